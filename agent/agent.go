@@ -163,7 +163,15 @@ func (tcp *TCPService) onClientMessage(client *Client, content []byte) {
 		var raw map[string]interface{}
 		err = json.Unmarshal(data, &raw)
 		if err == nil {
-			table := raw["database"].(string) + "." + raw["table"].(string)
+			table := ""
+			// 没有表的事件主题为空，与binlog中的主题一致
+			if raw["table"] != "" {
+				table = raw["database"].(string) + "." + raw["table"].(string)
+				// 多个数据源时主题带上数据源名称，与binlog中的主题一致
+				if source, ok := raw["source"].(string); ok && source != "" {
+					table = source + "." + table
+				}
+			}
 			for _, f := range tcp.onEvent {
 				f(table, data)
 			}
@@ -5,7 +5,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/siddontang/go-mysql/mysql"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/mia0x75/copycat/g"
@@ -14,6 +13,16 @@ import (
 
 // NewBinlog 创建一个binlog服务对象
 func NewBinlog(ctx *g.Context, opts ...Option) *Binlog {
+	binlog := newBinlog(ctx, opts...)
+	binlog.handlerInit()
+	go binlog.lookStartService()
+	go binlog.lookStopService()
+	go binlog.lookAckService()
+	return binlog
+}
+
+// 创建binlog服务对象，不连接数据库
+func newBinlog(ctx *g.Context, opts ...Option) *Binlog {
 	binlog := &Binlog{
 		wg:               new(sync.WaitGroup),                //
 		lock:             new(sync.Mutex),                    //
@@ -28,9 +37,6 @@ func NewBinlog(ctx *g.Context, opts ...Option) *Binlog {
 	for _, f := range opts {
 		f(binlog)
 	}
-	binlog.handlerInit()
-	go binlog.lookStartService()
-	go binlog.lookStopService()
 	return binlog
 }
 
@@ -90,7 +96,12 @@ func (h *Binlog) lookStartService() {
 				h.status |= binlogIsRunning
 				h.statusLock.Unlock()
 				log.Debug("[D] binlog service start")
+				done := make(chan struct{})
+				h.lock.Lock()
+				h.runDone = done
+				h.lock.Unlock()
 				go func() {
+					defer close(done)
 					start := time.Now().Unix()
 					for {
 						if h.lastBinFile == "" {
@@ -103,10 +114,6 @@ func (h *Binlog) lookStartService() {
 						}
 						break
 					}
-					startPos := mysql.Position{
-						Name: h.lastBinFile,
-						Pos:  h.lastPos,
-					}
 					for {
 						if h.handler == nil {
 							log.Warn("[W] binlog handler is nil, wait for init")
@@ -115,14 +122,8 @@ func (h *Binlog) lookStartService() {
 						}
 						break
 					}
-					err := h.handler.RunFrom(startPos)
-					if err != nil {
-						log.Warnf("[W] binlog service exit with error: %+v", err)
-						h.statusLock.Lock()
-						h.status ^= binlogIsRunning
-						h.statusLock.Unlock()
-						return
-					}
+					// 同步出错时自动重连，直到服务被停止或者超过重试次数
+					h.supervise()
 				}()
 				break
 			}
@@ -144,34 +145,23 @@ func (h *Binlog) lookStopService() {
 			if !ok {
 				return
 			}
+			// 先清除运行状态，同步协程据此判断是被停止而不是出错
+			// 同步协程退出前可能还在调用OnPosSynced，不能持有statusLock
 			h.statusLock.Lock()
-			if h.status&binlogIsRunning > 0 && !exit {
+			running := h.status&binlogIsRunning > 0
+			h.status &^= binlogIsRunning
+			h.statusLock.Unlock()
+			if running && !exit {
 				log.Debug("[D] binlog service stop")
-				h.handler.Close()
+				h.closeSyncer()
+				closeHandler(h.currentHandler())
 				//reset handler
 				h.setHandler()
 			}
-			h.statusLock.Unlock()
 
 			if exit {
-				h.lock.Lock()
-				r := packPos(h.lastBinFile, int64(h.lastPos), atomic.LoadInt64(&h.EventIndex))
-				h.lock.Unlock()
-				h.saveBinlogPositionCache(r)
-				h.statusLock.Lock()
-				if h.status&cacheHandlerIsOpened > 0 {
-					h.status ^= cacheHandlerIsOpened
-					h.statusLock.Unlock()
-					h.cacheHandler.Close()
-				} else {
-					h.statusLock.Unlock()
-				}
-			}
-			h.statusLock.Lock()
-			if h.status&binlogIsRunning > 0 {
-				h.status ^= binlogIsRunning
+				h.exitAcks()
 			}
-			h.statusLock.Unlock()
 		case <-h.ctx.Ctx.Done():
 			return
 		}
@@ -212,3 +202,43 @@ func (h *Binlog) OnLeader(isLeader bool) {
 		h.StopService(false)
 	}
 }
+
+// Status 服务状态，用于管理接口
+func (h *Binlog) Status() map[string]interface{} {
+	h.statusLock.Lock()
+	running := h.status&binlogIsRunning > 0
+	h.statusLock.Unlock()
+	h.lock.Lock()
+	file := h.lastBinFile
+	pos := h.lastPos
+	gtid := h.gtidString()
+	h.lock.Unlock()
+	status := make(map[string]interface{})
+	status["running"] = running
+	status["binlog_file"] = file
+	status["binlog_pos"] = pos
+	status["gtid_set"] = gtid
+	status["event_index"] = atomic.LoadInt64(&h.EventIndex)
+	if h.checkpoints != nil {
+		status["checkpoints"] = h.checkpoints.history()
+	}
+	status["pending_checkpoints"] = h.pendingAcks()
+	status["spill"] = h.spillStatus()
+	if retry := h.retryStatus(); retry != nil {
+		status["retry"] = retry
+	}
+	status["redact"] = h.redactStatus()
+	h.lock.Lock()
+	snapshot := h.snapshotting
+	h.lock.Unlock()
+	if snapshot != nil {
+		status["snapshot"] = snapshot.status()
+	}
+	h.lock.Lock()
+	resnapshot := h.resnapshot
+	h.lock.Unlock()
+	if resnapshot != nil {
+		status["table_snapshot"] = resnapshot.status()
+	}
+	return status
+}
@@ -0,0 +1,164 @@
+package binlog
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 确认驱动的检查点
+// canal同步到的位置不代表事件已经交付，服务的发送队列中可能还有事件，此时崩溃会丢失这些事件
+// 这里记录每个位置对应的各个服务已经接收的事件数量，只有所有服务都确认交付了这些事件，才保存该位置
+// 重启时从所有服务都确认过的位置开始同步，事件至少交付一次
+
+// 等待确认的位置
+type ackPos struct {
+	pos  []byte           // packPos打包的位置
+	sent map[string]int64 // 记录位置时每个服务已经接收的事件数量，key为服务名称
+}
+
+// 检查确认的间隔，没有新的位置时也需要定时检查
+const ackInterval = time.Second
+
+// 等待确认的位置的最大数量，超过时合并到最后一个位置，长时间没有确认时内存不会无限增长
+const maxPendingAcks = 10000
+
+// 记录一个等待确认的位置
+func (h *Binlog) ackPosition(r []byte) {
+	sent := make(map[string]int64)
+	h.lock.Lock()
+	for name, service := range h.services {
+		sent[name] = service.Sent()
+	}
+	if l := len(h.acks); l > 0 && (sameSent(h.acks[l-1].sent, sent) || l >= maxPendingAcks) {
+		// 两个位置之间没有新的事件，只需要保留后一个位置；
+		// 数量超过上限时也替换最后一个位置，后一个位置需要的确认更多，只是检查点更粗
+		h.acks[l-1].pos = r
+		h.acks[l-1].sent = sent
+	} else {
+		h.acks = append(h.acks, &ackPos{pos: r, sent: sent})
+	}
+	h.lock.Unlock()
+	h.flushAcks()
+}
+
+func sameSent(a, b map[string]int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// 保存已经确认的最新位置
+func (h *Binlog) flushAcks() {
+	if r := h.ackedPosition(); r != nil {
+		h.saveBinlogPositionCache(r)
+	}
+}
+
+// 取出已经被所有服务确认的位置，返回其中最新的一个，没有时返回nil
+func (h *Binlog) ackedPosition() []byte {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.acks) == 0 {
+		return nil
+	}
+	acked := make(map[string]int64)
+	for name, service := range h.services {
+		acked[name] = service.Acked()
+	}
+	var r []byte
+	n := 0
+	for _, a := range h.acks {
+		ok := true
+		for name, sent := range a.sent {
+			if v, exists := acked[name]; exists && v < sent {
+				ok = false
+				break
+			}
+		}
+		if !ok {
+			break
+		}
+		r = a.pos
+		n++
+	}
+	h.acks = h.acks[n:]
+	return r
+}
+
+// 等待确认的位置数量
+func (h *Binlog) pendingAcks() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.acks)
+}
+
+// 所有服务是否都已经确认交付了已经推送的事件
+func (h *Binlog) allAcked() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, service := range h.services {
+		if service.Acked() < service.Sent() {
+			return false
+		}
+	}
+	return true
+}
+
+// 等待快照已经推送的行被所有服务确认，之后才能保存快照进度
+// 否则崩溃时已经保存进度但没有交付的行会丢失
+func (h *Binlog) waitSnapshotAcked(name string) error {
+	start := time.Now()
+	warned := start
+	for !h.allAcked() {
+		if h.stopped() {
+			return fmt.Errorf("snapshot of %s stopped", name)
+		}
+		if time.Since(warned) >= time.Minute {
+			warned = time.Now()
+			log.Warnf("[W] snapshot of %s is waiting for services ack for %v", name, time.Since(start))
+		}
+		select {
+		case <-h.ctx.Ctx.Done():
+			return fmt.Errorf("snapshot of %s stopped", name)
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+	return nil
+}
+
+// 定时检查确认
+func (h *Binlog) lookAckService() {
+	h.wg.Add(1)
+	defer h.wg.Done()
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.flushAcks()
+			h.flushCheckpoint()
+		case <-h.ctx.Ctx.Done():
+			return
+		}
+	}
+}
+
+// 退出时保存已经确认的位置
+// 退出状态下saveBinlogPositionCache不再写入，这里直接写入检查点
+func (h *Binlog) exitAcks() {
+	if r := h.ackedPosition(); r != nil {
+		h.saveCheckpoint(r)
+	}
+	h.flushCheckpoint()
+	if n := h.pendingAcks(); n > 0 {
+		log.Warnf("[W] %d binlog positions are not acked, will resume from the last acked position", n)
+	}
+}
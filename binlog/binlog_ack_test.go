@@ -0,0 +1,73 @@
+package binlog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+
+	"github.com/mia0x75/copycat/g"
+	"github.com/mia0x75/copycat/services"
+)
+
+// 用于测试的服务，确认数量由测试控制
+type testAckService struct {
+	sent  int64
+	acked int64
+}
+
+func (s *testAckService) SendAll(table string, data []byte) bool {
+	s.sent++
+	return true
+}
+func (s *testAckService) Start()       {}
+func (s *testAckService) Close()       {}
+func (s *testAckService) Reload()      {}
+func (s *testAckService) Name() string { return "test" }
+func (s *testAckService) Sent() int64  { return s.sent }
+func (s *testAckService) Acked() int64 { return s.acked }
+
+// test ack-driven checkpoint
+// 服务确认交付之前不保存位置
+func TestBinlog_AckCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copycat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{Database: &g.DatabaseConfig{}}, &events)
+	h.checkpoints = newCheckpointFile(&g.CheckpointConfig{File: filepath.Join(dir, "checkpoint.json")})
+	s := &testAckService{}
+	h.services = map[string]services.IService{s.Name(): s}
+
+	testOnRow(h, newTestRowsEvent("a", 2))
+	h.OnPosSynced(mysql.Position{Name: "mysql-bin.000001", Pos: 300}, false)
+	testOnRow(h, newTestRowsEvent("a", 1))
+	h.OnPosSynced(mysql.Position{Name: "mysql-bin.000001", Pos: 400}, false)
+	// 没有新的事件，合并到上一个位置
+	h.OnPosSynced(mysql.Position{Name: "mysql-bin.000001", Pos: 450}, false)
+	if file, _, _, _ := h.getBinlogPositionCache(); file != "" {
+		t.Fatalf("position should not be saved before ack")
+	}
+	if n := h.pendingAcks(); n != 2 {
+		t.Errorf("expect 2 pending positions, got %d", n)
+	}
+	s.acked = 2
+	h.flushAcks()
+	if _, pos, _, _ := h.getBinlogPositionCache(); pos != 300 {
+		t.Errorf("expect acked pos 300, got %d", pos)
+	}
+	// 写入间隔内的检查点由定时器写入
+	s.acked = 3
+	h.flushAcks()
+	h.flushCheckpoint()
+	if _, pos, _, _ := h.getBinlogPositionCache(); pos != 450 {
+		t.Errorf("expect acked pos 450, got %d", pos)
+	}
+	if n := h.pendingAcks(); n != 0 {
+		t.Errorf("expect no pending positions, got %d", n)
+	}
+}
@@ -0,0 +1,253 @@
+package binlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// 同步位置检查点
+// 检查点文件为json，包含格式版本和最近的n个检查点，最新的在前，每个检查点带有校验和
+// 写入时先写临时文件并同步到磁盘，再改名覆盖，崩溃时不会留下写了一半的文件
+// 需要回滚时，将历史中的检查点移动到第一个即可
+// 每个事务提交都写入时fsync的开销很大，保留的历史也只覆盖几毫秒，因此：
+// 距离上次写入不到interval时只在内存中记录，由确认检查的定时器和退出时写入；
+// 历史中的检查点间隔至少history_interval，间隔内只更新最新的一个
+// 旧版本的二进制位置文件（/var/run/copycat/copycat.cache）在第一次读取时自动迁移
+const checkpointVersion = 1
+
+// 默认保留的检查点数量
+const checkpointDefaultKeep = 10
+
+// 默认的写入间隔和历史检查点的间隔，单位秒
+const (
+	checkpointDefaultInterval        = 1
+	checkpointDefaultHistoryInterval = 60
+)
+
+var errCheckpointChecksum = errors.New("checkpoint checksum mismatch")
+
+// 检查点文件
+type checkpointFile struct {
+	path            string        // 文件路径
+	legacy          string        // 旧版本的位置文件，用于迁移
+	keep            int           // 保留的检查点数量
+	interval        time.Duration // 两次写入的最小间隔
+	historyInterval int64         // 历史检查点的最小间隔，单位秒
+	lock            *sync.Mutex   //
+	data            checkpointData
+	pending         *checkpoint // 还没有写入的最新检查点
+	written         time.Time   // 上次写入的时间
+}
+
+// 检查点文件内容
+type checkpointData struct {
+	Version     int           `json:"version"`     // 格式版本
+	Checkpoints []*checkpoint `json:"checkpoints"` // 最新的在前
+}
+
+// 单个检查点
+type checkpoint struct {
+	File       string `json:"file"`        // binlog file
+	Pos        uint32 `json:"pos"`         // binlog pos
+	EventIndex int64  `json:"event_index"` // 事件索引
+	GTID       string `json:"gtid"`        // 已执行的gtid集合，仅gtid模式
+	Time       int64  `json:"time"`        // 写入时间
+	Checksum   uint32 `json:"checksum"`    // 以上字段的crc32
+}
+
+// 计算校验和
+func (c *checkpoint) sum() uint32 {
+	return crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s|%d|%d|%s|%d", c.File, c.Pos, c.EventIndex, c.GTID, c.Time)))
+}
+
+// 创建检查点文件，path为空时使用默认路径
+func newCheckpointFile(cfg *g.CheckpointConfig) *checkpointFile {
+	f := &checkpointFile{
+		path:            g.CHECKPOINT_FILE,
+		legacy:          g.MASTER_INFO_FILE,
+		keep:            checkpointDefaultKeep,
+		interval:        time.Second * checkpointDefaultInterval,
+		historyInterval: checkpointDefaultHistoryInterval,
+		lock:            new(sync.Mutex),
+		data:            checkpointData{Version: checkpointVersion, Checkpoints: make([]*checkpoint, 0)},
+	}
+	if cfg != nil {
+		if cfg.File != "" {
+			f.path = cfg.File
+		}
+		if cfg.Keep > 0 {
+			f.keep = cfg.Keep
+		}
+		if cfg.Interval > 0 {
+			f.interval = time.Second * time.Duration(cfg.Interval)
+		}
+		if cfg.HistoryInterval > 0 {
+			f.historyInterval = int64(cfg.HistoryInterval)
+		}
+	}
+	return f
+}
+
+// 读取最新的有效检查点，没有时返回nil
+// 文件不存在时从旧版本的位置文件迁移，校验失败的检查点被跳过，相当于回滚到上一个检查点
+func (f *checkpointFile) load() (*checkpoint, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		if f.legacy == "" {
+			return nil, nil
+		}
+		if data, err = ioutil.ReadFile(f.legacy); err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return f.migrate(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+	if data[0] != '{' {
+		// 配置的路径是旧版本的位置文件
+		return f.migrate(data)
+	}
+	var d checkpointData
+	if err = json.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	if d.Version > checkpointVersion {
+		return nil, fmt.Errorf("unsupported checkpoint version %d", d.Version)
+	}
+	valid := make([]*checkpoint, 0)
+	for _, c := range d.Checkpoints {
+		if c == nil || c.sum() != c.Checksum {
+			log.Warnf("[W] skip invalid checkpoint: %+v", c)
+			continue
+		}
+		valid = append(valid, c)
+	}
+	f.data = checkpointData{Version: checkpointVersion, Checkpoints: valid}
+	if len(valid) == 0 {
+		if len(d.Checkpoints) > 0 {
+			return nil, errCheckpointChecksum
+		}
+		return nil, nil
+	}
+	return valid[0], nil
+}
+
+// 从旧版本的二进制位置文件迁移
+func (f *checkpointFile) migrate(data []byte) (*checkpoint, error) {
+	file, pos, index, gtid := unpackPos(data)
+	if file == "" {
+		return nil, nil
+	}
+	c := &checkpoint{File: file, Pos: uint32(pos), EventIndex: index, GTID: gtid, Time: time.Now().Unix()}
+	c.Checksum = c.sum()
+	if err := f.write(c); err != nil {
+		return nil, err
+	}
+	log.Infof("[I] migrate binlog position from %s to %s: %s:%d", f.legacy, f.path, file, pos)
+	return c, nil
+}
+
+// 保存一个检查点，距离上次写入不到interval时先记录在内存中，由flush写入
+func (f *checkpointFile) save(file string, pos uint32, eventIndex int64, gtid string) error {
+	c := &checkpoint{File: file, Pos: pos, EventIndex: eventIndex, GTID: gtid, Time: time.Now().Unix()}
+	c.Checksum = c.sum()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if time.Since(f.written) < f.interval {
+		f.pending = c
+		return nil
+	}
+	return f.write(c)
+}
+
+// 写入内存中还没有写入的检查点，定时和退出时调用
+func (f *checkpointFile) flush() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.pending == nil {
+		return nil
+	}
+	return f.write(f.pending)
+}
+
+// 写入检查点，调用方需持有f.lock
+// 最新的检查点距离上一个历史检查点不到historyInterval时被c替换，否则保留在历史中
+func (f *checkpointFile) write(c *checkpoint) error {
+	checkpoints := f.data.Checkpoints
+	if len(checkpoints) > 1 && checkpoints[0].Time-checkpoints[1].Time < f.historyInterval {
+		checkpoints = checkpoints[1:]
+	}
+	checkpoints = append([]*checkpoint{c}, checkpoints...)
+	if len(checkpoints) > f.keep {
+		checkpoints = checkpoints[:f.keep]
+	}
+	d := checkpointData{Version: checkpointVersion, Checkpoints: checkpoints}
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = writeFileSync(f.path, data); err != nil {
+		return err
+	}
+	f.data = d
+	f.pending = nil
+	f.written = time.Now()
+	return nil
+}
+
+// 历史检查点，用于管理接口
+func (f *checkpointFile) history() []*checkpoint {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]*checkpoint{}, f.data.Checkpoints...)
+}
+
+// 先写临时文件并同步到磁盘，再改名覆盖
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	fp, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+	if err = fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err = fp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+	// 同步目录，保证改名本身落盘
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
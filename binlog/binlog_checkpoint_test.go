@@ -0,0 +1,119 @@
+package binlog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// test checkpoint file
+// 保留最近的n个检查点，校验失败时使用上一个检查点
+func TestCheckpointFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copycat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.json")
+	f := newCheckpointFile(&g.CheckpointConfig{File: path, Keep: 2})
+	f.legacy = filepath.Join(dir, "copycat.cache")
+	f.interval, f.historyInterval = 0, 0
+	if c, err := f.load(); c != nil || err != nil {
+		t.Fatalf("empty checkpoint error: %+v, %v", c, err)
+	}
+	for i := uint32(1); i <= 3; i++ {
+		if err = f.save("mysql-bin.000001", i*100, int64(i), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h := f.history(); len(h) != 2 || h[0].Pos != 300 || h[1].Pos != 200 {
+		t.Errorf("checkpoint history error: %+v", h)
+	}
+
+	// 篡改最新的检查点
+	data, _ := ioutil.ReadFile(path)
+	var d checkpointData
+	json.Unmarshal(data, &d)
+	d.Checkpoints[0].Pos = 999
+	data, _ = json.Marshal(d)
+	ioutil.WriteFile(path, data, 0644)
+	f = newCheckpointFile(&g.CheckpointConfig{File: path})
+	c, err := f.load()
+	if err != nil || c == nil || c.Pos != 200 {
+		t.Errorf("invalid checkpoint should be skipped: %+v, %v", c, err)
+	}
+}
+
+// test checkpoint throttle
+// 写入间隔内只记录在内存中，历史检查点的间隔至少为history_interval
+func TestCheckpointFile_Throttle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copycat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.json")
+	f := newCheckpointFile(&g.CheckpointConfig{File: path, Keep: 5, Interval: 60, HistoryInterval: 60})
+	for i := uint32(1); i <= 3; i++ {
+		if err = f.save("mysql-bin.000001", i*100, int64(i), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h := f.history(); len(h) != 1 || h[0].Pos != 100 {
+		t.Errorf("checkpoints in the interval should not be written: %+v", h)
+	}
+	if err = f.flush(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newCheckpointFile(&g.CheckpointConfig{File: path}).load()
+	if err != nil || c == nil || c.Pos != 300 {
+		t.Errorf("pending checkpoint should be flushed: %+v, %v", c, err)
+	}
+
+	// 历史中只保留间隔足够的检查点
+	f = newCheckpointFile(&g.CheckpointConfig{File: path, Keep: 5, HistoryInterval: 60})
+	for i, ts := range []int64{0, 10, 20, 70, 80, 130} {
+		c := &checkpoint{File: "mysql-bin.000001", Pos: uint32(i), Time: ts}
+		c.Checksum = c.sum()
+		if err = f.write(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := f.history()
+	times := make([]int64, 0)
+	for _, c := range h {
+		times = append(times, c.Time)
+	}
+	if len(times) != 3 || times[0] != 130 || times[1] != 70 || times[2] != 0 {
+		t.Errorf("checkpoint history should be coarse: %v", times)
+	}
+}
+
+// test migrate from the old binary cache
+func TestCheckpointFile_Migrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copycat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	legacy := filepath.Join(dir, "copycat.cache")
+	ioutil.WriteFile(legacy, packPos("mysql-bin.000059", 123456, 20, "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5"), 0644)
+	for _, path := range []string{filepath.Join(dir, "checkpoint.json"), legacy} {
+		f := newCheckpointFile(&g.CheckpointConfig{File: path})
+		f.legacy = legacy
+		c, err := f.load()
+		if err != nil || c == nil || c.File != "mysql-bin.000059" || c.Pos != 123456 || c.EventIndex != 20 ||
+			c.GTID != "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5" {
+			t.Errorf("migrate %s error: %+v, %v", path, c, err)
+		}
+		// 迁移后为新格式
+		f = newCheckpointFile(&g.CheckpointConfig{File: path})
+		if c, err = f.load(); err != nil || c == nil || c.Pos != 123456 {
+			t.Errorf("load migrated %s error: %+v, %v", path, c, err)
+		}
+	}
+}
@@ -1,10 +1,11 @@
 package binlog
 
 import (
-	"os"
 	"sync"
 
 	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
 
 	"github.com/mia0x75/copycat/g"
 	"github.com/mia0x75/copycat/services"
@@ -12,24 +13,47 @@ import (
 
 // Binlog TODO
 type Binlog struct {
-	canal.DummyEventHandler                              // github.com/siddontang/go-mysql interface
-	handler                 *canal.Canal                 // github.com/siddontang/go-mysql mysql protocol handler
-	ctx                     *g.Context                   // context, like that use for wait coroutine exit
-	wg                      *sync.WaitGroup              // use for wait coroutine exit
-	lock                    *sync.Mutex                  // lock
-	statusLock              *sync.Mutex                  // status lock
-	EventIndex              int64                        // event unique index
-	services                map[string]services.IService // registered service, key is the name of the service
-	cacheHandler            *os.File                     // cache handler, binlog_handler.go SaveBinlogPostionCache and getBinlogPositionCache
-	lastPos                 uint32                       // the last read pos
-	lastBinFile             string                       // the last read binlog file
-	startServiceChan        chan struct{}                //
-	stopServiceChan         chan bool                    //
-	status                  int                          // binlog status
+	handler          *canal.Canal                 // github.com/siddontang/go-mysql mysql protocol handler
+	syncer           *replication.BinlogSyncer    // the binlog stream of the live sync, see binlog_stream.go
+	name             string                       // the source name, empty when there is only one source
+	ctx              *g.Context                   // context, like that use for wait coroutine exit
+	wg               *sync.WaitGroup              // use for wait coroutine exit
+	lock             *sync.Mutex                  // lock
+	statusLock       *sync.Mutex                  // status lock
+	EventIndex       int64                        // event unique index
+	services         map[string]services.IService // registered service, key is the name of the service
+	checkpoints      *checkpointFile              // the position checkpoint file, binlog_handler.go saveBinlogPositionCache and getBinlogPositionCache
+	lastPos          uint32                       // the last read pos
+	lastBinFile      string                       // the last read binlog file
+	serverID         uint32                       // the server id of master
+	gtidSet          mysql.GTIDSet                // the executed gtid set, only used in gtid sync mode
+	pendingGTID      mysql.GTIDSet                // the gtid of the transaction in progress
+	tx               *transaction                 // the buffered rows of the transaction in progress
+	txEvents         int                          // the rows events of the transaction in progress including the filtered ones, use for the event id
+	rowsQuery        string                       // the statement of the following rows events, from the rows_query or annotate_rows event
+	rowsQueryRule    *rowsQueryRules              // the compiled rows_query table rules
+	updateFormat     *updateFormats               // the compiled update_format rules
+	spill            spillStats                   // the statistics of the transactions spilled to disk
+	schemas          *schemaHistory               // the table schema history, use for decode old binlog
+	uniqueKeys       map[string][]string          // the unique key columns of the tables without primary key
+	filter           *tableFilter                 // the include and exclude table rules
+	runDone          chan struct{}                // closed when the binlog sync goroutine exit
+	streamEvents     int64                        // the events read from the binlog stream, use for waiting on the stream progress
+	redactor         *redactor                    // the compiled column redaction rules
+	snapshotting     *snapshotState               // the initial snapshot progress
+	resnapshot       *tableSnapshot               // the last admin-triggered table snapshot
+	acks             []*ackPos                    // the positions waiting for the services to ack
+	retry            *retryState                  // the reconnect state of the binlog stream
+	snapshotForced   bool                         // a fresh snapshot is required, e.g. the position has been purged
+	gap              map[string]interface{}       // the gap event waiting to be sent before the sync starts
+	startServiceChan chan struct{}                //
+	stopServiceChan  chan bool                    //
+	status           int                          // binlog status
 
 	//pos change 回调函数
 	onPosChanges []PosChangeFunc
 	onEvent      []OnEventFunc
+	transformers []Transformer
 }
 
 // Option TODO
@@ -41,8 +65,23 @@ type PosChangeFunc func(r []byte)
 // OnEventFunc TODO
 type OnEventFunc func(table string, data []byte)
 
+// ddl事件类型
+const eventTypeDDL = "ddl"
+
+// update事件格式
+const (
+	updateFormatFull  = "full"  // 完整的修改前后数据
+	updateFormatDiff  = "diff"  // 只有修改的列和主键
+	updateFormatAfter = "after" // 完整的修改后数据和修改的列名
+)
+
+// 同步模式
+const (
+	syncModePosition = "position" // 从binlog file和pos开始同步
+	syncModeGTID     = "gtid"     // 从gtid集合开始同步
+)
+
 const (
 	binlogIsRunning = 1 << iota
 	binlogIsExit
-	cacheHandlerIsOpened
 )
@@ -0,0 +1,573 @@
+package binlog
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pingcap/tidb/pkg/parser"
+	"github.com/pingcap/tidb/pkg/parser/ast"
+	_ "github.com/pingcap/tidb/pkg/parser/test_driver" // 解析器需要的表达式实现
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// 按ddl语句推导表结构的新版本
+// 回放或者追赶旧的binlog时，数据库中的表结构可能已经经过了之后的ddl，不能直接读取，
+// 这里用tidb的sql解析器解析ddl，在上一个版本的基础上应用列、主键、唯一索引和非空约束的变化，
+// 其它表选项、分区等不影响行事件的解析，直接忽略
+// 支持CREATE TABLE（含LIKE）、ALTER TABLE、RENAME TABLE、DROP TABLE、CREATE INDEX、DROP INDEX，
+// TRUNCATE以及库、视图等其它ddl不改变表结构
+
+// ddl对一个表的结构变化
+type ddlChange struct {
+	key     string         // db.table
+	version *schemaVersion // 新的表结构，表被删除时Table为nil，位置由调用方填写
+}
+
+// 主键索引名
+const primaryIndex = "PRIMARY"
+
+// mariadb的ALTER ONLINE TABLE，解析器不支持ONLINE，不影响表结构，去掉后再解析
+var ddlOnlineExp = regexp.MustCompile("(?i)^(\\s*ALTER\\s+)ONLINE\\s+")
+
+// 推导ddl之后的表结构
+// db为执行ddl时的当前库，prev返回ddl之前的表结构版本，表不存在或者没有记录时返回nil
+// 返回按顺序的表结构变化，无法推导时返回错误
+func evolveSchema(query, db string, prev func(key string) *schemaVersion) ([]ddlChange, error) {
+	query = ddlOnlineExp.ReplaceAllString(query, "$1")
+	stmts, _, err := parser.New().Parse(query, "", "")
+	if err != nil {
+		return nil, err
+	}
+	e := &ddlEvolver{db: db, prev: prev, tables: make(map[string]*schemaVersion)}
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ast.CreateTableStmt:
+			err = e.create(s)
+		case *ast.AlterTableStmt:
+			err = e.alter(s)
+		case *ast.RenameTableStmt:
+			err = e.rename(s)
+		case *ast.DropTableStmt:
+			err = e.drop(s)
+		case *ast.CreateIndexStmt:
+			err = e.createIndex(s)
+		case *ast.DropIndexStmt:
+			err = e.dropIndex(s)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e.changes(), nil
+}
+
+// 一条ddl的推导过程，tables记录已经修改过的表，rename a to b, b to c这样的语句依赖前面的修改
+type ddlEvolver struct {
+	db     string
+	prev   func(key string) *schemaVersion
+	tables map[string]*schemaVersion
+	keys   []string // 修改的顺序
+}
+
+// 表的当前结构，表不存在时返回nil
+func (e *ddlEvolver) get(key string) *schemaVersion {
+	if v, ok := e.tables[key]; ok {
+		return v
+	}
+	if v := e.prev(key); v != nil && v.Table != nil {
+		return v
+	}
+	return nil
+}
+
+// 记录表的新结构
+func (e *ddlEvolver) set(key string, v *schemaVersion) {
+	if _, ok := e.tables[key]; !ok {
+		e.keys = append(e.keys, key)
+	}
+	if v == nil {
+		v = &schemaVersion{}
+	}
+	e.tables[key] = v
+}
+
+func (e *ddlEvolver) changes() []ddlChange {
+	changes := make([]ddlChange, 0, len(e.keys))
+	for _, key := range e.keys {
+		changes = append(changes, ddlChange{key: key, version: e.tables[key]})
+	}
+	return changes
+}
+
+// 库名和表名，语句中没有指定库名时使用当前库
+func (e *ddlEvolver) tableName(t *ast.TableName) (string, string) {
+	if t.Schema.O != "" {
+		return t.Schema.O, t.Name.O
+	}
+	return e.db, t.Name.O
+}
+
+func (e *ddlEvolver) tableKey(t *ast.TableName) string {
+	db, name := e.tableName(t)
+	return db + "." + name
+}
+
+// 修改的表，没有记录时无法推导
+func (e *ddlEvolver) alterTable(t *ast.TableName) (*tableAlter, string, error) {
+	key := e.tableKey(t)
+	v := e.get(key)
+	if v == nil {
+		return nil, key, fmt.Errorf("table %s not tracked", key)
+	}
+	return &tableAlter{v: copyVersion(v)}, key, nil
+}
+
+func (e *ddlEvolver) create(s *ast.CreateTableStmt) error {
+	key := e.tableKey(s.Table)
+	if s.IfNotExists && e.get(key) != nil {
+		return nil
+	}
+	if s.Select != nil {
+		// 列由查询结果决定
+		return fmt.Errorf("create table %s from select is not supported", key)
+	}
+	db, name := e.tableName(s.Table)
+	if s.ReferTable != nil {
+		refer := e.tableKey(s.ReferTable)
+		v := e.get(refer)
+		if v == nil {
+			return fmt.Errorf("table %s not tracked", refer)
+		}
+		v = copyVersion(v)
+		v.Table.Schema, v.Table.Name = db, name
+		e.set(key, v)
+		return nil
+	}
+	a := &tableAlter{v: &schemaVersion{
+		Table:   &schema.Table{Schema: db, Name: name},
+		Unique:  make([]string, 0),
+		NotNull: make([]string, 0),
+	}}
+	for _, col := range s.Cols {
+		if err := a.addColumn(col, nil); err != nil {
+			return err
+		}
+	}
+	for _, c := range s.Constraints {
+		a.addConstraint(c)
+	}
+	e.set(key, a.done())
+	return nil
+}
+
+func (e *ddlEvolver) alter(s *ast.AlterTableStmt) error {
+	a, key, err := e.alterTable(s.Table)
+	if err != nil {
+		return err
+	}
+	var rename *ast.TableName
+	for _, spec := range s.Specs {
+		switch spec.Tp {
+		case ast.AlterTableAddColumns:
+			for _, col := range spec.NewColumns {
+				if spec.IfNotExists && a.column(col.Name.Name.O) >= 0 {
+					continue
+				}
+				if err = a.addColumn(col, spec.Position); err != nil {
+					return err
+				}
+			}
+			for _, c := range spec.NewConstraints {
+				a.addConstraint(c)
+			}
+		case ast.AlterTableAddConstraint:
+			a.addConstraint(spec.Constraint)
+		case ast.AlterTableDropColumn:
+			if spec.IfExists && a.column(spec.OldColumnName.Name.O) < 0 {
+				continue
+			}
+			err = a.dropColumn(spec.OldColumnName.Name.O)
+		case ast.AlterTableDropPrimaryKey:
+			a.dropIndex(primaryIndex)
+		case ast.AlterTableDropIndex:
+			a.dropIndex(spec.Name)
+		case ast.AlterTableModifyColumn:
+			err = a.changeColumn(spec.NewColumns[0].Name.Name.O, spec.NewColumns[0], spec.Position)
+		case ast.AlterTableChangeColumn:
+			err = a.changeColumn(spec.OldColumnName.Name.O, spec.NewColumns[0], spec.Position)
+		case ast.AlterTableRenameColumn:
+			err = a.renameColumn(spec.OldColumnName.Name.O, spec.NewColumnName.Name.O)
+		case ast.AlterTableRenameIndex:
+			a.renameIndex(spec.FromKey.O, spec.ToKey.O)
+		case ast.AlterTableRenameTable:
+			rename = spec.NewTable
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if rename != nil {
+		// 改名在其它修改之后生效
+		e.set(key, nil)
+		key = e.tableKey(rename)
+		a.v.Table.Schema, a.v.Table.Name = e.tableName(rename)
+	}
+	e.set(key, a.done())
+	return nil
+}
+
+func (e *ddlEvolver) rename(s *ast.RenameTableStmt) error {
+	for _, t := range s.TableToTables {
+		a, key, err := e.alterTable(t.OldTable)
+		if err != nil {
+			return err
+		}
+		e.set(key, nil)
+		a.v.Table.Schema, a.v.Table.Name = e.tableName(t.NewTable)
+		e.set(e.tableKey(t.NewTable), a.v)
+	}
+	return nil
+}
+
+func (e *ddlEvolver) drop(s *ast.DropTableStmt) error {
+	if s.IsView {
+		return nil
+	}
+	for _, t := range s.Tables {
+		e.set(e.tableKey(t), nil)
+	}
+	return nil
+}
+
+func (e *ddlEvolver) createIndex(s *ast.CreateIndexStmt) error {
+	a, key, err := e.alterTable(s.Table)
+	if err != nil {
+		return err
+	}
+	if s.IfNotExists && a.index(s.IndexName) >= 0 {
+		return nil
+	}
+	a.addIndex(s.IndexName, s.IndexPartSpecifications, s.KeyType == ast.IndexKeyTypeUnique)
+	e.set(key, a.done())
+	return nil
+}
+
+func (e *ddlEvolver) dropIndex(s *ast.DropIndexStmt) error {
+	a, key, err := e.alterTable(s.Table)
+	if err != nil {
+		return err
+	}
+	a.dropIndex(s.IndexName)
+	e.set(key, a.done())
+	return nil
+}
+
+// 修改中的表结构，v是上一个版本的副本
+type tableAlter struct {
+	v *schemaVersion
+}
+
+// 列的位置，列名不区分大小写，不存在时返回-1
+func (a *tableAlter) column(name string) int {
+	for i, col := range a.v.Table.Columns {
+		if strings.EqualFold(col.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// 索引的位置，不存在时返回-1
+func (a *tableAlter) index(name string) int {
+	for i, index := range a.v.Table.Indexes {
+		if strings.EqualFold(index.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// 按定义添加列，pos为nil时添加到最后
+func (a *tableAlter) addColumn(def *ast.ColumnDef, pos *ast.ColumnPosition) error {
+	name := def.Name.Name.O
+	if a.column(name) >= 0 {
+		return fmt.Errorf("column %s already exists", name)
+	}
+	i, err := a.position(pos, len(a.v.Table.Columns))
+	if err != nil {
+		return err
+	}
+	a.insertColumn(i, def)
+	return nil
+}
+
+// MODIFY和CHANGE，列定义整体替换，pos为nil时位置不变
+func (a *tableAlter) changeColumn(old string, def *ast.ColumnDef, pos *ast.ColumnPosition) error {
+	i := a.column(old)
+	if i < 0 {
+		return fmt.Errorf("column %s not found", old)
+	}
+	name := def.Name.Name.O
+	if j := a.column(name); j >= 0 && j != i {
+		return fmt.Errorf("column %s already exists", name)
+	}
+	if err := a.renameColumn(old, name); err != nil {
+		return err
+	}
+	a.v.Table.Columns = append(a.v.Table.Columns[:i], a.v.Table.Columns[i+1:]...)
+	a.v.NotNull = removeName(a.v.NotNull, name)
+	if pos != nil && pos.Tp != ast.ColumnPositionNone {
+		var err error
+		if i, err = a.position(pos, i); err != nil {
+			return err
+		}
+	}
+	a.insertColumn(i, def)
+	return nil
+}
+
+// 列改名，索引和非空约束中的列名一起修改
+func (a *tableAlter) renameColumn(old, name string) error {
+	i := a.column(old)
+	if i < 0 {
+		return fmt.Errorf("column %s not found", old)
+	}
+	old = a.v.Table.Columns[i].Name
+	a.v.Table.Columns[i].Name = name
+	for _, index := range a.v.Table.Indexes {
+		for j, column := range index.Columns {
+			if strings.EqualFold(column, old) {
+				index.Columns[j] = name
+			}
+		}
+	}
+	for j, column := range a.v.NotNull {
+		if strings.EqualFold(column, old) {
+			a.v.NotNull[j] = name
+		}
+	}
+	return nil
+}
+
+// 删除列，列从所在的索引中移除，没有列的索引一起删除
+func (a *tableAlter) dropColumn(name string) error {
+	i := a.column(name)
+	if i < 0 {
+		return fmt.Errorf("column %s not found", name)
+	}
+	name = a.v.Table.Columns[i].Name
+	a.v.Table.Columns = append(a.v.Table.Columns[:i], a.v.Table.Columns[i+1:]...)
+	a.v.NotNull = removeName(a.v.NotNull, name)
+	indexes := a.v.Table.Indexes[:0]
+	for _, index := range a.v.Table.Indexes {
+		columns := index.Columns[:0]
+		for _, column := range index.Columns {
+			if !strings.EqualFold(column, name) {
+				columns = append(columns, column)
+			}
+		}
+		index.Columns = columns
+		index.Cardinality = index.Cardinality[:len(columns)]
+		if len(columns) > 0 {
+			indexes = append(indexes, index)
+		} else {
+			a.v.Unique = removeName(a.v.Unique, index.Name)
+		}
+	}
+	a.v.Table.Indexes = indexes
+	return nil
+}
+
+// 新列的位置，FIRST或者AFTER某一列，没有指定时为def
+func (a *tableAlter) position(pos *ast.ColumnPosition, def int) (int, error) {
+	if pos == nil {
+		return def, nil
+	}
+	switch pos.Tp {
+	case ast.ColumnPositionFirst:
+		return 0, nil
+	case ast.ColumnPositionAfter:
+		i := a.column(pos.RelativeColumn.Name.O)
+		if i < 0 {
+			return 0, fmt.Errorf("column %s not found", pos.RelativeColumn.Name.O)
+		}
+		return i + 1, nil
+	}
+	return def, nil
+}
+
+// 在位置i插入列，列定义中的主键、唯一和非空约束同时生效
+func (a *tableAlter) insertColumn(i int, def *ast.ColumnDef) {
+	name := def.Name.Name.O
+	collation, extra := def.Tp.GetCollate(), ""
+	notNull, primary, unique := false, false, false
+	for _, o := range def.Options {
+		switch o.Tp {
+		case ast.ColumnOptionNotNull:
+			notNull = true
+		case ast.ColumnOptionNull:
+			notNull = false
+		case ast.ColumnOptionPrimaryKey:
+			primary = true
+		case ast.ColumnOptionUniqKey:
+			unique = true
+		case ast.ColumnOptionAutoIncrement:
+			extra = "auto_increment"
+		case ast.ColumnOptionCollate:
+			collation = o.StrValue
+		}
+	}
+	t := &schema.Table{}
+	t.AddColumn(name, columnType(def), collation, extra)
+	columns := a.v.Table.Columns
+	a.v.Table.Columns = append(append(append([]schema.TableColumn{}, columns[:i]...), t.Columns[0]), columns[i:]...)
+	if notNull {
+		a.v.NotNull = append(a.v.NotNull, name)
+	}
+	part := []*ast.IndexPartSpecification{{Column: def.Name}}
+	if primary {
+		a.setPrimary(part)
+	}
+	if unique {
+		a.addIndex("", part, true)
+	}
+}
+
+// 添加表定义中的约束，主键和唯一索引之外的索引只记录名称和列
+func (a *tableAlter) addConstraint(c *ast.Constraint) {
+	if c.IfNotExists && c.Name != "" && a.index(c.Name) >= 0 {
+		return
+	}
+	switch c.Tp {
+	case ast.ConstraintPrimaryKey:
+		a.setPrimary(c.Keys)
+	case ast.ConstraintUniq, ast.ConstraintUniqKey, ast.ConstraintUniqIndex:
+		a.addIndex(c.Name, c.Keys, true)
+	case ast.ConstraintKey, ast.ConstraintIndex, ast.ConstraintFulltext:
+		a.addIndex(c.Name, c.Keys, false)
+	}
+}
+
+func (a *tableAlter) setPrimary(keys []*ast.IndexPartSpecification) {
+	a.dropIndex(primaryIndex)
+	a.addIndex(primaryIndex, keys, false)
+}
+
+// 添加索引，没有指定名称时和mysql一样使用第一列的列名，重名时加上序号
+// 表达式索引的列记为空，不能作为行的标识
+func (a *tableAlter) addIndex(name string, keys []*ast.IndexPartSpecification, unique bool) {
+	index := schema.NewIndex("")
+	for _, key := range keys {
+		column := ""
+		if key.Column != nil {
+			if i := a.column(key.Column.Name.O); i >= 0 {
+				column = a.v.Table.Columns[i].Name
+			}
+		}
+		index.AddColumn(column, 0)
+	}
+	if name == "" && len(index.Columns) > 0 {
+		name = index.Columns[0]
+		for n := 2; a.index(name) >= 0; n++ {
+			name = fmt.Sprintf("%s_%d", index.Columns[0], n)
+		}
+	}
+	index.Name = name
+	a.v.Table.Indexes = append(a.v.Table.Indexes, index)
+	if unique {
+		a.v.Unique = append(a.v.Unique, name)
+	}
+}
+
+func (a *tableAlter) dropIndex(name string) {
+	if i := a.index(name); i >= 0 {
+		name = a.v.Table.Indexes[i].Name
+		a.v.Table.Indexes = append(a.v.Table.Indexes[:i], a.v.Table.Indexes[i+1:]...)
+		a.v.Unique = removeName(a.v.Unique, name)
+	}
+}
+
+func (a *tableAlter) renameIndex(old, name string) {
+	if i := a.index(old); i >= 0 {
+		old = a.v.Table.Indexes[i].Name
+		a.v.Table.Indexes[i].Name = name
+		for j, unique := range a.v.Unique {
+			if unique == old {
+				a.v.Unique[j] = name
+			}
+		}
+	}
+}
+
+// 重新计算主键和无符号列的下标，主键的列都不能为null
+func (a *tableAlter) done() *schemaVersion {
+	t := a.v.Table
+	t.PKColumns = make([]int, 0)
+	t.UnsignedColumns = make([]int, 0)
+	for i, col := range t.Columns {
+		if col.IsUnsigned {
+			t.UnsignedColumns = append(t.UnsignedColumns, i)
+		}
+	}
+	if i := a.index(primaryIndex); i >= 0 {
+		for _, column := range t.Indexes[i].Columns {
+			if j := a.column(column); j >= 0 {
+				t.PKColumns = append(t.PKColumns, j)
+			}
+			if !hasName(a.v.NotNull, column) {
+				a.v.NotNull = append(a.v.NotNull, column)
+			}
+		}
+	}
+	return a.v
+}
+
+// 列类型，与information_schema.COLUMNS的COLUMN_TYPE格式一致
+func columnType(def *ast.ColumnDef) string {
+	typ := def.Tp.InfoSchemaStr()
+	if strings.HasPrefix(typ, "year") {
+		// 解析器中year没有显示宽度
+		return "year"
+	}
+	return typ
+}
+
+func hasName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func removeName(names []string, name string) []string {
+	r := make([]string, 0, len(names))
+	for _, n := range names {
+		if !strings.EqualFold(n, name) {
+			r = append(r, n)
+		}
+	}
+	return r
+}
+
+// 复制表结构版本，推导时不修改上一个版本
+func copyVersion(v *schemaVersion) *schemaVersion {
+	t := *v.Table
+	t.Columns = append([]schema.TableColumn{}, v.Table.Columns...)
+	t.PKColumns = append([]int{}, v.Table.PKColumns...)
+	t.UnsignedColumns = append([]int{}, v.Table.UnsignedColumns...)
+	t.Indexes = make([]*schema.Index, 0, len(v.Table.Indexes))
+	for _, index := range v.Table.Indexes {
+		i := *index
+		i.Columns = append([]string{}, index.Columns...)
+		i.Cardinality = append([]uint64{}, index.Cardinality...)
+		t.Indexes = append(t.Indexes, &i)
+	}
+	return &schemaVersion{
+		Table:   &t,
+		Unique:  append([]string{}, v.Unique...),
+		NotNull: append([]string{}, v.NotNull...),
+	}
+}
@@ -0,0 +1,155 @@
+package binlog
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// 表结构的列名、类型和主键，用于比较
+func describeTable(t *schema.Table) []string {
+	if t == nil {
+		return nil
+	}
+	r := make([]string, 0)
+	for i, col := range t.Columns {
+		s := col.Name + " " + col.RawType
+		for _, pk := range t.PKColumns {
+			if pk == i {
+				s += " pk"
+			}
+		}
+		r = append(r, s)
+	}
+	return r
+}
+
+// test evolve schema by ddl
+// 在上一个版本的基础上推导ddl之后的表结构
+func TestEvolveSchema(t *testing.T) {
+	tables := make(map[string]*schemaVersion)
+	prev := func(key string) *schemaVersion {
+		return tables[key]
+	}
+	apply := func(query string) []ddlChange {
+		changes, err := evolveSchema(query, "test", prev)
+		if err != nil {
+			t.Fatalf("%s with error: %v", query, err)
+		}
+		for _, c := range changes {
+			tables[c.key] = c.version
+		}
+		return changes
+	}
+	table := func(key string) *schema.Table {
+		if v := tables[key]; v != nil {
+			return v.Table
+		}
+		return nil
+	}
+
+	apply("CREATE TABLE `a` (\n`id` int(11) unsigned NOT NULL AUTO_INCREMENT,\n`name` varchar(20) DEFAULT 'a,b' COMMENT 'name (x)',\n" +
+		"`amount` DECIMAL(10, 2),\nPRIMARY KEY (`id`),\nUNIQUE KEY `uk_name` (`name`(10))\n) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4")
+	first := tables["test.a"]
+	a := first.Table
+	if expect := []string{"id int(11) unsigned pk", "name varchar(20)", "amount decimal(10,2)"}; !reflect.DeepEqual(describeTable(a), expect) {
+		t.Fatalf("create expect %v, got %v", expect, describeTable(a))
+	}
+	if !a.Columns[0].IsAuto || !reflect.DeepEqual(a.UnsignedColumns, []int{0}) || a.Columns[2].Type != schema.TYPE_DECIMAL {
+		t.Errorf("unexpected columns: %+v", a.Columns)
+	}
+	if len(a.Indexes) != 2 || a.Indexes[1].Name != "uk_name" || a.Indexes[1].Columns[0] != "name" {
+		t.Errorf("unexpected indexes: %+v", a.Indexes)
+	}
+	if !reflect.DeepEqual(first.Unique, []string{"uk_name"}) || !reflect.DeepEqual(first.NotNull, []string{"id"}) {
+		t.Errorf("unexpected keys: %v, %v", first.Unique, first.NotNull)
+	}
+
+	cases := []struct {
+		query  string
+		expect []string
+	}{
+		{"ALTER TABLE a ADD COLUMN `age` TINYINT AFTER `id`, ADD INDEX (age)",
+			[]string{"id int(11) unsigned pk", "age tinyint(4)", "name varchar(20)", "amount decimal(10,2)"}},
+		{"ALTER TABLE test.a DROP COLUMN amount, ALGORITHM=INPLACE, LOCK=NONE",
+			[]string{"id int(11) unsigned pk", "age tinyint(4)", "name varchar(20)"}},
+		{"alter table `test`.`a` modify `name` text first",
+			[]string{"name text", "id int(11) unsigned pk", "age tinyint(4)"}},
+		{"ALTER TABLE a CHANGE id uid BIGINT UNSIGNED NOT NULL, RENAME COLUMN age TO level",
+			[]string{"name text", "uid bigint(20) unsigned pk", "level tinyint(4)"}},
+		{"ALTER TABLE a DROP PRIMARY KEY, ADD PRIMARY KEY (`name`(10), level) /* comment */",
+			[]string{"name text pk", "uid bigint(20) unsigned", "level tinyint(4) pk"}},
+		{"ALTER ONLINE TABLE a ADD (x ENUM('A','b'), y SET('c')), ENGINE = InnoDB, COMMENT 'c'",
+			[]string{"name text pk", "uid bigint(20) unsigned", "level tinyint(4) pk", "x enum('A','b')", "y set('c')"}},
+	}
+	for _, c := range cases {
+		apply(c.query)
+		if r := describeTable(table("test.a")); !reflect.DeepEqual(r, c.expect) {
+			t.Errorf("%s expect %v, got %v", c.query, c.expect, r)
+		}
+	}
+	// 旧版本不受影响
+	if len(a.Columns) != 3 || a.Columns[0].Name != "id" || len(a.Indexes) != 2 || len(first.NotNull) != 1 {
+		t.Errorf("old version should not change: %+v", a)
+	}
+	if a = table("test.a"); !reflect.DeepEqual(a.UnsignedColumns, []int{1}) || a.Columns[3].EnumValues[0] != "A" {
+		t.Errorf("unexpected columns: %+v", a.Columns)
+	}
+	// 列改名后索引和非空约束跟随，主键的列不能为null
+	if v := tables["test.a"]; !reflect.DeepEqual(v.Unique, []string{"uk_name"}) || !reflect.DeepEqual(v.NotNull, []string{"uid", "name", "level"}) ||
+		!reflect.DeepEqual(a.Indexes[1].Columns, []string{"level"}) {
+		t.Errorf("unexpected keys: %v, %v, %+v", v.Unique, v.NotNull, a.Indexes)
+	}
+
+	// 索引
+	apply("ALTER TABLE a DROP PRIMARY KEY, MODIFY name text NULL")
+	apply("CREATE UNIQUE INDEX uk_uid ON test.a (uid)")
+	v := tables["test.a"]
+	if !reflect.DeepEqual(v.Unique, []string{"uk_name", "uk_uid"}) || len(v.Table.PKColumns) != 0 {
+		t.Errorf("create index expect unique uk_uid, got %v", v.Unique)
+	}
+	if keys := versionKeys(v.Table, v.Table.Indexes, v.Unique, v.NotNull); !reflect.DeepEqual(keys, []string{"uid"}) {
+		t.Errorf("expect non-null unique key uid, got %v", keys)
+	}
+	apply("DROP INDEX uk_uid ON a")
+	if v = tables["test.a"]; !reflect.DeepEqual(v.Unique, []string{"uk_name"}) || len(v.Table.Indexes) != 2 {
+		t.Errorf("drop index expect only uk_name, got %v, %+v", v.Unique, v.Table.Indexes)
+	}
+
+	// 改名和删除
+	changes := apply("RENAME TABLE a TO b, b TO c")
+	if len(changes) != 3 || table("test.a") != nil || table("test.b") != nil || table("test.c").Name != "c" {
+		t.Errorf("rename expect a to c, got %+v", changes)
+	}
+	apply("ALTER TABLE c RENAME TO other.d")
+	if table("test.c") != nil || table("other.d") == nil || table("other.d").Schema != "other" {
+		t.Errorf("alter rename expect c to other.d")
+	}
+	apply("CREATE TABLE IF NOT EXISTS e LIKE other.d")
+	if len(table("test.e").Columns) != 5 {
+		t.Errorf("create like expect 5 columns, got %+v", table("test.e"))
+	}
+	apply("DROP TABLE IF EXISTS `other`.`d`, e /* generated by server */")
+	if table("other.d") != nil || table("test.e") != nil {
+		t.Errorf("drop expect nil tables")
+	}
+	if changes = apply("TRUNCATE TABLE x"); len(changes) != 0 {
+		t.Errorf("truncate should not change schema")
+	}
+
+	// 无法推导
+	tables["test.a"] = &schemaVersion{Table: &schema.Table{Schema: "test", Name: "a", Columns: []schema.TableColumn{{Name: "id"}}}}
+	for _, query := range []string{
+		"ALTER TABLE a DROP COLUMN name",
+		"ALTER TABLE a ADD COLUMN id int",
+		"ALTER TABLE a FOO BAR",
+		"ALTER TABLE missing ADD COLUMN id int",
+		"CREATE INDEX i ON missing (id)",
+		"CREATE TABLE f SELECT * FROM a",
+	} {
+		if _, err := evolveSchema(query, "test", prev); err == nil {
+			t.Errorf("%s should fail", query)
+		}
+	}
+}
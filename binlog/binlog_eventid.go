@@ -0,0 +1,87 @@
+package binlog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// 事件ID
+// event_index是内存中的计数器，故障切换、重新同步和离线回放后同一个修改的序号会不同，
+// event_id由数据源名称、binlog坐标（或者gtid）和行序号组成，同一个修改总是得到相同的ID，消费者可以据此去重：
+// 有gtid时为 gtid:行事件在事务中的序号:行在事件中的序号，切换master后仍然相同，
+// 行事件的序号包括被过滤的行事件，修改过滤规则后同一个修改的ID也不变
+// 没有gtid时为 server_id:binlog file:事件开始的位置:行在事件中的序号
+// ddl事件的行序号为ddl，快照事件为 snapshot:快照开始的位置:表名:主键的哈希，
+// 主键同样可能是敏感数据，使用脱敏配置中的盐做sha256，不直接放入ID
+// 多个数据源时前面加上数据源名称
+const eventIDDDL = "ddl"
+
+// 拼接事件ID
+func (h *Binlog) eventID(parts ...interface{}) string {
+	s := make([]string, 0, len(parts)+1)
+	if h.name != "" {
+		s = append(s, h.name)
+	}
+	for _, p := range parts {
+		s = append(s, fmt.Sprint(p))
+	}
+	return strings.Join(s, ":")
+}
+
+// 记录事务中的一个行事件，在过滤之前调用
+func (h *Binlog) countRowsEvent() {
+	h.lock.Lock()
+	h.txEvents++
+	h.lock.Unlock()
+}
+
+// 行事件的ID，rowIndex为行在行事件中的序号
+// 调用方需持有h.lock
+func (h *Binlog) rowEventID(header *replication.EventHeader, file string, rowIndex int) string {
+	if h.pendingGTID != nil {
+		// 事务中可能有多个行事件，加上当前行事件在事务中的序号
+		return h.eventID(h.pendingGTID.String(), h.txEvents-1, rowIndex)
+	}
+	return h.eventID(header.ServerID, file, header.LogPos-header.EventSize, rowIndex)
+}
+
+// 快照行的ID，有主键时使用主键的哈希，否则使用行在表中的序号
+func (h *Binlog) snapshotEventID(snapshot string, table *schema.Table, keys []string, offset int64, row []interface{}) string {
+	key := fmt.Sprint(offset)
+	if len(keys) > 0 {
+		key = h.hashKey(snapshotKey(table, keys, row))
+	}
+	return h.eventID(eventTypeSnapshot, snapshot, table.String(), key)
+}
+
+// 主键值的哈希，每个值前面加上长度，避免不同的主键拼接后相同
+func (h *Binlog) hashKey(values []string) string {
+	salt := ""
+	if cfg := h.ctx.Config().Redact; cfg != nil {
+		salt = cfg.Salt
+	}
+	var b strings.Builder
+	b.WriteString(salt)
+	for _, v := range values {
+		fmt.Fprintf(&b, "%d:%s", len(v), v)
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// 一个事件被转换为多个事件时，在ID后面加上序号区分
+func fanoutEventID(events []map[string]interface{}) {
+	if len(events) < 2 {
+		return
+	}
+	for i, ev := range events {
+		if id, ok := ev["event_id"].(string); ok {
+			ev["event_id"] = fmt.Sprintf("%s:%d", id, i)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package binlog
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// test event id
+// 同一个修改重新同步后得到相同的ID，与event_index无关
+func TestBinlog_EventID(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{Database: &g.DatabaseConfig{}}, &events)
+	e := newTestRowsEvent("a", 2)
+	e.Header.ServerID = 1
+	testOnRow(h, e)
+	h.EventIndex = 100
+	testOnRow(h, e)
+	if len(events) != 4 {
+		t.Fatalf("expect 4 events, got %d", len(events))
+	}
+	expects := []string{"1:mysql-bin.000001:150:0", "1:mysql-bin.000001:150:1"}
+	for i, ev := range events {
+		if ev["event_id"] != expects[i%2] {
+			t.Errorf("event %d expect id %s, got %v", i, expects[i%2], ev["event_id"])
+		}
+	}
+	if events[0]["event_index"] == events[2]["event_index"] {
+		t.Errorf("event index should be different")
+	}
+
+	// 有gtid时使用gtid和行在事务中的序号
+	events = events[:0]
+	h.name = "db1"
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	gtid, _ := mysql.ParseMysqlGTIDSet(uuid + ":5")
+	h.OnGTID(gtid)
+	testOnRow(h, newTestRowsEvent("a", 2))
+	testOnRow(h, newTestRowsEvent("b", 1))
+	h.onXID(txCommit{pos: mysql.Position{Name: "mysql-bin.000001", Pos: 300}})
+	expects = []string{"db1:" + uuid + ":5:0:0", "db1:" + uuid + ":5:0:1", "db1:" + uuid + ":5:1:0"}
+	for i, ev := range events {
+		if ev["event_id"] != expects[i] {
+			t.Errorf("event %d expect id %s, got %v", i, expects[i], ev["event_id"])
+		}
+	}
+	// 重新收到同一个事务，修改过滤规则后被过滤的行事件不影响之后的ID
+	events = events[:0]
+	h.filter, _ = newTableFilter(&g.FilterConfig{Exclude: []string{`^test\.a$`}})
+	h.OnGTID(gtid)
+	header := &replication.EventHeader{EventType: replication.WRITE_ROWS_EVENTv2, LogPos: 200, EventSize: 50}
+	rows := &replication.RowsEvent{Table: &replication.TableMapEvent{Schema: []byte("test"), Table: []byte("a")}}
+	if err := h.handleRows(mysql.Position{Name: "mysql-bin.000001", Pos: 200}, header, rows); err != nil {
+		t.Fatal(err)
+	}
+	testOnRow(h, newTestRowsEvent("b", 1))
+	if len(events) != 1 || events[0]["event_id"] != expects[2] {
+		t.Errorf("replayed transaction expect id %s, got %+v", expects[2], events)
+	}
+}
+
+// test event id fan out
+// 一个事件被转换为多个事件时ID不重复
+func TestBinlog_EventIDFanout(t *testing.T) {
+	events := []map[string]interface{}{{"event_id": "a"}, {"event_id": "a"}}
+	fanoutEventID(events)
+	if events[0]["event_id"] != "a:0" || events[1]["event_id"] != "a:1" {
+		t.Errorf("unexpected event ids: %+v", events)
+	}
+	events = []map[string]interface{}{{"event_id": "a"}}
+	fanoutEventID(events)
+	if events[0]["event_id"] != "a" {
+		t.Errorf("single event id should not change, got %v", events[0]["event_id"])
+	}
+}
+
+// test ddl event id
+// ddl的ID使用事件头中的server_id，与推送的server_id一致
+func TestBinlog_DDLEventID(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{Database: &g.DatabaseConfig{}}, &events)
+	h.serverID = 1
+	header := &replication.EventHeader{ServerID: 2, Timestamp: 1555555555, LogPos: 300, EventSize: 50}
+	query := &replication.QueryEvent{Schema: []byte("test"), Query: []byte("CREATE TABLE a (id INT)")}
+	if err := h.onDDL(mysql.Position{Name: "mysql-bin.000001", Pos: 300}, header, query); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expect 1 ddl event, got %d", len(events))
+	}
+	if events[0]["event_id"] != "2:mysql-bin.000001:300:"+eventIDDDL || events[0]["server_id"] != float64(2) {
+		t.Errorf("ddl event id error: %+v", events[0])
+	}
+}
+
+// test snapshot event id
+// 快照的ID使用主键的哈希，不包含主键原值
+func TestBinlog_SnapshotEventID(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{Redact: &g.RedactConfig{Salt: "salt"}}, &events)
+	table := &schema.Table{
+		Schema:  "test",
+		Name:    "a",
+		Columns: []schema.TableColumn{{Name: "phone", Type: schema.TYPE_STRING}, {Name: "id", Type: schema.TYPE_NUMBER}},
+	}
+	id := h.snapshotEventID("mysql-bin.000001:4", table, []string{"phone"}, 0, []interface{}{[]byte("13800138000"), 1})
+	if strings.Contains(id, "13800138000") || !strings.HasPrefix(id, "snapshot:mysql-bin.000001:4:test.a:") {
+		t.Errorf("snapshot event id error: %s", id)
+	}
+	if h.snapshotEventID("mysql-bin.000001:4", table, []string{"phone"}, 1, []interface{}{"13800138000", 2}) != id {
+		t.Errorf("same key should have the same id")
+	}
+	if h.snapshotEventID("mysql-bin.000001:4", table, []string{"phone"}, 0, []interface{}{"13800138001", 1}) == id {
+		t.Errorf("different keys should have different ids")
+	}
+	if h.hashKey([]string{"1,2", "3"}) == h.hashKey([]string{"1", "2,3"}) {
+		t.Errorf("key tuples should not collide")
+	}
+}
@@ -0,0 +1,138 @@
+package binlog
+
+import (
+	"reflect"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// 采集端的表过滤
+// 过滤规则同时设置到canal，被排除的表的行事件不会被解析和推送
+// canal不会过滤ddl事件，ddl事件使用这里的规则过滤
+type tableFilter struct {
+	cfg     g.FilterConfig   // 生成过滤规则的配置，用于判断配置是否改变
+	include []*regexp.Regexp //
+	exclude []*regexp.Regexp //
+}
+
+// 默认包含所有的表
+const includeAllTables = ".*"
+
+// 创建表过滤规则，正则表达式错误时返回error
+func newTableFilter(cfg *g.FilterConfig) (*tableFilter, error) {
+	f := &tableFilter{}
+	if cfg == nil {
+		return f, nil
+	}
+	f.cfg = *cfg
+	for _, exp := range cfg.Include {
+		reg, err := regexp.Compile(exp)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, reg)
+	}
+	for _, exp := range cfg.Exclude {
+		reg, err := regexp.Compile(exp)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, reg)
+	}
+	return f, nil
+}
+
+// 表是否需要同步，table格式为db.table
+func (f *tableFilter) match(table string) bool {
+	if len(f.include) > 0 {
+		matched := false
+		for _, reg := range f.include {
+			if reg.MatchString(table) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for _, reg := range f.exclude {
+		if reg.MatchString(table) {
+			return false
+		}
+	}
+	return true
+}
+
+// canal的过滤规则
+// canal在只有exclude时会排除所有的表，这里补上包含所有表的include
+func (f *tableFilter) canalRegex() ([]string, []string) {
+	include := f.cfg.Include
+	if len(include) == 0 && len(f.cfg.Exclude) > 0 {
+		include = []string{includeAllTables}
+	}
+	return include, f.cfg.Exclude
+}
+
+// 配置是否改变
+func (f *tableFilter) changed(cfg *g.FilterConfig) bool {
+	if cfg == nil {
+		cfg = &g.FilterConfig{}
+	}
+	return !reflect.DeepEqual(f.cfg.Include, cfg.Include) || !reflect.DeepEqual(f.cfg.Exclude, cfg.Exclude)
+}
+
+// 表是否需要同步
+func (h *Binlog) tableMatch(table string) bool {
+	h.lock.Lock()
+	f := h.filter
+	h.lock.Unlock()
+	return f == nil || f.match(table)
+}
+
+// Reload 重新加载配置
+// 表过滤规则改变时重新创建canal句柄，正在同步时从最后保存的位置继续同步
+func (h *Binlog) Reload() {
+	// update事件格式规则立即重新编译，错误时保留之前的规则
+	h.updateFormatRules()
+	cfg := h.filterConfig()
+	if cfg == nil {
+		cfg = &g.FilterConfig{}
+	}
+	h.lock.Lock()
+	f := h.filter
+	h.lock.Unlock()
+	if f != nil && !f.changed(cfg) {
+		return
+	}
+	if _, err := newTableFilter(cfg); err != nil {
+		log.Errorf("[E] reload table filter with error: %+v", err)
+		return
+	}
+	log.Infof("[I] table filter changed, include: %v, exclude: %v", cfg.Include, cfg.Exclude)
+	h.statusLock.Lock()
+	running := h.status&binlogIsRunning > 0
+	h.statusLock.Unlock()
+	if !running {
+		// 未在同步，关闭旧的句柄后重新创建，下次启动时使用新的规则
+		closeHandler(h.currentHandler())
+		h.setHandler()
+		return
+	}
+	h.lock.Lock()
+	done := h.runDone
+	h.lock.Unlock()
+	h.StopService(false)
+	if done != nil {
+		select {
+		case <-done:
+		case <-time.After(time.Second * 10):
+			log.Warnf("[W] wait binlog service stop timeout")
+		}
+	}
+	h.StartService()
+}
@@ -0,0 +1,48 @@
+package binlog
+
+import (
+	"testing"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// test table filter
+func TestTableFilter(t *testing.T) {
+	f, err := newTableFilter(&g.FilterConfig{
+		Include: []string{`^test\.`},
+		Exclude: []string{`^test\.tmp_`},
+	})
+	if err != nil {
+		t.Fatalf("new table filter error: %+v", err)
+	}
+	cases := map[string]bool{
+		"test.user":     true,
+		"test.tmp_user": false,
+		"other.user":    false,
+	}
+	for table, expect := range cases {
+		if f.match(table) != expect {
+			t.Errorf("match %s expect %v", table, expect)
+		}
+	}
+	if f.changed(&g.FilterConfig{Include: []string{`^test\.`}, Exclude: []string{`^test\.tmp_`}}) {
+		t.Errorf("filter should not be changed")
+	}
+	if !f.changed(nil) {
+		t.Errorf("filter should be changed")
+	}
+
+	// 只有exclude时canal需要包含所有的表
+	f, _ = newTableFilter(&g.FilterConfig{Exclude: []string{`^mysql\.`}})
+	include, exclude := f.canalRegex()
+	if len(include) != 1 || include[0] != includeAllTables || len(exclude) != 1 {
+		t.Errorf("canal regex error: %v, %v", include, exclude)
+	}
+	if !f.match("test.user") || f.match("mysql.user") {
+		t.Errorf("exclude only match error")
+	}
+
+	if _, err = newTableFilter(&g.FilterConfig{Include: []string{"("}}); err == nil {
+		t.Errorf("invalid regex should return error")
+	}
+}
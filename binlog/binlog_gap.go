@@ -0,0 +1,265 @@
+package binlog
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// 同步位置不可用时的处理
+// 启动和重连时检查同步位置对应的binlog是否还在master上，已经被purge时按配置的策略处理：
+// fail     停止同步，需要人工处理，默认
+// oldest   从master上最早的binlog继续
+// current  从master当前的位置继续
+// snapshot 从master当前的位置重新做一次全量快照，然后继续增量同步
+// 跳过位置时推送一个gap事件，订阅方据此知道中间的数据可能丢失
+const (
+	missingPositionFail     = "fail"
+	missingPositionOldest   = "oldest"
+	missingPositionCurrent  = "current"
+	missingPositionSnapshot = "snapshot"
+)
+
+const eventTypeGap = "gap"
+
+// 同步位置不可用，并且策略为fail
+type positionMissingError struct {
+	reason string
+}
+
+func (e *positionMissingError) Error() string {
+	return "binlog position no longer available: " + e.reason
+}
+
+// master上的一个binlog文件
+type binaryLog struct {
+	name string
+	size uint64
+}
+
+// 同步位置不可用时的处理策略
+func (h *Binlog) missingPositionPolicy() string {
+	policy := strings.ToLower(h.database().MissingPosition)
+	switch policy {
+	case missingPositionOldest, missingPositionCurrent, missingPositionSnapshot:
+		return policy
+	}
+	return missingPositionFail
+}
+
+// 检查同步位置是否可用，不可用时按策略处理
+// 策略为fail时返回*positionMissingError
+func (h *Binlog) checkPosition() error {
+	if err := h.resolvePosition(); err != nil {
+		return err
+	}
+	h.flushGap()
+	h.lock.Lock()
+	forced := h.snapshotForced
+	h.lock.Unlock()
+	if forced {
+		return h.snapshot()
+	}
+	return nil
+}
+
+// 推送启动或者重连时跳过同步位置的gap事件
+func (h *Binlog) flushGap() {
+	h.lock.Lock()
+	gap := h.gap
+	h.gap = nil
+	h.lock.Unlock()
+	if gap != nil {
+		h.notify(gap)
+	}
+}
+
+// 检查同步位置是否可用，不可用时按策略调整同步位置
+// 跳过位置的gap事件记录在h.gap中，由flushGap在同步开始前推送，策略为snapshot时清除快照进度
+// mysql的gtid模式按gtid_purged检查，mariadb没有对应的变量，和文件位置模式一样按binlog文件检查
+func (h *Binlog) resolvePosition() error {
+	handler := h.currentHandler()
+	logs, err := h.binaryLogs()
+	if err != nil {
+		return err
+	}
+	h.lock.Lock()
+	from := mysql.Position{Name: h.lastBinFile, Pos: h.lastPos}
+	var gset mysql.GTIDSet
+	if h.gtidSet != nil {
+		gset = h.gtidSet.Clone()
+	}
+	h.lock.Unlock()
+	var (
+		reason string
+		purged mysql.GTIDSet
+	)
+	if gset != nil && h.flavor() == mysql.MySQLFlavor {
+		if purged, err = h.purgedGTIDSet(); err != nil {
+			return err
+		}
+		reason = gtidMissing(gset, purged)
+	} else {
+		reason = positionMissing(logs, from)
+	}
+	if reason == "" {
+		return nil
+	}
+	policy := h.missingPositionPolicy()
+	log.Errorf("[E] binlog position no longer available: %s, policy: %s", reason, policy)
+	if policy == missingPositionFail {
+		return &positionMissingError{reason: reason}
+	}
+	to, err := handler.GetMasterPos()
+	if err != nil {
+		return err
+	}
+	var toSet mysql.GTIDSet
+	switch policy {
+	case missingPositionOldest:
+		to = mysql.Position{Name: logs[0].name, Pos: 4}
+		if gset == nil {
+			break
+		}
+		if purged != nil {
+			// 已经purge的事务全部跳过，master上还有的事务都会收到
+			toSet = gset.Clone()
+			if err = toSet.Update(purged.String()); err != nil {
+				return err
+			}
+		} else if toSet, err = h.binlogGTIDPos(to); err != nil {
+			return err
+		}
+	default:
+		if gset != nil {
+			if toSet, err = handler.GetMasterGTIDSet(); err != nil {
+				return err
+			}
+		}
+	}
+	h.lock.Lock()
+	h.lastBinFile = to.Name
+	h.lastPos = to.Pos
+	if toSet != nil {
+		h.gtidSet = toSet
+	}
+	gtid := h.gtidString()
+	h.lock.Unlock()
+	gap := h.gapEvent(from, to, gset, gtid, policy, reason)
+	h.lock.Lock()
+	h.gap = gap
+	h.lock.Unlock()
+	if policy == missingPositionSnapshot {
+		return h.resetSnapshot()
+	}
+	return nil
+}
+
+// master上的binlog文件列表，按顺序排列
+func (h *Binlog) binaryLogs() ([]binaryLog, error) {
+	rr, err := h.currentHandler().Execute("SHOW BINARY LOGS")
+	if err != nil {
+		return nil, err
+	}
+	logs := make([]binaryLog, 0, rr.RowNumber())
+	for i := 0; i < rr.RowNumber(); i++ {
+		name, _ := rr.GetString(i, 0)
+		size, _ := rr.GetUint(i, 1)
+		logs = append(logs, binaryLog{name: name, size: size})
+	}
+	if len(logs) == 0 {
+		return nil, fmt.Errorf("binary logging is not enabled")
+	}
+	return logs, nil
+}
+
+// master上已经purge的gtid集合，mariadb没有对应的变量，返回空
+func (h *Binlog) purgedGTIDSet() (mysql.GTIDSet, error) {
+	if h.flavor() != mysql.MySQLFlavor {
+		return nil, nil
+	}
+	rr, err := h.currentHandler().Execute("SELECT @@GLOBAL.gtid_purged")
+	if err != nil {
+		return nil, err
+	}
+	s, _ := rr.GetString(0, 0)
+	return mysql.ParseGTIDSet(mysql.MySQLFlavor, s)
+}
+
+// mariadb上binlog位置对应的gtid集合
+func (h *Binlog) binlogGTIDPos(p mysql.Position) (mysql.GTIDSet, error) {
+	rr, err := h.currentHandler().Execute("SELECT BINLOG_GTID_POS(?, ?)", p.Name, p.Pos)
+	if err != nil {
+		return nil, err
+	}
+	s, _ := rr.GetString(0, 0)
+	return mysql.ParseGTIDSet(mysql.MariaDBFlavor, s)
+}
+
+// 同步位置对应的binlog是否还在master上，不在时返回原因
+func positionMissing(logs []binaryLog, p mysql.Position) string {
+	for i, l := range logs {
+		if l.name != p.Name {
+			continue
+		}
+		// 最后一个文件还在写入，位置超出的情况在启动时已经处理
+		if i < len(logs)-1 && uint64(p.Pos) > l.size {
+			return fmt.Sprintf("pos %d beyond the size %d of %s", p.Pos, l.size, p.Name)
+		}
+		return ""
+	}
+	if len(logs) > 0 && p.Name < logs[0].name {
+		return fmt.Sprintf("%s has been purged, the oldest is %s", p.Name, logs[0].name)
+	}
+	return fmt.Sprintf("%s not found on master", p.Name)
+}
+
+// 已执行的gtid集合是否包含master上已经purge的所有事务，不包含时返回原因
+func gtidMissing(executed, purged mysql.GTIDSet) string {
+	if purged == nil || purged.String() == "" || executed.Contain(purged) {
+		return ""
+	}
+	return fmt.Sprintf("gtid set %s not contain the purged %s", executed.String(), purged.String())
+}
+
+// 跳过同步位置的事件，没有数据库和表，推送给所有的订阅方
+func (h *Binlog) gapEvent(from, to mysql.Position, fromSet mysql.GTIDSet, toGTID, policy, reason string) map[string]interface{} {
+	gap := map[string]interface{}{
+		"from_file": from.Name,
+		"from_pos":  from.Pos,
+		"to_file":   to.Name,
+		"to_pos":    to.Pos,
+		"policy":    policy,
+		"reason":    reason,
+	}
+	if fromSet != nil {
+		gap["from_gtid"] = fromSet.String()
+		gap["to_gtid"] = toGTID
+	}
+	data := make(map[string]interface{})
+	data["database"] = ""
+	data["table"] = ""
+	data["event_type"] = eventTypeGap
+	data["time"] = time.Now().Unix()
+	data["event_index"] = atomic.AddInt64(&h.EventIndex, int64(1))
+	data["event"] = gap
+	data["event_id"] = h.eventID(eventTypeGap, from.Name, from.Pos, to.Name, to.Pos)
+	h.setSource(data, h.serverID, to)
+	return data
+}
+
+// 清除快照进度，下次同步前重新做全量快照
+func (h *Binlog) resetSnapshot() error {
+	if err := os.Remove(h.snapshotFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	h.lock.Lock()
+	h.snapshotForced = true
+	h.lock.Unlock()
+	return nil
+}
@@ -0,0 +1,98 @@
+package binlog
+
+import (
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// test purged position detection
+func TestBinlog_PositionMissing(t *testing.T) {
+	logs := []binaryLog{
+		{name: "mysql-bin.000003", size: 1000},
+		{name: "mysql-bin.000004", size: 500},
+	}
+	available := []mysql.Position{
+		{Name: "mysql-bin.000003", Pos: 4},
+		{Name: "mysql-bin.000003", Pos: 1000},
+		// 最后一个文件还在写入
+		{Name: "mysql-bin.000004", Pos: 800},
+	}
+	for _, p := range available {
+		if reason := positionMissing(logs, p); reason != "" {
+			t.Errorf("%+v should be available, got: %s", p, reason)
+		}
+	}
+	missing := []mysql.Position{
+		{Name: "mysql-bin.000001", Pos: 4},
+		{Name: "mysql-bin.000003", Pos: 1001},
+		{Name: "mysql-bin.000009", Pos: 4},
+	}
+	for _, p := range missing {
+		if reason := positionMissing(logs, p); reason == "" {
+			t.Errorf("%+v should be missing", p)
+		}
+	}
+}
+
+// test purged gtid detection
+func TestBinlog_GTIDMissing(t *testing.T) {
+	parse := func(s string) mysql.GTIDSet {
+		gset, err := mysql.ParseGTIDSet(mysql.MySQLFlavor, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return gset
+	}
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	executed := parse(uuid + ":1-100")
+	if reason := gtidMissing(executed, parse(uuid+":1-50")); reason != "" {
+		t.Errorf("gtid should be available, got: %s", reason)
+	}
+	if reason := gtidMissing(executed, parse("")); reason != "" {
+		t.Errorf("gtid should be available when nothing purged, got: %s", reason)
+	}
+	if reason := gtidMissing(executed, parse(uuid+":1-150")); reason == "" {
+		t.Errorf("gtid should be missing")
+	}
+}
+
+// test gap event
+// 没有表的事件主题为空，推送给所有的订阅方
+func TestBinlog_GapEvent(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{Database: &g.DatabaseConfig{}}, &events)
+	if policy := h.missingPositionPolicy(); policy != missingPositionFail {
+		t.Errorf("expect default policy fail, got %s", policy)
+	}
+	h.ctx.Config().Database.MissingPosition = "Oldest"
+	if policy := h.missingPositionPolicy(); policy != missingPositionOldest {
+		t.Errorf("expect policy oldest, got %s", policy)
+	}
+	topics := make([]string, 0)
+	h.onEvent = append(h.onEvent, func(table string, data []byte) {
+		topics = append(topics, table)
+	})
+	from := mysql.Position{Name: "mysql-bin.000001", Pos: 120}
+	to := mysql.Position{Name: "mysql-bin.000003", Pos: 4}
+	h.notify(h.gapEvent(from, to, nil, "", missingPositionOldest, "purged"))
+	if len(events) != 1 || len(topics) != 1 {
+		t.Fatalf("expect 1 event, got %d", len(events))
+	}
+	if topics[0] != "" {
+		t.Errorf("expect empty topic, got %s", topics[0])
+	}
+	ev := events[0]
+	if ev["event_type"] != eventTypeGap || ev["binlog_file"] != to.Name {
+		t.Errorf("unexpected gap event: %+v", ev)
+	}
+	gap := ev["event"].(map[string]interface{})
+	if gap["from_file"] != from.Name || gap["from_pos"] != float64(from.Pos) || gap["policy"] != missingPositionOldest {
+		t.Errorf("unexpected gap: %+v", gap)
+	}
+	if _, ok := gap["from_gtid"]; ok {
+		t.Errorf("gap should not have gtid in position mode")
+	}
+}
@@ -0,0 +1,187 @@
+package binlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 空间数据解析
+// binlog中的空间数据为4字节SRID加上WKB（Well-Known Binary），这里转换为WKT（Well-Known Text）
+// 参考 https://dev.mysql.com/doc/refman/5.7/en/gis-data-formats.html
+
+// WKB几何类型
+const (
+	wkbPoint = iota + 1
+	wkbLineString
+	wkbPolygon
+	wkbMultiPoint
+	wkbMultiLineString
+	wkbMultiPolygon
+	wkbGeometryCollection
+)
+
+var errInvalidWKB = errors.New("invalid wkb data")
+
+// WKB读取器
+type wkbReader struct {
+	data  []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+// 将binlog中的空间数据转换为WKT，SRID被忽略
+func geometryToWKT(data []byte) (string, error) {
+	if len(data) < 4 {
+		return "", errInvalidWKB
+	}
+	r := &wkbReader{data: data[4:]}
+	return r.geometry()
+}
+
+func (r *wkbReader) uint32() (uint32, error) {
+	if r.pos+4 > len(r.data) {
+		return 0, errInvalidWKB
+	}
+	v := r.order.Uint32(r.data[r.pos:])
+	r.pos += 4
+	return v, nil
+}
+
+func (r *wkbReader) float64() (float64, error) {
+	if r.pos+8 > len(r.data) {
+		return 0, errInvalidWKB
+	}
+	v := math.Float64frombits(r.order.Uint64(r.data[r.pos:]))
+	r.pos += 8
+	return v, nil
+}
+
+// 读取字节序和几何类型
+func (r *wkbReader) header() (uint32, error) {
+	if r.pos >= len(r.data) {
+		return 0, errInvalidWKB
+	}
+	if r.data[r.pos] == 0 {
+		r.order = binary.BigEndian
+	} else {
+		r.order = binary.LittleEndian
+	}
+	r.pos++
+	return r.uint32()
+}
+
+// 读取一个完整的几何对象，返回WKT
+func (r *wkbReader) geometry() (string, error) {
+	tp, err := r.header()
+	if err != nil {
+		return "", err
+	}
+	var (
+		name string
+		body string
+	)
+	switch tp {
+	case wkbPoint:
+		name = "POINT"
+		body, err = r.point()
+	case wkbLineString:
+		name = "LINESTRING"
+		body, err = r.points()
+	case wkbPolygon:
+		name = "POLYGON"
+		body, err = r.polygon()
+	case wkbMultiPoint, wkbMultiLineString, wkbMultiPolygon, wkbGeometryCollection:
+		return r.collection(tp)
+	default:
+		return "", errInvalidWKB
+	}
+	if err != nil {
+		return "", err
+	}
+	return name + body, nil
+}
+
+// 多个几何对象，每个子对象都带有自己的头
+func (r *wkbReader) collection(tp uint32) (string, error) {
+	names := map[uint32]string{
+		wkbMultiPoint:         "MULTIPOINT",
+		wkbMultiLineString:    "MULTILINESTRING",
+		wkbMultiPolygon:       "MULTIPOLYGON",
+		wkbGeometryCollection: "GEOMETRYCOLLECTION",
+	}
+	n, err := r.uint32()
+	if err != nil {
+		return "", err
+	}
+	items := make([]string, 0)
+	for i := uint32(0); i < n; i++ {
+		item, err := r.geometry()
+		if err != nil {
+			return "", err
+		}
+		if tp != wkbGeometryCollection {
+			// MULTIPOINT((1 2),(3 4))，去掉子对象的类型名
+			item = item[strings.Index(item, "("):]
+		}
+		items = append(items, item)
+	}
+	return names[tp] + "(" + strings.Join(items, ",") + ")", nil
+}
+
+// (x y)
+func (r *wkbReader) point() (string, error) {
+	xy, err := r.coordinate()
+	if err != nil {
+		return "", err
+	}
+	return "(" + xy + ")", nil
+}
+
+func (r *wkbReader) coordinate() (string, error) {
+	x, err := r.float64()
+	if err != nil {
+		return "", err
+	}
+	y, err := r.float64()
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(x, 'f', -1, 64) + " " + strconv.FormatFloat(y, 'f', -1, 64), nil
+}
+
+// (x1 y1,x2 y2,...)
+func (r *wkbReader) points() (string, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return "", err
+	}
+	items := make([]string, 0)
+	for i := uint32(0); i < n; i++ {
+		xy, err := r.coordinate()
+		if err != nil {
+			return "", err
+		}
+		items = append(items, xy)
+	}
+	return "(" + strings.Join(items, ",") + ")", nil
+}
+
+// ((x1 y1,...),(x1 y1,...))
+func (r *wkbReader) polygon() (string, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return "", err
+	}
+	rings := make([]string, 0)
+	for i := uint32(0); i < n; i++ {
+		ring, err := r.points()
+		if err != nil {
+			return "", err
+		}
+		rings = append(rings, ring)
+	}
+	return "(" + strings.Join(rings, ",") + ")", nil
+}
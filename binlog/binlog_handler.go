@@ -1,17 +1,17 @@
 package binlog
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
-	"os"
+	"reflect"
+	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/siddontang/go-mysql/canal"
 	"github.com/siddontang/go-mysql/mysql"
 	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/mia0x75/copycat/g"
@@ -20,17 +20,13 @@ import (
 
 // 初始化binlog事件相关句柄
 func (h *Binlog) handlerInit() {
-	var err error
-	mysqlBinlogCacheFile := g.MASTER_INFO_FILE
-	flag := os.O_RDWR | os.O_CREATE | os.O_SYNC
-	h.cacheHandler, err = os.OpenFile(mysqlBinlogCacheFile, flag, 0755)
-	if err != nil {
-		log.Panicf("[P] open cache file with error：%s, %+v", mysqlBinlogCacheFile, err)
+	h.cleanSpill()
+	h.checkpoints = newCheckpointFile(h.checkpointConfig())
+	if h.name != "" {
+		// 旧版本只支持单个数据源，不需要迁移
+		h.checkpoints.legacy = ""
 	}
-	h.statusLock.Lock()
-	h.status |= cacheHandlerIsOpened
-	h.statusLock.Unlock()
-	f, p, index := h.getBinlogPositionCache()
+	f, p, index, gtid := h.getBinlogPositionCache()
 	atomic.StoreInt64(&h.EventIndex, index)
 	h.setHandler()
 	currentPos, err := h.handler.GetMasterPos()
@@ -38,43 +34,157 @@ func (h *Binlog) handlerInit() {
 		log.Panicf("[P] get master pos with error：%+v", err)
 	}
 	log.Debugf("[D] master pos: %+v", currentPos)
+	if rr, err := h.handler.Execute("SELECT @@server_id"); err == nil {
+		serverID, _ := rr.GetUint(0, 0)
+		h.serverID = uint32(serverID)
+	} else {
+		log.Warnf("[W] get master server id with error：%+v", err)
+	}
 	if f != "" && p > 0 {
-		h.ctx.Config.Database.BinlogFile = f
-		h.ctx.Config.Database.BinlogPos = uint32(p)
-		if f == currentPos.Name && h.ctx.Config.Database.BinlogPos > currentPos.Pos {
+		h.database().BinlogFile = f
+		h.database().BinlogPos = uint32(p)
+		if f == currentPos.Name && h.database().BinlogPos > currentPos.Pos {
 			//pos set error, auto start form current pos
-			h.ctx.Config.Database.BinlogPos = currentPos.Pos
-			log.Warnf("[W] pos set error, auto start form: %d", h.ctx.Config.Database.BinlogPos)
+			h.database().BinlogPos = currentPos.Pos
+			log.Warnf("[W] pos set error, auto start form: %d", h.database().BinlogPos)
+		}
+	} else if h.database().StartTime != "" {
+		// 没有保存的位置时从配置的时间开始
+		t, err := ParseStartTime(h.database().StartTime)
+		if err != nil {
+			log.Panicf("[P] parse start time with error：%+v", err)
+		}
+		pos, gset, err := h.locateTime(t)
+		if err != nil {
+			log.Panicf("[P] locate start time %s with error：%+v", t, err)
+		}
+		log.Infof("[I] start time %s resolved to %s:%d", t, pos.Name, pos.Pos)
+		h.database().BinlogFile = pos.Name
+		h.database().BinlogPos = pos.Pos
+		if gset != nil {
+			gtid = gset.String()
 		}
 	} else {
-		h.ctx.Config.Database.BinlogFile = currentPos.Name
-		h.ctx.Config.Database.BinlogPos = currentPos.Pos
+		h.database().BinlogFile = currentPos.Name
+		h.database().BinlogPos = currentPos.Pos
 	}
-	h.lastBinFile = h.ctx.Config.Database.BinlogFile
-	h.lastPos = uint32(h.ctx.Config.Database.BinlogPos)
+	h.lastBinFile = h.database().BinlogFile
+	h.lastPos = uint32(h.database().BinlogPos)
 	log.Debugf("[D] current pos: (%+v, %+v)", h.lastBinFile, h.lastPos)
+	if h.isGTIDMode() {
+		h.gtidInit(gtid)
+	}
+	// 保存的同步位置可能已经被purge，按策略调整后再记录表结构快照
+	if err = h.resolvePosition(); err != nil {
+		if _, ok := err.(*positionMissingError); !ok {
+			log.Panicf("[P] check binlog position with error：%+v", err)
+		}
+		// 启动同步时再次检查并停止服务
+		log.Errorf("[E] %v", err)
+	}
+	schemaFile := h.database().SchemaFile
+	if schemaFile == "" {
+		schemaFile = h.sourceFile(g.SCHEMA_FILE)
+	}
+	h.schemas = newSchemaHistory(schemaFile)
+	if h.schemas.empty() {
+		h.schemaSnapshot(mysql.Position{Name: h.lastBinFile, Pos: h.lastPos})
+	}
+}
+
+// 是否为gtid同步模式
+func (h *Binlog) isGTIDMode() bool {
+	return strings.ToLower(h.database().SyncMode) == syncModeGTID
+}
+
+// 初始化gtid集合
+// 优先使用cache中的gtid集合，其次是配置的gtid集合，都为空时从master当前的gtid集合开始
+func (h *Binlog) gtidInit(cached string) {
+	var (
+		gset mysql.GTIDSet
+		err  error
+	)
+	gtid := cached
+	if gtid == "" {
+		gtid = h.database().GTIDSet
+	}
+	if gtid != "" {
+		gset, err = mysql.ParseGTIDSet(h.flavor(), gtid)
+	} else {
+		gset, err = h.handler.GetMasterGTIDSet()
+	}
+	if err != nil {
+		log.Panicf("[P] init gtid set with error：%+v", err)
+	}
+	h.lock.Lock()
+	h.gtidSet = gset
+	h.lock.Unlock()
+	log.Debugf("[D] current gtid set: %s", gset.String())
+}
+
+// 数据库类型，mysql或者mariadb，默认mysql
+func (h *Binlog) flavor() string {
+	if h.database().Flavor == "" {
+		return mysql.MySQLFlavor
+	}
+	return h.database().Flavor
+}
+
+// 将当前事务的gtid合并到已执行的gtid集合
+// 调用方需持有h.lock
+func (h *Binlog) commitGTID() {
+	if h.gtidSet != nil && h.pendingGTID != nil {
+		if err := h.gtidSet.Update(h.pendingGTID.String()); err != nil {
+			log.Errorf("[E] update gtid set with error: %+v", err)
+		}
+	}
+	h.pendingGTID = nil
+}
+
+// 已执行的gtid集合，非gtid模式下为空
+// 调用方需持有h.lock
+func (h *Binlog) gtidString() string {
+	if h.gtidSet == nil {
+		return ""
+	}
+	return h.gtidSet.String()
 }
 
 // 设置binlog句柄为当前实现类
 func (h *Binlog) setHandler() {
 	cfg := canal.NewDefaultConfig()
-	cfg.Addr = fmt.Sprintf("%s:%d", g.Config().Database.Host, g.Config().Database.Port)
-	cfg.User = g.Config().Database.User
-	cfg.Password = g.Config().Database.Password
-	cfg.Charset = g.Config().Database.Charset
-	cfg.ServerID = g.Config().Database.ServerID
-	cfg.Flavor = g.Config().Database.Flavor
-	cfg.HeartbeatPeriod = time.Duration(g.Config().Database.HeartbeatPeriod)
-	cfg.ReadTimeout = time.Duration(g.Config().Database.ReadTimeout)
+	cfg.Addr = fmt.Sprintf("%s:%d", h.database().Host, h.database().Port)
+	cfg.User = h.database().User
+	cfg.Password = h.database().Password
+	cfg.Charset = h.database().Charset
+	cfg.ServerID = h.database().ServerID
+	cfg.Flavor = h.database().Flavor
+	cfg.HeartbeatPeriod = time.Duration(h.database().HeartbeatPeriod)
+	cfg.ReadTimeout = time.Duration(h.database().ReadTimeout)
 	cfg.Silence = true // 禁止打印日志
+	// decimal解析为精确值，时间类型解析为time.Time，由fieldDecode统一格式化
+	cfg.UseDecimal = true
+	cfg.ParseTime = true
+	filter, err := newTableFilter(h.filterConfig())
+	if err != nil {
+		log.Panicf("[P] table filter with error：%+v", err)
+	}
+	if _, err = newUpdateFormats(h.ctx.Config().UpdateFormat); err != nil {
+		log.Panicf("[P] update format with error：%+v", err)
+	}
+	cfg.IncludeTableRegex, cfg.ExcludeTableRegex = filter.canalRegex()
+	cfg.IncludeTableRegex = h.watermarkRegex(cfg.IncludeTableRegex)
 	handler, err := canal.NewCanal(cfg)
 	if err != nil {
 		log.Panicf("[P] new canal with error：%+v", err)
 	}
 	h.lock.Lock()
 	h.handler = handler
+	h.filter = filter
+	// 未完成的事务会在重新同步时再次收到
+	h.pendingGTID = nil
 	h.lock.Unlock()
-	h.handler.SetEventHandler(h)
+	h.discardTransaction()
 }
 
 // RegisterService 注册服务
@@ -86,13 +196,17 @@ func (h *Binlog) RegisterService(s services.IService) {
 
 // notify 事件广播通知
 func (h *Binlog) notify(data map[string]interface{}) {
+	if h.name != "" {
+		// 事务分组推送的事件也需要带上数据源名称
+		data["source"] = h.name
+	}
 	log.Debugf("[D] binlog notify: %+v", data)
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		log.Errorf("[E] json pack data error[%v]: %v", err, data)
 		return
 	}
-	table := data["database"].(string) + "." + data["table"].(string)
+	table := h.topic(data)
 	for _, service := range h.services {
 		service.SendAll(table, jsonData)
 	}
@@ -102,15 +216,36 @@ func (h *Binlog) notify(data map[string]interface{}) {
 	}
 }
 
-// OnRow 数据改变事件回调
-func (h *Binlog) OnRow(e *canal.RowsEvent) error {
-	log.Debug("[D] OnRow fired")
+// notifyTo 推送给指定地址的客户端
+// 只有支持指定客户端的服务会收到，事件回调不会收到
+func (h *Binlog) notifyTo(data map[string]interface{}, targets []string) {
+	log.Debugf("[D] binlog notify to %v: %+v", targets, data)
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		log.Errorf("[E] json pack data error[%v]: %v", err, data)
+		return
+	}
+	table := h.topic(data)
+	for _, service := range h.services {
+		if s, ok := service.(services.ITargetService); ok {
+			s.SendTo(targets, table, jsonData)
+		}
+	}
+}
+
+// 处理行事件
+// before、after为行事件中的列位图，insert和delete只有before，为nil时所有列都已记录
+func (h *Binlog) onRows(e *canal.RowsEvent, before, after []byte) error {
+	log.Debug("[D] rows event fired")
 	h.statusLock.Lock()
 	if h.status&binlogIsExit > 0 {
 		h.statusLock.Unlock()
 		return nil
 	}
 	h.statusLock.Unlock()
+	if h.onWatermark(e) {
+		return nil
+	}
 	// 发生变化的数据表e.Table，如xsl.x_reports
 	// 发生的操作类型e.Action，如update、insert、delete
 	// 如update的数据，update的数据以双数出现前面为更新前的数据，后面的为更新后的数据
@@ -121,104 +256,252 @@ func (h *Binlog) OnRow(e *canal.RowsEvent) error {
 	// delete的数据delete [[3 1 3074961 [97 115 100 99 97 100 115] 1,2,2 1 1485768268 1485768268]]
 	// 一次插入多条的时候，同时返回
 	// insert的数据insert xsl.x_reports [[6 0 0 [] 0 1 0 0]]
-	rowData := make(map[string]interface{})
-	rowData["database"] = e.Table.Schema
-	rowData["event_type"] = e.Action
-	rowData["time"] = time.Now().Unix()
-	rowData["table"] = e.Table.Name
-
-	data := make(map[string]interface{})
-	ed := make(map[string]interface{})
-
+	// 回放旧的binlog时，使用事件发生时的表结构
+	table := h.tableAt(e)
+	keys := h.keyColumns(table)
+	types := columnTypes(table)
 	if e.Action == "update" {
-		for i := 0; i < len(e.Rows); i += 2 {
-			rowData["event_index"] = atomic.AddInt64(&h.EventIndex, int64(1))
-			oldData := make(map[string]interface{})
-			newData := make(map[string]interface{})
-			rowsLen := len(e.Rows[i])
-			for k, col := range e.Table.Columns {
-				if k < rowsLen {
-					oldData[col.Name] = fieldDecode(e.Rows[i][k], &col)
-				} else {
-					log.Warn("[W] unknown line", col.Name)
-					oldData[col.Name] = nil
-				}
-			}
-			rowsLen = len(e.Rows[i+1])
-			for k, col := range e.Table.Columns {
-				if k < rowsLen {
-					newData[col.Name] = fieldDecode(e.Rows[i+1][k], &col)
-				} else {
-					log.Warn("[W] unknown line", col.Name)
-					newData[col.Name] = nil
-				}
+		format := h.updateFormatRules().format(e.Table.String())
+		for i := 0; i+1 < len(e.Rows); i += 2 {
+			oldImage := bitmapImage(before, len(e.Rows[i]))
+			newImage := bitmapImage(after, len(e.Rows[i+1]))
+			oldData := rowDecode(table, e.Rows[i], oldImage)
+			newData := rowDecode(table, e.Rows[i+1], newImage)
+			data := updateData(format, table, keys, oldData, newData)
+			rowData := h.rowEvent(e, i/2, data)
+			rowData["column_types"] = types
+			setImageColumns(rowData, table, "old_", oldImage)
+			setImageColumns(rowData, table, "", newImage)
+			setRowKey(rowData, keys, oldData, newData)
+			h.snapshotChanged(e.Table.String(), rowData["pk"], rowData["old_pk"])
+			if err := h.emitRow(e, rowData); err != nil {
+				return err
 			}
-			data["old_data"] = oldData
-			data["new_data"] = newData
-			ed["data"] = data
-			rowData["event"] = ed
-			h.notify(rowData)
 		}
 	} else {
 		for i := 0; i < len(e.Rows); i++ {
-			rowData["event_index"] = atomic.AddInt64(&h.EventIndex, int64(1))
-			rowsLen := len(e.Rows[i])
-			for k, col := range e.Table.Columns {
-				if k < rowsLen {
-					data[col.Name] = fieldDecode(e.Rows[i][k], &col)
-				} else {
-					log.Warn("[W] unknown line", col.Name)
-					data[col.Name] = nil
-				}
+			// delete为修改前的数据，insert为修改后的数据
+			image := bitmapImage(before, len(e.Rows[i]))
+			data := rowDecode(table, e.Rows[i], image)
+			rowData := h.rowEvent(e, i, data)
+			rowData["column_types"] = types
+			setImageColumns(rowData, table, "", image)
+			setRowKey(rowData, keys, nil, data)
+			h.snapshotChanged(e.Table.String(), rowData["pk"])
+			if err := h.emitRow(e, rowData); err != nil {
+				return err
 			}
-			ed["data"] = data
-			rowData["event"] = ed
-			h.notify(rowData)
 		}
 	}
 	return nil
 }
 
+// 脱敏和转换之后推送行事件
+// 返回error时停止同步
+func (h *Binlog) emitRow(e *canal.RowsEvent, rowData map[string]interface{}) error {
+	h.redact(rowData)
+	events, err := h.transform(rowData)
+	if err != nil {
+		return err
+	}
+	fanoutEventID(events)
+	for _, ev := range events {
+		h.emit(e, ev)
+	}
+	return nil
+}
+
+// 构造行事件
+// 每一行都是一个新的map，事务分组推送时会被缓存
+// time为binlog事件头中的时间戳，即数据改变的时间，rowIndex为该行在行事件中的序号
+func (h *Binlog) rowEvent(e *canal.RowsEvent, rowIndex int, data map[string]interface{}) map[string]interface{} {
+	ed := make(map[string]interface{})
+	ed["data"] = data
+
+	rowData := make(map[string]interface{})
+	rowData["database"] = e.Table.Schema
+	rowData["event_type"] = e.Action
+	rowData["time"] = int64(e.Header.Timestamp)
+	rowData["table"] = e.Table.Name
+	rowData["event_index"] = atomic.AddInt64(&h.EventIndex, int64(1))
+	rowData["event"] = ed
+	rowData["row_index"] = rowIndex
+	h.lock.Lock()
+	file := h.lastBinFile
+	rowData["event_id"] = h.rowEventID(e.Header, file, rowIndex)
+	query := h.rowsQuery
+	h.lock.Unlock()
+	h.setSource(rowData, e.Header.ServerID, mysql.Position{Name: file, Pos: e.Header.LogPos})
+	h.setRowsQuery(rowData, e.Table.String(), query)
+	return rowData
+}
+
+// 设置行的唯一标识
+// primary_key为主键（或者唯一索引）列名，pk为主键的值，update修改了主键时old_pk为修改前的值
+// binlog_row_image为minimal时没有修改的主键不会记录在修改后的数据中，使用修改前的值
+func setRowKey(rowData map[string]interface{}, keys []string, before, after map[string]interface{}) {
+	rowData["primary_key"] = keys
+	if len(keys) == 0 {
+		return
+	}
+	pk := make(map[string]interface{})
+	changed := false
+	for _, k := range keys {
+		v, ok := after[k]
+		if !ok {
+			v = before[k]
+		}
+		pk[k] = v
+		if before != nil && ok && !reflect.DeepEqual(before[k], v) {
+			changed = true
+		}
+	}
+	rowData["pk"] = pk
+	if changed {
+		oldPk := make(map[string]interface{})
+		for _, k := range keys {
+			oldPk[k] = before[k]
+		}
+		rowData["old_pk"] = oldPk
+	}
+}
+
+// 列的原始类型，如decimal(10,2)、datetime(3)，用于消费者解析字段
+func columnTypes(table *schema.Table) map[string]string {
+	types := make(map[string]string)
+	for _, col := range table.Columns {
+		types[col.Name] = col.RawType
+	}
+	return types
+}
+
+// 按表结构解析一行数据
+// 没有记录在binlog中的列不包含在结果中
+func rowDecode(table *schema.Table, row []interface{}, image rowImage) map[string]interface{} {
+	data := make(map[string]interface{})
+	rowsLen := len(row)
+	for k, col := range table.Columns {
+		if image.state(k) == columnMissing {
+			continue
+		}
+		if k < rowsLen {
+			data[col.Name] = fieldDecode(row[k], &col)
+		} else {
+			log.Warn("[W] unknown line", col.Name)
+			data[col.Name] = nil
+		}
+	}
+	return data
+}
+
 // String 基础接口
 func (h *Binlog) String() string {
 	return "Binlog"
 }
 
-// OnRotate 暂未使用的基础事件
-func (h *Binlog) OnRotate(e *replication.RotateEvent) error {
-	log.Debugf("[D] OnRotate event fired, %+v", e)
+// 处理ddl事件
+// 包括create、alter、rename、drop、create_index、drop_index、truncate，作为ddl事件推送，和行事件使用相同的主题过滤
+// header为query事件的事件头，为nil时使用当前时间和master的server id
+func (h *Binlog) onDDL(p mysql.Position, header *replication.EventHeader, e *replication.QueryEvent) error {
+	h.statusLock.Lock()
+	if h.status&binlogIsExit > 0 {
+		h.statusLock.Unlock()
+		return nil
+	}
+	h.statusLock.Unlock()
+	action, db, table := parseDDL(string(e.Query))
+	if db == "" {
+		db = string(e.Schema)
+	}
+	log.Infof("[I] schema change detected, db: %s, table: %s, action: %s.", db, table, action)
+
+	query := make(map[string]interface{})
+	query["query"] = string(e.Query)
+	query["action"] = action
+
+	event := make(map[string]interface{})
+	event["data"] = query
+
+	data := make(map[string]interface{})
+	data["database"] = db
+	data["event_type"] = eventTypeDDL
+	serverID := h.serverID
+	if header != nil {
+		// ddl在master上执行的时间，与行事件一致
+		data["time"] = int64(header.Timestamp)
+		serverID = header.ServerID
+	} else {
+		data["time"] = time.Now().Unix()
+	}
+	data["table"] = table
+	data["event_index"] = atomic.AddInt64(&h.EventIndex, int64(1))
+	data["event"] = event
+	h.lock.Lock()
+	if h.pendingGTID != nil {
+		data["event_id"] = h.eventID(h.pendingGTID.String(), eventIDDDL)
+	} else {
+		data["event_id"] = h.eventID(serverID, p.Name, p.Pos, eventIDDDL)
+	}
+	h.lock.Unlock()
+	h.setSource(data, serverID, p)
+
+	// ddl会隐式提交当前事务，ddl本身没有xid
+	h.lock.Lock()
+	h.commitGTID()
+	h.lock.Unlock()
+	h.commitTransaction(txCommit{})
+	h.schemaChanged(db, table, string(e.Query), p)
+	if table != "" && !h.tableMatch(db+"."+table) {
+		return nil
+	}
+	h.notify(data)
 	return nil
 }
 
-// alter table结构改变事件回调
-// func (h *Binlog) OnDDL(p mysql.Position, e *canal.DDLEvent) error {
-// 	log.Infof("[I] schema change detected, db: %s, table: %s, action: %s.", e.Schema, e.Table, e.Action)
-// 	query := make(map[string]interface{})
-// 	query["query"] = e.Query
-
-// 	event := make(map[string]interface{})
-// 	event["data"] = query
-
-// 	data := make(map[string]interface{})
-// 	data["database"] = e.Schema
-// 	data["event_type"] = e.Action
-// 	data["time"] = time.Now().Unix()
-// 	data["table"] = e.Table
-// 	data["event_index"] = atomic.AddInt64(&h.EventIndex, int64(1))
-// 	data["event"] = event
-// 	h.notify(data)
-// 	return nil
-// }
-
-// OnXID 暂未使用的基础事件
-func (h *Binlog) OnXID(p mysql.Position) error {
-	log.Debugf("[D] OnXID event fired, %+v.", p)
+// 设置事件的来源信息，用于计算延迟、去重以及追溯到binlog中的具体位置
+// binlog_pos为事件结束的位置，gtid为事件所在事务的gtid（如果有）
+func (h *Binlog) setSource(data map[string]interface{}, serverID uint32, p mysql.Position) {
+	h.lock.Lock()
+	gtid := ""
+	if h.pendingGTID != nil {
+		gtid = h.pendingGTID.String()
+	}
+	h.lock.Unlock()
+	if h.name != "" {
+		data["source"] = h.name
+	}
+	data["server_id"] = serverID
+	data["binlog_file"] = p.Name
+	data["binlog_pos"] = p.Pos
+	if gtid != "" {
+		data["gtid"] = gtid
+	}
+}
+
+// 处理事务提交，c中带有xid事件的事务号和时间戳，非事务表的COMMIT语句没有xid
+// 当前事务的gtid在此时合并到已执行的gtid集合，事务分组推送模式下缓存的行事件在此时推送
+func (h *Binlog) onXID(c txCommit) error {
+	log.Debugf("[D] commit event fired, %+v, xid: %d.", c.pos, c.xid)
+	h.lock.Lock()
+	h.commitGTID()
+	h.rowsQuery = ""
+	h.lock.Unlock()
+	h.commitTransaction(c)
 	return nil
 }
 
-// OnGTID 暂未使用的基础事件
+// OnGTID 事务开始事件，记录当前事务的gtid
+// 新的gtid事件出现时上一个事务已经结束（比如没有xid的ddl），先合并上一个事务的gtid
 func (h *Binlog) OnGTID(g mysql.GTIDSet) error {
 	log.Debugf("[D] OnGTID event fired, GTID: %+v", g)
+	h.lock.Lock()
+	h.commitGTID()
+	h.pendingGTID = g
+	h.txEvents = 0
+	h.rowsQuery = ""
+	h.lock.Unlock()
+	// 非事务表（如MyISAM）的提交没有xid，新事务开始时推送上一个事务缓存的行事件
+	h.commitTransaction(txCommit{})
 	return nil
 }
 
@@ -227,8 +510,12 @@ func (h *Binlog) OnPosSynced(p mysql.Position, b bool) error {
 	log.Debugf("[D] OnPosSynced fired with data: %+v, %v", p, b)
 	eventIndex := atomic.LoadInt64(&h.EventIndex)
 	pos := int64(p.Pos)
-	data := packPos(p.Name, pos, eventIndex)
-	h.saveBinlogPositionCache(data)
+	h.lock.Lock()
+	gtid := h.gtidString()
+	h.lock.Unlock()
+	data := packPos(p.Name, pos, eventIndex, gtid)
+	// 服务确认交付了之前的事件后才保存
+	h.ackPosition(data)
 	h.lock.Lock()
 	h.lastBinFile = p.Name
 	h.lastPos = p.Pos
@@ -240,55 +527,68 @@ func (h *Binlog) OnPosSynced(p mysql.Position, b bool) error {
 // 保存pos信息到cache
 // 这里的api对外提供，用于agent集群同步pos信息
 func (h *Binlog) SaveBinlogPosition(r []byte) {
-	file, pos, index := unpackPos(r)
+	file, pos, index, gtid := unpackPos(r)
 	h.lastBinFile = file    //p.Name
 	h.lastPos = uint32(pos) //p.Pos
 	atomic.StoreInt64(&h.EventIndex, index)
+	if gtid != "" && h.isGTIDMode() {
+		gset, err := mysql.ParseGTIDSet(h.flavor(), gtid)
+		if err != nil {
+			log.Errorf("[E] parse gtid set with error: %+v", err)
+		} else {
+			h.lock.Lock()
+			h.gtidSet = gset
+			h.lock.Unlock()
+		}
+	}
 	h.saveBinlogPositionCache(r)
 }
 
 // agent 接收到pos改变的时候也会回调到这里
-// 保存pos信息到cache
+// 保存pos信息到检查点文件
 func (h *Binlog) saveBinlogPositionCache(r []byte) {
 	h.statusLock.Lock()
 	if h.status&binlogIsExit > 0 {
 		h.statusLock.Unlock()
 		return
 	}
-	log.Debugf("[D] write binlog pos cache: %+v", r)
-	if h.status&cacheHandlerIsOpened > 0 {
-		n, err := h.cacheHandler.WriteAt(r, 0)
-		if err != nil || n <= 0 {
-			log.Errorf("[E] write binlog cache file with error: %+v", err)
-		}
-	} else {
-		log.Warnf("[W] handler is closed")
-	}
 	h.statusLock.Unlock()
+	h.saveCheckpoint(r)
 	//只有leader才发送
 	for _, f := range h.onPosChanges {
 		f(r)
 	}
 }
 
-// 读取cache中的pos信息
-// 返回值分别为binlog file，binlog pos，event index 事件索引
-func (h *Binlog) getBinlogPositionCache() (string, int64, int64) {
-	h.statusLock.Lock()
-	if h.status&cacheHandlerIsOpened <= 0 {
-		h.statusLock.Unlock()
-		log.Warnf("[W] handler is closed")
-		return "", 0, 0
+// 写入检查点，r为packPos打包的pos信息
+func (h *Binlog) saveCheckpoint(r []byte) {
+	log.Debugf("[D] write binlog checkpoint: %+v", r)
+	file, pos, index, gtid := unpackPos(r)
+	if file == "" {
+		return
 	}
-	h.statusLock.Unlock()
-	h.cacheHandler.Seek(0, io.SeekStart)
-	data := make([]byte, bytes.MinRead)
-	n, err := h.cacheHandler.Read(data)
-	if n <= 0 || err != nil {
-		if err != io.EOF {
-			log.Errorf("[E] read pos error: %v", err)
-		}
-		return "", int64(0), int64(0)
+	if err := h.checkpoints.save(file, uint32(pos), index, gtid); err != nil {
+		log.Errorf("[E] write binlog checkpoint with error: %+v", err)
+	}
+}
+
+// 写入还没有写入的检查点
+func (h *Binlog) flushCheckpoint() {
+	if err := h.checkpoints.flush(); err != nil {
+		log.Errorf("[E] write binlog checkpoint with error: %+v", err)
+	}
+}
+
+// 读取检查点中的pos信息
+// 返回值分别为binlog file，binlog pos，event index 事件索引，gtid集合
+// 检查点文件损坏时不能从当前位置开始同步，否则会丢失数据
+func (h *Binlog) getBinlogPositionCache() (string, int64, int64, string) {
+	c, err := h.checkpoints.load()
+	if err != nil {
+		log.Panicf("[P] read binlog checkpoint with error：%+v", err)
+	}
+	if c == nil {
+		return "", int64(0), int64(0), ""
 	}
-	return unpackPos(data)
+	return c.File, int64(c.Pos), c.EventIndex, c.GTID
 }
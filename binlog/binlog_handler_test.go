@@ -9,6 +9,8 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"github.com/toolkits/file"
+
+	"github.com/mia0x75/copycat/g"
 )
 
 // GetCurrentPath get current path
@@ -38,24 +40,21 @@ func init() {
 // 基础的保存pos到cache和读取cache相关api测试
 func TestBinlogHandler_SaveBinlogPostionCache(t *testing.T) {
 	h := &Binlog{
-		statusLock: new(sync.Mutex),
-		status:     cacheHandlerIsOpened,
-	}
-	var err error
-	flag := os.O_RDWR | os.O_CREATE | os.O_SYNC
-	h.cacheHandler, err = os.OpenFile(CurrentPath+"/cache_test.pos", flag, 0755)
-	if err != nil {
-		t.Errorf("binlog open cache file error: %+v", err)
+		statusLock:  new(sync.Mutex),
+		checkpoints: newCheckpointFile(&g.CheckpointConfig{File: CurrentPath + "/cache_test.pos"}),
 	}
 	defer file.Remove(CurrentPath + "/cache_test.pos")
+	// 每次保存都立即写入
+	h.checkpoints.interval = 0
 
 	binfile := "mysql-bin.000059"
 	pos := int64(123456)
 	eventIndex := int64(20)
+	gtid := "3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5"
 
-	r := packPos(binfile, pos, eventIndex)
+	r := packPos(binfile, pos, eventIndex, gtid)
 	h.saveBinlogPositionCache(r)
-	s, p, e := h.getBinlogPositionCache()
+	s, p, e, gs := h.getBinlogPositionCache()
 	if s != binfile {
 		t.Errorf("getBinlogPositionCache binfile error")
 	}
@@ -65,13 +64,17 @@ func TestBinlogHandler_SaveBinlogPostionCache(t *testing.T) {
 	if e != eventIndex {
 		t.Errorf("getBinlogPositionCache eventIndex error")
 	}
+	if gs != gtid {
+		t.Errorf("getBinlogPositionCache gtid error")
+	}
 
 	binfile = "mysql-bin.00005"
 	pos = int64(12345)
 	eventIndex = int64(2)
-	r = packPos(binfile, pos, eventIndex)
+	gtid = ""
+	r = packPos(binfile, pos, eventIndex, gtid)
 	h.saveBinlogPositionCache(r)
-	s, p, e = h.getBinlogPositionCache()
+	s, p, e, gs = h.getBinlogPositionCache()
 	if s != binfile {
 		t.Errorf("getBinlogPositionCache binfile error")
 	}
@@ -81,4 +84,68 @@ func TestBinlogHandler_SaveBinlogPostionCache(t *testing.T) {
 	if e != eventIndex {
 		t.Errorf("getBinlogPositionCache eventIndex error")
 	}
+	if gs != gtid {
+		t.Errorf("getBinlogPositionCache gtid error")
+	}
+}
+
+// test unpackPos api with the cache written by old version
+// 旧版本的cache没有gtid集合
+func TestUnpackPos_WithoutGTID(t *testing.T) {
+	r := packPos("mysql-bin.000059", 123456, 20, "")
+	// 去掉末尾的gtid长度，模拟旧版本的cache
+	s, p, e, gs := unpackPos(r[:len(r)-2])
+	if s != "mysql-bin.000059" || p != 123456 || e != 20 || gs != "" {
+		t.Errorf("unpackPos old format error: %s, %d, %d, %s", s, p, e, gs)
+	}
+	s, p, e, gs = unpackPos([]byte{})
+	if s != "" || p != 0 || e != 0 || gs != "" {
+		t.Errorf("unpackPos empty data error")
+	}
+}
+
+// test setRowKey api
+// update修改了主键时需要带上修改前的主键
+func TestSetRowKey(t *testing.T) {
+	keys := []string{"id"}
+	rowData := make(map[string]interface{})
+	setRowKey(rowData, keys, map[string]interface{}{"id": 1, "name": "a"}, map[string]interface{}{"id": 1, "name": "b"})
+	if pk := rowData["pk"].(map[string]interface{}); pk["id"] != 1 {
+		t.Errorf("pk error: %+v", rowData)
+	}
+	if _, ok := rowData["old_pk"]; ok {
+		t.Errorf("old_pk should not be set when the key is not changed")
+	}
+	setRowKey(rowData, keys, map[string]interface{}{"id": 1}, map[string]interface{}{"id": 2})
+	if pk := rowData["pk"].(map[string]interface{}); pk["id"] != 2 {
+		t.Errorf("pk error: %+v", rowData)
+	}
+	if oldPk := rowData["old_pk"].(map[string]interface{}); oldPk["id"] != 1 {
+		t.Errorf("old_pk error: %+v", rowData)
+	}
+	rowData = make(map[string]interface{})
+	setRowKey(rowData, []string{}, nil, map[string]interface{}{"id": 1})
+	if _, ok := rowData["pk"]; ok {
+		t.Errorf("pk should not be set without key columns")
+	}
+}
+
+// test OnRow source info
+// 行事件带上binlog事件头的时间戳、server id以及binlog位置
+func TestBinlog_OnRowSource(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{Database: &g.DatabaseConfig{}}, &events)
+	e := newTestRowsEvent("a", 2)
+	e.Header.ServerID = 3
+	testOnRow(h, e)
+	if len(events) != 2 {
+		t.Fatalf("expect 2 events, got %d", len(events))
+	}
+	for i, ev := range events {
+		if ev["time"] != float64(1555555555) || ev["server_id"] != float64(3) ||
+			ev["binlog_file"] != "mysql-bin.000001" || ev["binlog_pos"] != float64(200) ||
+			ev["row_index"] != float64(i) {
+			t.Errorf("source info error: %+v", ev)
+		}
+	}
 }
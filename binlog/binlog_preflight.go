@@ -0,0 +1,334 @@
+package binlog
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/siddontang/go-mysql/client"
+	"github.com/siddontang/go-mysql/mysql"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// 启动前检查结果的级别
+const (
+	PreflightOK    = "ok"    // 正常
+	PreflightWarn  = "warn"  // 可以启动，但是可能有问题
+	PreflightFatal = "fatal" // 不能启动
+)
+
+// binlog保留时间少于该值时警告
+const minBinlogRetention = 24 * time.Hour
+
+// 启动前检查需要的全局变量
+var preflightVariables = []string{
+	"server_id", "log_bin", "binlog_format", "binlog_row_image", "gtid_mode",
+	"expire_logs_days", "binlog_expire_logs_seconds",
+}
+
+// Finding 单项检查的结果
+type Finding struct {
+	Check   string `json:"check"`   // 检查项，如binlog_format
+	Level   string `json:"level"`   // ok、warn或者fatal
+	Message string `json:"message"` //
+}
+
+// PreflightReport 数据源的启动前检查报告
+type PreflightReport struct {
+	Source   string     `json:"source"`   // 数据源名称，只有一个数据源时为空
+	Addr     string     `json:"addr"`     //
+	Findings []*Finding `json:"findings"` // 所有检查项的结果，不会在第一个错误时停止
+}
+
+func (r *PreflightReport) add(check, level, format string, args ...interface{}) {
+	r.Findings = append(r.Findings, &Finding{Check: check, Level: level, Message: fmt.Sprintf(format, args...)})
+}
+
+// Fatal 是否有不能启动的问题
+func (r *PreflightReport) Fatal() bool {
+	for _, f := range r.Findings {
+		if f.Level == PreflightFatal {
+			return true
+		}
+	}
+	return false
+}
+
+// String 格式化的报告，每个检查项一行
+func (r *PreflightReport) String() string {
+	name := r.Source
+	if name == "" {
+		name = "default"
+	}
+	lines := []string{fmt.Sprintf("source %s (%s):", name, r.Addr)}
+	for _, f := range r.Findings {
+		lines = append(lines, fmt.Sprintf("  [%-5s] %-16s %s", strings.ToUpper(f.Level), f.Check, f.Message))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Log 按级别记录所有检查项
+func (r *PreflightReport) Log() {
+	for _, f := range r.Findings {
+		switch f.Level {
+		case PreflightFatal:
+			log.Errorf("[E] preflight %s %s: %s", r.Source, f.Check, f.Message)
+		case PreflightWarn:
+			log.Warnf("[W] preflight %s %s: %s", r.Source, f.Check, f.Message)
+		default:
+			log.Infof("[I] preflight %s %s: %s", r.Source, f.Check, f.Message)
+		}
+	}
+}
+
+// Preflight 启动前检查数据源
+// 检查binlog格式、行镜像、gtid模式、账号权限、binlog保留时间和server_id是否冲突，
+// 一次报告所有的问题，有fatal级别的问题时不应该启动
+func Preflight(ctx *g.Context, opts ...Option) *PreflightReport {
+	return newBinlog(ctx, opts...).preflight()
+}
+
+func (h *Binlog) preflight() *PreflightReport {
+	r := &PreflightReport{Source: h.name}
+	cfg := h.database()
+	if cfg == nil {
+		r.add("config", PreflightFatal, "database source not configured")
+		return r
+	}
+	r.Addr = fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	conn, err := client.Connect(r.Addr, cfg.User, cfg.Password, "")
+	if err != nil {
+		r.add("connect", PreflightFatal, "connect with error: %v", err)
+		return r
+	}
+	defer conn.Close()
+	r.add("connect", PreflightOK, "connected as %s", cfg.User)
+
+	vars, err := globalVariables(conn)
+	if err != nil {
+		r.add("variables", PreflightFatal, "read global variables with error: %v", err)
+		return r
+	}
+	checkBinlogFormat(r, vars)
+	checkRowImage(r, vars)
+	checkGTIDMode(r, vars, cfg.Flavor, h.isGTIDMode())
+	checkRetention(r, vars)
+
+	if grants, err := showGrants(conn); err != nil {
+		r.add("privileges", PreflightWarn, "show grants with error: %v", err)
+	} else {
+		checkGrants(r, grants)
+	}
+
+	if hosts, err := slaveHosts(conn); err != nil {
+		r.add("server_id", PreflightWarn, "show slave hosts with error: %v", err)
+	} else {
+		hostname, _ := os.Hostname()
+		cluster := h.ctx.Config().Agent != nil && h.ctx.Config().Agent.Enabled
+		checkServerID(r, cfg.ServerID, vars["server_id"], hosts, hostname, cluster)
+	}
+	return r
+}
+
+// 读取需要的全局变量，变量名为小写，不存在的变量为空字符串
+func globalVariables(conn *client.Conn) (map[string]string, error) {
+	names := make([]string, 0)
+	for _, name := range preflightVariables {
+		names = append(names, "'"+name+"'")
+	}
+	rr, err := conn.Execute("SHOW GLOBAL VARIABLES WHERE Variable_name IN (" + strings.Join(names, ",") + ")")
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string)
+	for i := 0; i < rr.RowNumber(); i++ {
+		name, _ := rr.GetString(i, 0)
+		value, _ := rr.GetString(i, 1)
+		vars[strings.ToLower(name)] = value
+	}
+	return vars, nil
+}
+
+// 当前账号的授权语句
+func showGrants(conn *client.Conn) ([]string, error) {
+	rr, err := conn.Execute("SHOW GRANTS")
+	if err != nil {
+		return nil, err
+	}
+	grants := make([]string, 0)
+	for i := 0; i < rr.RowNumber(); i++ {
+		grant, _ := rr.GetString(i, 0)
+		grants = append(grants, grant)
+	}
+	return grants, nil
+}
+
+// 注册到数据源的从库
+type slaveHost struct {
+	serverID uint64
+	host     string
+	port     uint64
+}
+
+// 注册到数据源的所有从库，包括其他的copycat进程
+func slaveHosts(conn *client.Conn) ([]slaveHost, error) {
+	rr, err := conn.Execute("SHOW SLAVE HOSTS")
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]slaveHost, 0)
+	for i := 0; i < rr.RowNumber(); i++ {
+		var s slaveHost
+		s.serverID, _ = rr.GetUintByName(i, "Server_id")
+		s.host, _ = rr.GetStringByName(i, "Host")
+		s.port, _ = rr.GetUintByName(i, "Port")
+		hosts = append(hosts, s)
+	}
+	return hosts, nil
+}
+
+// binlog必须开启，并且为row格式
+func checkBinlogFormat(r *PreflightReport, vars map[string]string) {
+	if !strings.EqualFold(vars["log_bin"], "ON") && vars["log_bin"] != "1" {
+		r.add("log_bin", PreflightFatal, "binary log is disabled, log_bin=%s", vars["log_bin"])
+	} else {
+		r.add("log_bin", PreflightOK, "binary log is enabled")
+	}
+	format := strings.ToUpper(vars["binlog_format"])
+	if format != "ROW" {
+		r.add("binlog_format", PreflightFatal, "binlog_format is %s, ROW is required", format)
+		return
+	}
+	r.add("binlog_format", PreflightOK, "ROW")
+}
+
+// minimal和noblob时没有记录的列会被标记，不影响启动
+func checkRowImage(r *PreflightReport, vars map[string]string) {
+	image := strings.ToLower(vars["binlog_row_image"])
+	switch image {
+	case "":
+		r.add("binlog_row_image", PreflightOK, "not supported by the server, full row image assumed")
+	case rowImageFull:
+		r.add("binlog_row_image", PreflightOK, "FULL")
+	case rowImageMinimal, rowImageNoblob:
+		r.add("binlog_row_image", PreflightWarn, "binlog_row_image is %s, the columns not logged will be marked in missing_columns", strings.ToUpper(image))
+	default:
+		r.add("binlog_row_image", PreflightWarn, "unknown binlog_row_image %s", image)
+	}
+}
+
+// gtid同步模式下mysql必须开启gtid_mode，mariadb总是有gtid
+func checkGTIDMode(r *PreflightReport, vars map[string]string, flavor string, gtid bool) {
+	mode := strings.ToUpper(vars["gtid_mode"])
+	if !gtid {
+		r.add("gtid_mode", PreflightOK, "position sync mode")
+		return
+	}
+	if flavor == mysql.MariaDBFlavor {
+		r.add("gtid_mode", PreflightOK, "gtid sync mode with mariadb gtid")
+		return
+	}
+	if mode != "ON" {
+		r.add("gtid_mode", PreflightFatal, "sync_mode is gtid, but gtid_mode is %s", mode)
+		return
+	}
+	r.add("gtid_mode", PreflightOK, "gtid sync mode, gtid_mode=ON")
+}
+
+// binlog保留时间过短时，停机维护期间同步位置可能被清理
+// mysql 8.0使用binlog_expire_logs_seconds，之前的版本使用expire_logs_days，都为0时不会自动清理
+func checkRetention(r *PreflightReport, vars map[string]string) {
+	var retention time.Duration
+	var seconds, days float64
+	fmt.Sscan(vars["binlog_expire_logs_seconds"], &seconds)
+	fmt.Sscan(vars["expire_logs_days"], &days)
+	if seconds > 0 {
+		retention = time.Duration(seconds) * time.Second
+	} else if days > 0 {
+		retention = time.Duration(days * float64(24*time.Hour))
+	}
+	if retention == 0 {
+		r.add("binlog_retention", PreflightOK, "binary logs are not purged automatically")
+		return
+	}
+	if retention < minBinlogRetention {
+		r.add("binlog_retention", PreflightWarn, "binary logs are purged after %s, the position may be purged during a downtime", retention)
+		return
+	}
+	r.add("binlog_retention", PreflightOK, "binary logs are purged after %s", retention)
+}
+
+// 同步需要REPLICATION SLAVE和REPLICATION CLIENT权限，读取表结构和快照需要SELECT权限
+func checkGrants(r *PreflightReport, grants []string) {
+	privileges := make(map[string]bool)
+	for _, grant := range grants {
+		grant = strings.ToUpper(grant)
+		if !strings.HasPrefix(grant, "GRANT ") {
+			continue
+		}
+		i := strings.Index(grant, " ON ")
+		if i < 0 {
+			continue
+		}
+		global := strings.HasPrefix(strings.TrimSpace(grant[i+4:]), "*.*")
+		for _, p := range strings.Split(grant[6:i], ",") {
+			p = strings.TrimSpace(p)
+			if p == "ALL" {
+				p = "ALL PRIVILEGES"
+			}
+			if p == "SELECT" || p == "ALL PRIVILEGES" {
+				privileges["SELECT"] = true
+			}
+			if global {
+				privileges[p] = true
+			}
+		}
+	}
+	missing := make([]string, 0)
+	for _, p := range []string{"REPLICATION SLAVE", "REPLICATION CLIENT"} {
+		if !privileges[p] && !privileges["ALL PRIVILEGES"] {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) > 0 {
+		r.add("privileges", PreflightFatal, "missing %s on *.*", strings.Join(missing, ", "))
+		return
+	}
+	if !privileges["SELECT"] {
+		r.add("privileges", PreflightWarn, "no SELECT privilege, table schemas and snapshots can not be read")
+		return
+	}
+	r.add("privileges", PreflightOK, "REPLICATION SLAVE, REPLICATION CLIENT")
+}
+
+// server_id不能为0，不能和数据源以及其他从库相同，否则会被数据源断开
+// 本机的旧连接断开前仍然会出现在列表中；集群模式下其他节点可能正在同步，只作为警告
+func checkServerID(r *PreflightReport, serverID uint32, masterID string, hosts []slaveHost, hostname string, cluster bool) {
+	if serverID == 0 {
+		r.add("server_id", PreflightFatal, "server_id must not be 0")
+		return
+	}
+	if masterID == fmt.Sprintf("%d", serverID) {
+		r.add("server_id", PreflightFatal, "server_id %d is the same as the source server", serverID)
+		return
+	}
+	for _, s := range hosts {
+		if s.serverID != uint64(serverID) {
+			continue
+		}
+		if s.host == hostname {
+			r.add("server_id", PreflightWarn, "server_id %d is used by %s:%d, maybe a previous connection of this host", serverID, s.host, s.port)
+			return
+		}
+		if cluster {
+			r.add("server_id", PreflightWarn, "server_id %d is used by %s:%d, maybe another node of the cluster", serverID, s.host, s.port)
+			return
+		}
+		r.add("server_id", PreflightFatal, "server_id %d is used by another replica %s:%d", serverID, s.host, s.port)
+		return
+	}
+	r.add("server_id", PreflightOK, "server_id %d is unique", serverID)
+}
@@ -0,0 +1,104 @@
+package binlog
+
+import (
+	"testing"
+)
+
+func findingLevel(r *PreflightReport, check string) string {
+	for _, f := range r.Findings {
+		if f.Check == check {
+			return f.Level
+		}
+	}
+	return ""
+}
+
+// test binlog variable checks
+// 所有的检查项都会报告，不会在第一个错误时停止
+func TestBinlog_PreflightVariables(t *testing.T) {
+	r := &PreflightReport{}
+	vars := map[string]string{
+		"log_bin":          "ON",
+		"binlog_format":    "STATEMENT",
+		"binlog_row_image": "MINIMAL",
+		"gtid_mode":        "OFF",
+		"expire_logs_days": "0",
+	}
+	checkBinlogFormat(r, vars)
+	checkRowImage(r, vars)
+	checkGTIDMode(r, vars, "mysql", true)
+	checkRetention(r, vars)
+	expect := map[string]string{
+		"log_bin":          PreflightOK,
+		"binlog_format":    PreflightFatal,
+		"binlog_row_image": PreflightWarn,
+		"gtid_mode":        PreflightFatal,
+		"binlog_retention": PreflightOK,
+	}
+	for check, level := range expect {
+		if l := findingLevel(r, check); l != level {
+			t.Errorf("%s expect %s, got %s", check, level, l)
+		}
+	}
+	if !r.Fatal() {
+		t.Errorf("report should be fatal")
+	}
+
+	// mariadb总是有gtid，mysql 8.0的保留时间优先
+	r = &PreflightReport{}
+	checkGTIDMode(r, map[string]string{}, "mariadb", true)
+	checkRetention(r, map[string]string{"binlog_expire_logs_seconds": "3600", "expire_logs_days": "7"})
+	if findingLevel(r, "gtid_mode") != PreflightOK || findingLevel(r, "binlog_retention") != PreflightWarn {
+		t.Errorf("unexpected findings: %+v", r.String())
+	}
+	if r.Fatal() {
+		t.Errorf("report should not be fatal")
+	}
+}
+
+// test privilege checks
+func TestBinlog_PreflightGrants(t *testing.T) {
+	cases := []struct {
+		grants []string
+		level  string
+	}{
+		{[]string{"GRANT ALL PRIVILEGES ON *.* TO 'root'@'%'"}, PreflightOK},
+		{[]string{"GRANT SELECT, REPLICATION SLAVE, REPLICATION CLIENT ON *.* TO `copycat`@`%`"}, PreflightOK},
+		{[]string{"GRANT REPLICATION SLAVE, REPLICATION CLIENT ON *.* TO 'copycat'@'%'"}, PreflightWarn},
+		{[]string{"GRANT USAGE ON *.* TO 'copycat'@'%'", "GRANT ALL PRIVILEGES ON `test`.* TO 'copycat'@'%'"}, PreflightFatal},
+		{[]string{"GRANT REPLICATION CLIENT ON *.* TO 'copycat'@'%'", "GRANT SELECT ON `test`.* TO 'copycat'@'%'"}, PreflightFatal},
+	}
+	for _, c := range cases {
+		r := &PreflightReport{}
+		checkGrants(r, c.grants)
+		if l := findingLevel(r, "privileges"); l != c.level {
+			t.Errorf("%v expect %s, got %s", c.grants, c.level, l)
+		}
+	}
+}
+
+// test server id collision
+// 本机的旧连接和集群的其他节点只作为警告
+func TestBinlog_PreflightServerID(t *testing.T) {
+	hosts := []slaveHost{{serverID: 100, host: "db2", port: 3306}, {serverID: 1001, host: "node1", port: 3306}}
+	cases := []struct {
+		serverID uint32
+		hostname string
+		cluster  bool
+		level    string
+	}{
+		{0, "node1", false, PreflightFatal},
+		{1, "node1", false, PreflightFatal},
+		{1002, "node1", false, PreflightOK},
+		{1001, "node1", false, PreflightWarn},
+		{1001, "node2", false, PreflightFatal},
+		{1001, "node2", true, PreflightWarn},
+	}
+	for _, c := range cases {
+		r := &PreflightReport{}
+		checkServerID(r, c.serverID, "1", hosts, c.hostname, c.cluster)
+		if l := findingLevel(r, "server_id"); l != c.level {
+			t.Errorf("server id %d on %s expect %s, got %s", c.serverID, c.hostname, c.level, l)
+		}
+	}
+}
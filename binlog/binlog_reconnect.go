@@ -0,0 +1,197 @@
+package binlog
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// 自动重连
+// 同步出错时重新创建canal句柄，从最后同步到的位置继续，重试间隔按指数增长并加上随机抖动
+// 重连之后同步位置有前进时重试次数清零，连续失败超过配置的次数后放弃，等待下一次启动服务
+const (
+	reconnectDefaultInitialInterval = 1000  // 默认的初始重试间隔，毫秒
+	reconnectDefaultMaxInterval     = 60000 // 默认的最大重试间隔，毫秒
+)
+
+var errStreamClosed = errors.New("binlog stream closed")
+
+// 重连状态
+type retryState struct {
+	Attempts      int    `json:"attempts"`        // 连续失败的次数
+	LastError     string `json:"last_error"`      // 最后一次错误
+	LastErrorTime int64  `json:"last_error_time"` // 最后一次错误的时间
+	NextRetryTime int64  `json:"next_retry_time"` // 下一次重试的时间，没有在等待重试时为0
+	GaveUp        bool   `json:"gave_up"`         // 超过重试次数，已经放弃
+}
+
+// 监督同步协程，出错时自动重连
+func (h *Binlog) supervise() {
+	h.lock.Lock()
+	h.retry = &retryState{}
+	h.lock.Unlock()
+	for {
+		h.lock.Lock()
+		start := mysql.Position{Name: h.lastBinFile, Pos: h.lastPos}
+		h.lock.Unlock()
+		err := h.run()
+		if h.stopped() {
+			// 服务被停止
+			return
+		}
+		if err == nil {
+			err = errStreamClosed
+		}
+		log.Warnf("[W] binlog service exit with error: %+v", err)
+		h.lock.Lock()
+		if h.lastBinFile != start.Name || h.lastPos != start.Pos {
+			// 上一次连接有进展，重新计数
+			h.retry.Attempts = 0
+		}
+		h.retry.Attempts++
+		h.retry.LastError = err.Error()
+		h.retry.LastErrorTime = time.Now().Unix()
+		attempts := h.retry.Attempts
+		h.lock.Unlock()
+		switch err.(type) {
+		case *positionMissingError, *transformHaltError:
+			// 重试也无法恢复，需要人工处理
+			h.giveUp()
+			return
+		}
+		if max := h.reconnectConfig().MaxRetries; max > 0 && attempts > max {
+			log.Errorf("[E] binlog reconnect failed %d times, give up", max)
+			h.giveUp()
+			return
+		}
+		d := h.backoff(attempts)
+		h.lock.Lock()
+		h.retry.NextRetryTime = time.Now().Add(d).Unix()
+		h.lock.Unlock()
+		log.Infof("[I] binlog reconnect after %v, attempts: %d", d, attempts)
+		if !h.sleep(d) {
+			return
+		}
+		h.lock.Lock()
+		h.retry.NextRetryTime = 0
+		h.lock.Unlock()
+		closeHandler(h.currentHandler())
+		h.setHandler()
+	}
+}
+
+// 放弃重连，停止服务
+func (h *Binlog) giveUp() {
+	h.lock.Lock()
+	h.retry.GaveUp = true
+	h.lock.Unlock()
+	h.statusLock.Lock()
+	h.status &^= binlogIsRunning
+	h.statusLock.Unlock()
+}
+
+// 执行一次同步，返回时同步已经结束
+func (h *Binlog) run() error {
+	// 启动时跳过同步位置的gap事件在快照之前推送
+	h.flushGap()
+	if err := h.snapshot(); err != nil {
+		// 快照被中断，下次启动时从保存的进度继续
+		log.Warnf("[W] binlog snapshot exit with error: %+v", err)
+		return err
+	}
+	// 同步位置可能已经被purge
+	if err := h.checkPosition(); err != nil {
+		return err
+	}
+	h.lock.Lock()
+	startPos := mysql.Position{Name: h.lastBinFile, Pos: h.lastPos}
+	var gset mysql.GTIDSet
+	if h.gtidSet != nil {
+		gset = h.gtidSet.Clone()
+	}
+	h.lock.Unlock()
+	if gset != nil {
+		// gtid模式，master切换后binlog file会变化，从gtid集合继续同步
+		log.Debugf("[D] binlog start from gtid set: %s", gset.String())
+	}
+	return h.stream(startPos, gset)
+}
+
+// 重试间隔，第n次重试为初始间隔的2^(n-1)倍，不超过最大间隔，实际间隔在[d/2, d]之间随机
+func (h *Binlog) backoff(attempts int) time.Duration {
+	cfg := h.reconnectConfig()
+	d := time.Duration(cfg.InitialInterval) * time.Millisecond
+	max := time.Duration(cfg.MaxInterval) * time.Millisecond
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// 重连配置，未配置的项使用默认值
+func (h *Binlog) reconnectConfig() *g.ReconnectConfig {
+	cfg := g.ReconnectConfig{}
+	if h.ctx.Config().Reconnect != nil {
+		cfg = *h.ctx.Config().Reconnect
+	}
+	if cfg.InitialInterval <= 0 {
+		cfg.InitialInterval = reconnectDefaultInitialInterval
+	}
+	if cfg.MaxInterval <= 0 {
+		cfg.MaxInterval = reconnectDefaultMaxInterval
+	}
+	if cfg.MaxInterval < cfg.InitialInterval {
+		cfg.MaxInterval = cfg.InitialInterval
+	}
+	return &cfg
+}
+
+// 等待一段时间，服务被停止时返回false
+func (h *Binlog) sleep(d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	for time.Now().Before(deadline) {
+		if h.stopped() {
+			return false
+		}
+		select {
+		case <-h.ctx.Ctx.Done():
+			return false
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+	return !h.stopped()
+}
+
+// 重连状态，用于管理接口
+func (h *Binlog) retryStatus() *retryState {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.retry == nil {
+		return nil
+	}
+	r := *h.retry
+	return &r
+}
+
+// 关闭canal句柄
+// canal在连接已经断开时关闭会panic，这里忽略
+func closeHandler(c *canal.Canal) {
+	if c == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Warnf("[W] close binlog handler with error: %+v", r)
+		}
+	}()
+	c.Close()
+}
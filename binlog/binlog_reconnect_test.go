@@ -0,0 +1,61 @@
+package binlog
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// test reconnect backoff
+// 重试间隔按指数增长，不超过最大间隔，抖动在[d/2, d]之间
+func TestBinlog_Backoff(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{Reconnect: &g.ReconnectConfig{
+		InitialInterval: 100,
+		MaxInterval:     1000,
+	}}, &events)
+	expects := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, expect := range expects {
+		expect *= time.Millisecond
+		for n := 0; n < 20; n++ {
+			d := h.backoff(i + 1)
+			if d < expect/2 || d > expect {
+				t.Fatalf("attempts %d: backoff %v out of [%v, %v]", i+1, d, expect/2, expect)
+			}
+		}
+	}
+	// 未配置时使用默认值
+	h = newTestBinlog(&g.GlobalConfig{}, &events)
+	cfg := h.reconnectConfig()
+	if cfg.InitialInterval != reconnectDefaultInitialInterval || cfg.MaxInterval != reconnectDefaultMaxInterval {
+		t.Errorf("unexpected default reconnect config: %+v", cfg)
+	}
+	if d := h.backoff(100); d > reconnectDefaultMaxInterval*time.Millisecond {
+		t.Errorf("backoff %v exceed max interval", d)
+	}
+}
+
+// test reconnect sleep
+// 服务停止时立即返回
+func TestBinlog_ReconnectSleep(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{}, &events)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h.ctx.Ctx = ctx
+	h.status = binlogIsRunning
+	if !h.sleep(time.Millisecond * 10) {
+		t.Errorf("sleep should finish while running")
+	}
+	h.status = 0
+	start := time.Now()
+	if h.sleep(time.Minute) {
+		t.Errorf("sleep should be interrupted after stopped")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("sleep should return immediately after stopped")
+	}
+	closeHandler(nil)
+}
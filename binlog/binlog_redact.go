@@ -0,0 +1,192 @@
+package binlog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// 敏感数据脱敏
+// 按db.table.column配置规则，在推送之前处理data、old_data、new_data中的列
+// 主键的值同样可能是敏感数据，pk和old_pk也使用同样的规则处理
+const (
+	redactDrop = "drop" // 删除列
+	redactNull = "null" // 置为null
+	redactMask = "mask" // 替换为固定的字符串
+	redactHash = "hash" // 加盐的sha256
+	redactLast = "last" // 只保留最后n个字符，其余替换为*
+)
+
+// mask未配置时的默认值
+const redactDefaultMask = "******"
+
+// 编译后的脱敏规则
+type redactor struct {
+	cfg     *g.RedactConfig        // 生成规则的配置，配置重新加载后重新编译
+	rules   []*redactRule          //
+	lock    *sync.Mutex            //
+	columns map[string]*redactRule // 缓存db.table.column匹配的规则，没有规则时为nil
+}
+
+type redactRule struct {
+	cfg *g.RedactRuleConfig
+	exp *regexp.Regexp
+}
+
+// 编译脱敏规则，规则错误时返回error
+func newRedactor(cfg *g.RedactConfig) (*redactor, error) {
+	r := &redactor{
+		cfg:     cfg,
+		rules:   make([]*redactRule, 0),
+		lock:    new(sync.Mutex),
+		columns: make(map[string]*redactRule),
+	}
+	if cfg == nil {
+		return r, nil
+	}
+	for _, rule := range cfg.Rules {
+		switch rule.Action {
+		case redactDrop, redactNull, redactMask, redactHash, redactLast:
+		default:
+			return nil, fmt.Errorf("unknown redact action %s of %s", rule.Action, rule.Column)
+		}
+		exp, err := regexp.Compile(rule.Column)
+		if err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, &redactRule{cfg: rule, exp: exp})
+	}
+	return r, nil
+}
+
+// 列对应的规则，按顺序匹配，第一个匹配的生效
+func (r *redactor) rule(column string) *redactRule {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if rule, ok := r.columns[column]; ok {
+		return rule
+	}
+	var res *redactRule
+	for _, rule := range r.rules {
+		if rule.exp.MatchString(column) {
+			res = rule
+			break
+		}
+	}
+	r.columns[column] = res
+	return res
+}
+
+// 处理一行数据，prefix为db.table.
+func (r *redactor) row(prefix string, data map[string]interface{}) {
+	for name, v := range data {
+		rule := r.rule(prefix + name)
+		if rule == nil {
+			continue
+		}
+		if rule.cfg.Action == redactDrop {
+			delete(data, name)
+			continue
+		}
+		data[name] = rule.value(r.cfg.Salt, v)
+	}
+}
+
+// 脱敏后的值，null不做处理
+func (rule *redactRule) value(salt string, v interface{}) interface{} {
+	if rule.cfg.Action == redactNull || v == nil {
+		return nil
+	}
+	switch rule.cfg.Action {
+	case redactMask:
+		if rule.cfg.Mask == "" {
+			return redactDefaultMask
+		}
+		return rule.cfg.Mask
+	case redactHash:
+		sum := sha256.Sum256([]byte(salt + fmt.Sprint(v)))
+		return hex.EncodeToString(sum[:])
+	case redactLast:
+		s := []rune(fmt.Sprint(v))
+		keep := rule.cfg.Keep
+		if keep < 0 {
+			keep = 0
+		}
+		if keep > len(s) {
+			keep = len(s)
+		}
+		return strings.Repeat("*", len(s)-keep) + string(s[len(s)-keep:])
+	}
+	return v
+}
+
+// 当前生效的脱敏规则，配置重新加载后重新编译
+func (h *Binlog) redactRules() *redactor {
+	cfg := h.ctx.Config().Redact
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.redactor != nil && h.redactor.cfg == cfg {
+		return h.redactor
+	}
+	r, err := newRedactor(cfg)
+	if err != nil {
+		log.Errorf("[E] redact rules with error: %+v", err)
+		if h.redactor != nil {
+			// 保留之前的规则，避免新规则错误时敏感数据被推送
+			return h.redactor
+		}
+		r = &redactor{cfg: cfg, lock: new(sync.Mutex), columns: make(map[string]*redactRule)}
+	}
+	h.redactor = r
+	return r
+}
+
+// 对行事件脱敏
+func (h *Binlog) redact(rowData map[string]interface{}) {
+	r := h.redactRules()
+	if len(r.rules) == 0 {
+		return
+	}
+	prefix := rowData["database"].(string) + "." + rowData["table"].(string) + "."
+	ed := rowData["event"].(map[string]interface{})
+	data, _ := ed["data"].(map[string]interface{})
+	if rowData["event_type"] == "update" {
+		// update事件的data中为old_data和new_data
+		for _, key := range []string{"old_data", "new_data"} {
+			if sub, ok := data[key].(map[string]interface{}); ok {
+				r.row(prefix, sub)
+			}
+		}
+	} else if data != nil {
+		r.row(prefix, data)
+	}
+	for _, key := range []string{"pk", "old_pk"} {
+		if data, ok := rowData[key].(map[string]interface{}); ok {
+			r.row(prefix, data)
+		}
+	}
+}
+
+// 脱敏规则状态，不包含salt
+func (h *Binlog) redactStatus() []map[string]interface{} {
+	r := h.redactRules()
+	res := make([]map[string]interface{}, 0)
+	for _, rule := range r.rules {
+		item := map[string]interface{}{
+			"column": rule.cfg.Column,
+			"action": rule.cfg.Action,
+		}
+		if rule.cfg.Action == redactLast {
+			item["keep"] = rule.cfg.Keep
+		}
+		res = append(res, item)
+	}
+	return res
+}
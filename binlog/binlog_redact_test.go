@@ -0,0 +1,73 @@
+package binlog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// test redact rules
+func TestBinlog_Redact(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{
+		Database: &g.DatabaseConfig{},
+		Redact: &g.RedactConfig{
+			Salt: "salt",
+			Rules: []*g.RedactRuleConfig{
+				{Column: `^test\.user\.password$`, Action: redactDrop},
+				{Column: `^test\.user\.email$`, Action: redactHash},
+				{Column: `^test\.user\.phone$`, Action: redactLast, Keep: 4},
+				{Column: `^test\.user\.card$`, Action: redactMask},
+				{Column: `^test\.user\.id$`, Action: redactNull},
+			},
+		},
+	}, &events)
+	e := newTestRowsEvent("user", 0)
+	e.Action = canal.UpdateAction
+	e.Table.Columns = []schema.TableColumn{
+		{Name: "id", Type: schema.TYPE_STRING},
+		{Name: "password", Type: schema.TYPE_STRING},
+		{Name: "email", Type: schema.TYPE_STRING},
+		{Name: "phone", Type: schema.TYPE_STRING},
+		{Name: "card", Type: schema.TYPE_STRING},
+	}
+	e.Table.PKColumns = []int{0}
+	e.Rows = [][]interface{}{
+		{"1", "p1", "a@b.c", "13800001234", "110101"},
+		{"2", "p2", "a@b.c", "13800005678", nil},
+	}
+	testOnRow(h, e)
+	if len(events) != 1 {
+		t.Fatalf("expect 1 event, got %d", len(events))
+	}
+	data := events[0]["event"].(map[string]interface{})["data"].(map[string]interface{})
+	oldData := data["old_data"].(map[string]interface{})
+	newData := data["new_data"].(map[string]interface{})
+	if _, ok := newData["password"]; ok {
+		t.Errorf("password should be dropped: %+v", newData)
+	}
+	if newData["id"] != nil || oldData["id"] != nil {
+		t.Errorf("id should be null: %+v", newData)
+	}
+	sum := sha256.Sum256([]byte("salta@b.c"))
+	if newData["email"] != hex.EncodeToString(sum[:]) || oldData["email"] != newData["email"] {
+		t.Errorf("email should be hashed: %+v", newData["email"])
+	}
+	if newData["phone"] != "*******5678" || oldData["phone"] != "*******1234" {
+		t.Errorf("phone should keep last 4: %+v, %+v", oldData["phone"], newData["phone"])
+	}
+	if oldData["card"] != redactDefaultMask || newData["card"] != nil {
+		t.Errorf("card mask error: %+v, %+v", oldData["card"], newData["card"])
+	}
+	if pk := events[0]["pk"].(map[string]interface{}); pk["id"] != nil {
+		t.Errorf("pk should be redacted: %+v", pk)
+	}
+	if len(h.redactStatus()) != 5 {
+		t.Errorf("redact status error: %+v", h.redactStatus())
+	}
+}
@@ -0,0 +1,253 @@
+package binlog
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// 离线回放
+// 不连接数据库，直接读取本地归档的binlog文件，使用表结构快照解析行事件，
+// 和实时同步一样经过过滤、脱敏、转换后推送给所有的服务
+// 表结构快照的格式与表结构历史文件相同，回放过程中经过的ddl在内存中推导新的表结构，不修改快照文件
+// 回放不会保存检查点，也不影响实时同步的检查点
+
+// binlog文件头
+var binlogFileHeader = []byte{0xfe, 'b', 'i', 'n'}
+
+// 等待服务确认交付的超时时间
+const replayAckTimeout = time.Minute
+
+// NewReplay 创建一个离线回放binlog文件的服务对象
+func NewReplay(ctx *g.Context, opts ...Option) (*Binlog, error) {
+	binlog := newBinlog(ctx, opts...)
+	if err := binlog.replayInit(); err != nil {
+		return nil, err
+	}
+	return binlog, nil
+}
+
+// 加载表过滤规则和表结构快照
+func (h *Binlog) replayInit() error {
+	filter, err := newTableFilter(h.filterConfig())
+	if err != nil {
+		return err
+	}
+	if _, err = newUpdateFormats(h.ctx.Config().UpdateFormat); err != nil {
+		return err
+	}
+	h.filter = filter
+	h.cleanSpill()
+	file := h.replayConfig().SchemaFile
+	if file == "" && h.database() != nil {
+		file = h.database().SchemaFile
+	}
+	if file == "" {
+		file = h.sourceFile(g.SCHEMA_FILE)
+	}
+	h.schemas = newSchemaHistory(file)
+	if h.schemas.empty() {
+		return fmt.Errorf("schema snapshot %s is empty", file)
+	}
+	return nil
+}
+
+// 回放配置
+func (h *Binlog) replayConfig() *g.ReplayConfig {
+	if cfg := h.ctx.Config().Replay; cfg != nil {
+		return cfg
+	}
+	return &g.ReplayConfig{}
+}
+
+// Replay 回放本地binlog文件，files可以是单个文件、目录或者通配符，为空时使用配置的文件
+// 回放结束后等待服务确认交付所有的事件
+func (h *Binlog) Replay(files string) error {
+	cfg := h.replayConfig()
+	if files == "" {
+		files = cfg.Files
+	}
+	names, err := replayFiles(files)
+	if err != nil {
+		return err
+	}
+	start := mysql.Position{Name: cfg.StartFile, Pos: cfg.StartPos}
+	stop := mysql.Position{Name: cfg.StopFile, Pos: cfg.StopPos}
+	if cfg.Delay > 0 {
+		log.Infof("[I] replay wait %d seconds for clients", cfg.Delay)
+		select {
+		case <-time.After(time.Second * time.Duration(cfg.Delay)):
+		case <-h.ctx.Ctx.Done():
+			return h.ctx.Ctx.Err()
+		}
+	}
+	p := replication.NewBinlogParser()
+	// 与canal的解析配置保持一致
+	p.SetUseDecimal(true)
+	p.SetParseTime(true)
+	p.SetVerifyChecksum(true)
+	for _, name := range names {
+		base := filepath.Base(name)
+		if start.Name != "" && base < start.Name {
+			continue
+		}
+		if stop.Name != "" && base > stop.Name {
+			break
+		}
+		offset := int64(4)
+		if base == start.Name && start.Pos > 4 {
+			offset = int64(start.Pos)
+		}
+		log.Infof("[I] replay binlog %s from %d", name, offset)
+		h.lock.Lock()
+		h.lastBinFile = base
+		h.lastPos = uint32(offset)
+		h.lock.Unlock()
+		p.Reset()
+		err = p.ParseFile(name, offset, func(e *replication.BinlogEvent) error {
+			select {
+			case <-h.ctx.Ctx.Done():
+				return h.ctx.Ctx.Err()
+			default:
+			}
+			if base == stop.Name && stop.Pos > 0 && e.Header.LogPos > stop.Pos {
+				return errReplayStopped
+			}
+			return h.replayEvent(base, e)
+		})
+		if err == errReplayStopped {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("replay %s with error: %v", name, err)
+		}
+	}
+	// 最后一个事务没有结束时，推送缓存的行事件
+	h.commitTransaction(txCommit{})
+	h.lock.Lock()
+	log.Infof("[I] replay done at %s:%d", h.lastBinFile, h.lastPos)
+	h.lock.Unlock()
+	return h.waitAcked(replayAckTimeout)
+}
+
+var errReplayStopped = fmt.Errorf("replay reach the stop position")
+
+// 处理一个binlog事件，与实时同步的处理方式一致
+func (h *Binlog) replayEvent(file string, e *replication.BinlogEvent) error {
+	save, err := h.handleEvent(file, e)
+	if err != nil || !save {
+		return err
+	}
+	h.lock.Lock()
+	h.lastPos = e.Header.LogPos
+	h.lock.Unlock()
+	return nil
+}
+
+// binlog中不区分有无符号，按表结构转换为无符号整数
+func unsignedRows(table *schema.Table, rows [][]interface{}) {
+	for _, row := range rows {
+		for _, index := range table.UnsignedColumns {
+			if index >= len(row) {
+				continue
+			}
+			switch v := row[index].(type) {
+			case int8:
+				row[index] = uint8(v)
+			case int16:
+				row[index] = uint16(v)
+			case int32:
+				row[index] = uint32(v)
+			case int64:
+				row[index] = uint64(v)
+			case int:
+				row[index] = uint(v)
+			}
+		}
+	}
+}
+
+// 解析需要回放的文件，按文件名排序
+// 目录中只包含binlog文件，跳过索引等其他文件
+func replayFiles(files string) ([]string, error) {
+	if files == "" {
+		return nil, fmt.Errorf("no binlog files to replay")
+	}
+	names := make([]string, 0)
+	if info, err := os.Stat(files); err == nil && info.IsDir() {
+		infos, err := ioutil.ReadDir(files)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if !info.IsDir() {
+				names = append(names, filepath.Join(files, info.Name()))
+			}
+		}
+	} else if err == nil {
+		names = append(names, files)
+	} else if names, err = filepath.Glob(files); err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(names))
+	for _, name := range names {
+		if isBinlogFile(name) {
+			res = append(res, name)
+		} else {
+			log.Debugf("[D] replay skip %s, not a binlog file", name)
+		}
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no binlog files found in %s", files)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return filepath.Base(res[i]) < filepath.Base(res[j])
+	})
+	return res, nil
+}
+
+// 是否为binlog文件
+func isBinlogFile(name string) bool {
+	if strings.HasSuffix(name, ".index") {
+		return false
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	b := make([]byte, len(binlogFileHeader))
+	if _, err = f.Read(b); err != nil {
+		return false
+	}
+	return bytes.Equal(b, binlogFileHeader)
+}
+
+// 等待所有服务确认交付已经推送的事件
+func (h *Binlog) waitAcked(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(h.ctx.Ctx, timeout)
+	defer cancel()
+	for {
+		if h.allAcked() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("wait services ack timeout")
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+}
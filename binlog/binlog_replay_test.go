@@ -0,0 +1,109 @@
+package binlog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// test replay file resolving
+// 目录和通配符都只包含binlog文件，按文件名排序
+func TestBinlog_ReplayFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copycat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"mysql-bin.000002", "mysql-bin.000001", "mysql-bin.index", "readme.txt"} {
+		data := append([]byte{}, binlogFileHeader...)
+		if name == "readme.txt" {
+			data = []byte("hello")
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := []string{filepath.Join(dir, "mysql-bin.000001"), filepath.Join(dir, "mysql-bin.000002")}
+	for _, files := range []string{dir, filepath.Join(dir, "mysql-bin.*")} {
+		names, err := replayFiles(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != 2 || names[0] != expect[0] || names[1] != expect[1] {
+			t.Errorf("replay %s expect %v, got %v", files, expect, names)
+		}
+	}
+	if names, err := replayFiles(expect[1]); err != nil || len(names) != 1 {
+		t.Errorf("replay single file got %v, %+v", names, err)
+	}
+	if _, err = replayFiles(filepath.Join(dir, "readme.txt")); err == nil {
+		t.Errorf("replay non binlog file should fail")
+	}
+}
+
+// test replay rows event
+// 使用表结构快照解析，快照中没有的表跳过
+func TestBinlog_ReplayRows(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{}, &events)
+	h.schemas = newSchemaHistory(filepath.Join(os.TempDir(), "copycat-replay-schema-not-exist.json"))
+	h.schemas.add("test.a", &schemaVersion{File: "mysql-bin.000001", Pos: 4, Table: &schema.Table{
+		Schema:          "test",
+		Name:            "a",
+		Columns:         []schema.TableColumn{{Name: "id", Type: schema.TYPE_NUMBER, IsUnsigned: true}},
+		PKColumns:       []int{0},
+		UnsignedColumns: []int{0},
+	}})
+	header := &replication.EventHeader{Timestamp: 1555555555, LogPos: 300, EventSize: 50, EventType: replication.WRITE_ROWS_EVENTv2}
+	rows := &replication.RowsEvent{
+		Table: &replication.TableMapEvent{Schema: []byte("test"), Table: []byte("a")},
+		Rows:  [][]interface{}{{int32(-1)}},
+	}
+	if err := h.replayEvent("mysql-bin.000001", &replication.BinlogEvent{Header: header, Event: rows}); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expect 1 event, got %d", len(events))
+	}
+	data := events[0]["event"].(map[string]interface{})["data"].(map[string]interface{})
+	if data["id"] != float64(4294967295) {
+		t.Errorf("expect unsigned id 4294967295, got %v", data["id"])
+	}
+	if events[0]["event_type"] != "insert" || events[0]["binlog_pos"] != float64(300) {
+		t.Errorf("unexpected event: %+v", events[0])
+	}
+	// 快照中没有的表
+	rows.Table.Table = []byte("b")
+	if err := h.replayEvent("mysql-bin.000001", &replication.BinlogEvent{Header: header, Event: rows}); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Errorf("table not in snapshot should be skipped")
+	}
+	// ddl推送事件，并在内存中推导新的表结构
+	query := &replication.QueryEvent{Schema: []byte("test"), Query: []byte("ALTER TABLE a ADD COLUMN name VARCHAR(10)")}
+	if err := h.replayEvent("mysql-bin.000001", &replication.BinlogEvent{Header: header, Event: query}); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[1]["event_type"] != eventTypeDDL || events[1]["time"] != float64(1555555555) {
+		t.Errorf("expect ddl event at the query event time, got %+v", events)
+	}
+	versions := h.schemas.Tables["test.a"]
+	if len(versions) != 2 || len(versions[1].Table.Columns) != 2 || versions[1].Table.Columns[1].Name != "name" {
+		t.Errorf("expect the new version after ddl, got %+v", versions)
+	}
+	// 无法推导的ddl，离线回放时没有数据库连接，保留上一个版本继续回放
+	header.LogPos = 400
+	if err := h.replayEvent("mysql-bin.000001", &replication.BinlogEvent{Header: header, Event: query}); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || len(h.schemas.Tables["test.a"]) != 2 {
+		t.Errorf("expect the previous version kept after the ddl, got %+v", h.schemas.Tables["test.a"])
+	}
+}
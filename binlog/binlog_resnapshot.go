@@ -0,0 +1,360 @@
+package binlog
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/client"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+// 增量快照
+// 同步过程中通过管理接口对单个表重新快照，不需要停止同步
+// 每个分块先写入低水位，然后读取分块，最后写入高水位，水位写入水位表，会和数据修改一样出现在binlog中
+// 增量同步收到低水位之后记录修改过的行，收到高水位时推送分块中没有被修改过的行，
+// 被修改过的行在binlog中已经有更新的事件，推送旧的快照数据会覆盖更新的修改
+// 水位表需要提前创建，并且同步账号需要有写权限：
+// CREATE TABLE copycat.watermark (id VARCHAR(64) PRIMARY KEY, value VARCHAR(64))
+const (
+	watermarkLow            = "low"
+	watermarkHigh           = "high"
+	watermarkDefaultTable   = "copycat.watermark"
+	watermarkDefaultTimeout = 60 // 等待高水位时binlog没有进展的默认超时时间，单位秒
+)
+
+// 单个表的增量快照
+type tableSnapshot struct {
+	id      string          // 快照id，写入水位表的id
+	table   *schema.Table   //
+	keys    []string        // 主键或者唯一索引，水位需要按主键判断行是否被修改
+	targets []string        // 接收快照数据的客户端地址，为空时推送给所有的客户端
+	state   *snapshotState  // 进度，只保存在内存中
+	err     error           // 快照失败的原因
+	window  *snapshotWindow // 当前分块的水位窗口，调用方需持有h.lock
+}
+
+// 一个分块的水位窗口
+type snapshotWindow struct {
+	chunk   int                      // 分块序号
+	low     bool                     // 已经收到低水位
+	high    bool                     // 已经收到高水位
+	changed map[string]bool          // 低水位之后被修改过的行的主键
+	rows    []map[string]interface{} // 分块读取的快照事件
+	done    chan struct{}            // 收到高水位并且推送完成后关闭
+}
+
+// 水位表，格式为db.table
+func (h *Binlog) watermarkTable() string {
+	if cfg := h.ctx.Config().Snapshot; cfg != nil && cfg.WatermarkTable != "" {
+		return cfg.WatermarkTable
+	}
+	return watermarkDefaultTable
+}
+
+// canal需要包含水位表，否则收不到水位事件
+func (h *Binlog) watermarkRegex(include []string) []string {
+	if len(include) == 0 {
+		return include
+	}
+	res := append([]string{}, include...)
+	return append(res, "^"+regexp.QuoteMeta(h.watermarkTable())+"$")
+}
+
+// SnapshotTable 对单个表重新快照，table格式为db.table
+// targets为接收快照数据的客户端地址，为空时推送给所有的客户端
+// 快照在后台执行，进度在管理接口的状态中查看
+func (h *Binlog) SnapshotTable(table string, targets []string) error {
+	parts := strings.SplitN(table, ".", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("table %s should be db.table", table)
+	}
+	if !h.tableMatch(table) {
+		return fmt.Errorf("table %s is excluded", table)
+	}
+	if h.stopped() {
+		return fmt.Errorf("binlog service is not running")
+	}
+	t, err := h.currentHandler().GetTable(parts[0], parts[1])
+	if err != nil {
+		return err
+	}
+	keys := h.keyColumns(t)
+	if len(keys) == 0 {
+		return fmt.Errorf("table %s has no primary key or non-null unique key", table)
+	}
+	s := &tableSnapshot{
+		id:      fmt.Sprintf("%s-%d", table, time.Now().UnixNano()),
+		table:   t,
+		keys:    keys,
+		targets: targets,
+		state:   newTableSnapshotState(table),
+	}
+	if len(s.id) > 64 {
+		s.id = s.id[len(s.id)-64:]
+	}
+	h.lock.Lock()
+	if r := h.resnapshot; r != nil && r.running() {
+		h.lock.Unlock()
+		return fmt.Errorf("snapshot of %s is running", r.table)
+	}
+	h.resnapshot = s
+	h.lock.Unlock()
+	log.Infof("[I] table snapshot %s start, targets: %v", table, targets)
+	go h.runTableSnapshot(s)
+	return nil
+}
+
+func newTableSnapshotState(table string) *snapshotState {
+	s, _ := loadSnapshotState("")
+	s.Tables = []string{table}
+	return s
+}
+
+// 是否正在执行
+func (s *tableSnapshot) running() bool {
+	s.state.lock.Lock()
+	defer s.state.lock.Unlock()
+	return !s.state.Done && s.err == nil
+}
+
+// 增量快照进度，用于管理接口
+func (s *tableSnapshot) status() map[string]interface{} {
+	status := s.state.status()
+	s.state.lock.Lock()
+	defer s.state.lock.Unlock()
+	delete(status, "binlog_file")
+	delete(status, "binlog_pos")
+	status["table"] = s.table.String()
+	status["targets"] = s.targets
+	status["chunks"] = s.state.Index
+	if s.err != nil {
+		status["error"] = s.err.Error()
+	}
+	return status
+}
+
+// 分块执行增量快照
+func (h *Binlog) runTableSnapshot(s *tableSnapshot) {
+	if err := h.tableSnapshotChunks(s); err != nil {
+		log.Errorf("[E] table snapshot %s with error: %+v", s.table, err)
+		s.state.lock.Lock()
+		s.err = err
+		s.state.lock.Unlock()
+		return
+	}
+	s.state.lock.Lock()
+	s.state.Done = true
+	s.state.lock.Unlock()
+	log.Infof("[I] table snapshot %s done, rows: %d", s.table, s.state.Rows)
+}
+
+// 使用独立连接依次读取所有的分块
+func (h *Binlog) tableSnapshotChunks(s *tableSnapshot) error {
+	chunkSize := snapshotDefaultChunkSize
+	if cfg := h.ctx.Config().Snapshot; cfg != nil && cfg.ChunkSize > 0 {
+		chunkSize = cfg.ChunkSize
+	}
+	conn, err := h.snapshotConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for {
+		n, err := h.snapshotChunk(conn, s, chunkSize)
+		if err != nil {
+			return err
+		}
+		if n < chunkSize {
+			return nil
+		}
+	}
+}
+
+// 读取一个分块，在收到高水位时推送，返回分块的行数
+func (h *Binlog) snapshotChunk(conn *client.Conn, s *tableSnapshot, chunkSize int) (int, error) {
+	if h.stopped() {
+		return 0, fmt.Errorf("binlog service is not running")
+	}
+	s.state.lock.Lock()
+	w := &snapshotWindow{
+		chunk:   s.state.Index,
+		changed: make(map[string]bool),
+		done:    make(chan struct{}),
+	}
+	s.state.lock.Unlock()
+	h.lock.Lock()
+	s.window = w
+	h.lock.Unlock()
+	defer func() {
+		h.lock.Lock()
+		s.window = nil
+		h.lock.Unlock()
+	}()
+	if err := h.writeWatermark(s, watermarkLow, w.chunk); err != nil {
+		return 0, err
+	}
+	query, args := snapshotQuery(s.table, s.keys, s.state, chunkSize)
+	rr, err := conn.Execute(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	rows := make([]map[string]interface{}, 0)
+	for i, row := range rr.Values {
+		rowData := h.snapshotEvent(s.table, s.keys, mysql.Position{}, i, row)
+		rowData["event_id"] = h.snapshotEventID(s.id, s.table, s.keys, 0, row)
+		rows = append(rows, rowData)
+	}
+	h.lock.Lock()
+	w.rows = rows
+	h.lock.Unlock()
+	if err = h.writeWatermark(s, watermarkHigh, w.chunk); err != nil {
+		return 0, err
+	}
+	if err = h.waitWatermark(w); err != nil {
+		return 0, err
+	}
+	n := len(rr.Values)
+	s.state.lock.Lock()
+	if n > 0 {
+		s.state.LastKey = snapshotKey(s.table, s.keys, rr.Values[n-1])
+	}
+	s.state.Index++
+	s.state.Offset += int64(n)
+	s.state.Rows += int64(n)
+	s.state.lock.Unlock()
+	return n, nil
+}
+
+// 等待高水位
+// 同步落后较多时高水位要等很久才能读到，binlog还在前进就一直等待，超时时间内没有读到任何事件才失败
+func (h *Binlog) waitWatermark(w *snapshotWindow) error {
+	timeout := h.watermarkTimeout()
+	ticker := time.NewTicker(timeout)
+	defer ticker.Stop()
+	progress := atomic.LoadInt64(&h.streamEvents)
+	for {
+		select {
+		case <-w.done:
+			return nil
+		case <-ticker.C:
+			current := atomic.LoadInt64(&h.streamEvents)
+			if current == progress {
+				return fmt.Errorf("wait high watermark of chunk %d timeout, no binlog progress in %v", w.chunk, timeout)
+			}
+			progress = current
+		}
+	}
+}
+
+// 等待高水位的超时时间
+func (h *Binlog) watermarkTimeout() time.Duration {
+	if cfg := h.ctx.Config().Snapshot; cfg != nil && cfg.WatermarkTimeout > 0 {
+		return time.Second * time.Duration(cfg.WatermarkTimeout)
+	}
+	return time.Second * watermarkDefaultTimeout
+}
+
+// 写入水位
+func (h *Binlog) writeWatermark(s *tableSnapshot, kind string, chunk int) error {
+	parts := strings.SplitN(h.watermarkTable(), ".", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("watermark table %s should be db.table", h.watermarkTable())
+	}
+	_, err := h.currentHandler().Execute(fmt.Sprintf("REPLACE INTO %s.%s (id, value) VALUES (?, ?)",
+		quoteName(parts[0]), quoteName(parts[1])), s.id, fmt.Sprintf("%s:%d", kind, chunk))
+	return err
+}
+
+// 处理水位表的行事件，水位事件不推送
+func (h *Binlog) onWatermark(e *canal.RowsEvent) bool {
+	if e.Table.String() != h.watermarkTable() {
+		return false
+	}
+	idIndex := e.Table.FindColumn("id")
+	valueIndex := e.Table.FindColumn("value")
+	if e.Action == canal.DeleteAction || idIndex < 0 || valueIndex < 0 {
+		return true
+	}
+	for i, row := range e.Rows {
+		if e.Action == canal.UpdateAction && i%2 == 0 {
+			// 只需要修改后的值
+			continue
+		}
+		if idIndex >= len(row) || valueIndex >= len(row) {
+			continue
+		}
+		id, value := watermarkString(row[idIndex]), watermarkString(row[valueIndex])
+		h.lock.Lock()
+		s := h.resnapshot
+		if s == nil || s.id != id || s.window == nil {
+			h.lock.Unlock()
+			continue
+		}
+		w := s.window
+		var rows []map[string]interface{}
+		switch value {
+		case fmt.Sprintf("%s:%d", watermarkLow, w.chunk):
+			w.low = true
+		case fmt.Sprintf("%s:%d", watermarkHigh, w.chunk):
+			if w.low && !w.high {
+				w.high = true
+				rows = w.rows
+			}
+		}
+		file := h.lastBinFile
+		h.lock.Unlock()
+		if rows == nil {
+			continue
+		}
+		for _, rowData := range rows {
+			if w.changed[windowKey(s.keys, rowData["pk"])] {
+				continue
+			}
+			rowData["binlog_file"] = file
+			rowData["binlog_pos"] = e.Header.LogPos
+			if err := h.pushSnapshot(rowData, s.targets); err != nil {
+				log.Errorf("[E] table snapshot %s push with error: %+v", s.table, err)
+			}
+		}
+		close(w.done)
+	}
+	return true
+}
+
+func watermarkString(v interface{}) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
+
+// 行的主键值，用于判断快照的行是否被修改过
+func windowKey(keys []string, pk interface{}) string {
+	data, _ := pk.(map[string]interface{})
+	values := make([]string, 0)
+	for _, k := range keys {
+		values = append(values, fmt.Sprint(data[k]))
+	}
+	return strings.Join(values, "\x00")
+}
+
+// 记录低水位之后被修改的行，pk为setRowKey生成的主键值
+func (h *Binlog) snapshotChanged(table string, pk ...interface{}) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s := h.resnapshot
+	if s == nil || s.window == nil || !s.window.low || s.window.high || s.table.String() != table {
+		return
+	}
+	for _, v := range pk {
+		if v != nil {
+			s.window.changed[windowKey(s.keys, v)] = true
+		}
+	}
+}
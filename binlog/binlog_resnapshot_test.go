@@ -0,0 +1,119 @@
+package binlog
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+func newTestWatermarkEvent(id, value string) *canal.RowsEvent {
+	return &canal.RowsEvent{
+		Table: &schema.Table{
+			Schema: "copycat",
+			Name:   "watermark",
+			Columns: []schema.TableColumn{
+				{Name: "id", Type: schema.TYPE_STRING},
+				{Name: "value", Type: schema.TYPE_STRING},
+			},
+		},
+		Action: canal.InsertAction,
+		Rows:   [][]interface{}{{id, value}},
+		Header: &replication.EventHeader{Timestamp: 1555555555, LogPos: 500, EventSize: 50},
+	}
+}
+
+// test table snapshot watermark
+// 低水位和高水位之间被修改的行不推送快照数据
+func TestBinlog_SnapshotWatermark(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{Database: &g.DatabaseConfig{}}, &events)
+	table := newTestSnapshotTable()
+	s := &tableSnapshot{
+		id:    "test.user-1",
+		table: table,
+		keys:  []string{"id"},
+		state: newTableSnapshotState("test.user"),
+	}
+	w := &snapshotWindow{changed: make(map[string]bool), done: make(chan struct{})}
+	s.window = w
+	h.resnapshot = s
+
+	testOnRow(h, newTestWatermarkEvent(s.id, "low:0"))
+	w.rows = []map[string]interface{}{
+		h.snapshotEvent(table, s.keys, mysql.Position{}, 0, []interface{}{int64(1), []byte("a"), nil}),
+		h.snapshotEvent(table, s.keys, mysql.Position{}, 1, []interface{}{int64(2), []byte("b"), nil}),
+	}
+	// 低水位之后id为2的行被修改
+	e := newTestRowsEvent("user", 0)
+	e.Table = table
+	e.Rows = [][]interface{}{{int32(2), "c", nil}}
+	testOnRow(h, e)
+	// 其他分块的水位被忽略
+	testOnRow(h, newTestWatermarkEvent(s.id, "high:1"))
+	if len(events) != 1 {
+		t.Fatalf("expect 1 row event before high watermark, got %d", len(events))
+	}
+	testOnRow(h, newTestWatermarkEvent(s.id, "high:0"))
+	select {
+	case <-w.done:
+	default:
+		t.Fatalf("window should be done after high watermark")
+	}
+	if len(events) != 2 {
+		t.Fatalf("expect 2 events, got %d", len(events))
+	}
+	ev := events[1]
+	data := ev["event"].(map[string]interface{})["data"].(map[string]interface{})
+	if ev["event_type"] != eventTypeSnapshot || data["name"] != "a" || ev["binlog_pos"] != float64(500) {
+		t.Errorf("snapshot event error: %+v", ev)
+	}
+	// 重复的高水位不会再次推送
+	testOnRow(h, newTestWatermarkEvent(s.id, "high:0"))
+	if len(events) != 2 {
+		t.Errorf("duplicate high watermark should be ignored, got %d events", len(events))
+	}
+}
+
+// test wait watermark
+// binlog还在前进时一直等待高水位，超时时间内没有进展才失败
+func TestBinlog_WaitWatermark(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{
+		Database: &g.DatabaseConfig{},
+		Snapshot: &g.SnapshotConfig{WatermarkTimeout: 1},
+	}, &events)
+	w := &snapshotWindow{done: make(chan struct{})}
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Millisecond * 100)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				atomic.AddInt64(&h.streamEvents, 1)
+				if i == 25 {
+					close(w.done)
+				}
+			}
+		}
+	}()
+	start := time.Now()
+	err := h.waitWatermark(w)
+	close(stop)
+	if err != nil || time.Since(start) < time.Second*2 {
+		t.Errorf("should wait while the binlog is in progress, err: %v, waited %v", err, time.Since(start))
+	}
+	w = &snapshotWindow{done: make(chan struct{})}
+	if err = h.waitWatermark(w); err == nil {
+		t.Errorf("should timeout without binlog progress")
+	}
+}
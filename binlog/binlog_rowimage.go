@@ -0,0 +1,72 @@
+package binlog
+
+import (
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// binlog_row_image的取值
+const (
+	rowImageFull    = "full"    // 记录所有列
+	rowImageMinimal = "minimal" // 修改前只记录主键，修改后只记录修改的列
+	rowImageNoblob  = "noblob"  // 记录所有列，没有修改的blob、text列除外
+)
+
+// 列在行镜像中的状态
+const (
+	columnPresent = iota // 记录在binlog中
+	columnMissing        // 没有记录在binlog中，解析时忽略
+)
+
+// 一行数据中各列的状态，按表结构中列的顺序
+// 为nil时所有列都已记录
+type rowImage []int
+
+// 列的状态
+func (r rowImage) state(i int) int {
+	if i >= len(r) {
+		return columnPresent
+	}
+	return r[i]
+}
+
+// 指定状态的列名
+func (r rowImage) columns(table *schema.Table, state int) []string {
+	names := make([]string, 0)
+	for i, col := range table.Columns {
+		if r.state(i) == state {
+			names = append(names, col.Name)
+		}
+	}
+	return names
+}
+
+// 按行事件中的列位图得到各列的状态
+// bitmap中第i位为1表示第i列记录在binlog中，为nil时所有列都已记录
+func bitmapImage(bitmap []byte, n int) rowImage {
+	if bitmap == nil {
+		return nil
+	}
+	var r rowImage
+	for i := 0; i < n; i++ {
+		if i/8 < len(bitmap) && bitmap[i/8]&(1<<uint(i%8)) != 0 {
+			continue
+		}
+		if r == nil {
+			r = make(rowImage, n)
+		}
+		r[i] = columnMissing
+	}
+	return r
+}
+
+// 在事件中标记没有记录的列
+// insert和delete只有一个镜像，使用missing_columns，update修改前的数据使用old_missing_columns
+func setImageColumns(rowData map[string]interface{}, table *schema.Table, prefix string, r rowImage) {
+	if r == nil {
+		return
+	}
+	ed := rowData["event"].(map[string]interface{})
+	if cols := r.columns(table, columnMissing); len(cols) > 0 {
+		ed[prefix+"missing_columns"] = cols
+	}
+}
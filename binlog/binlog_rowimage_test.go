@@ -0,0 +1,106 @@
+package binlog
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+func newTestImageTable() *schema.Table {
+	return &schema.Table{
+		Schema: "test",
+		Name:   "a",
+		Columns: []schema.TableColumn{
+			{Name: "id", Type: schema.TYPE_NUMBER, RawType: "int(11)"},
+			{Name: "name", Type: schema.TYPE_STRING, RawType: "varchar(10)"},
+			{Name: "body", Type: schema.TYPE_STRING, RawType: "text"},
+		},
+		PKColumns: []int{0},
+	}
+}
+
+// test column states from the rows event bitmap
+func TestBinlog_BitmapImage(t *testing.T) {
+	if r := bitmapImage(nil, 3); r != nil {
+		t.Errorf("no bitmap expect nil, got %v", r)
+	}
+	if r := bitmapImage([]byte{0x07}, 3); r != nil {
+		t.Errorf("all columns logged expect nil, got %v", r)
+	}
+	r := bitmapImage([]byte{0x05}, 3)
+	expect := rowImage{columnPresent, columnMissing, columnPresent}
+	if !reflect.DeepEqual(r, expect) {
+		t.Errorf("expect %v, got %v", expect, r)
+	}
+}
+
+// test update event with minimal row image
+// 没有记录的列不包含在数据中，并在missing_columns中列出
+func TestBinlog_MinimalUpdate(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{}, &events)
+	e := newTestRowsEvent("a", 0)
+	e.Action = canal.UpdateAction
+	e.Table = newTestImageTable()
+	e.Rows = [][]interface{}{
+		{int32(1), nil, nil},
+		{nil, "b", nil},
+	}
+	if err := h.onRows(e, []byte{0x01}, []byte{0x02}); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expect 1 event, got %d", len(events))
+	}
+	ed := events[0]["event"].(map[string]interface{})
+	data := ed["data"].(map[string]interface{})
+	oldData := data["old_data"].(map[string]interface{})
+	newData := data["new_data"].(map[string]interface{})
+	if len(oldData) != 1 || oldData["id"] != float64(1) {
+		t.Errorf("unexpected old data: %+v", oldData)
+	}
+	if len(newData) != 1 || newData["name"] != "b" {
+		t.Errorf("unexpected new data: %+v", newData)
+	}
+	if !reflect.DeepEqual(ed["old_missing_columns"], []interface{}{"name", "body"}) ||
+		!reflect.DeepEqual(ed["missing_columns"], []interface{}{"id", "body"}) {
+		t.Errorf("unexpected missing columns: %+v", ed)
+	}
+	// 没有修改的主键使用修改前的值
+	pk := events[0]["pk"].(map[string]interface{})
+	if pk["id"] != float64(1) || events[0]["old_pk"] != nil {
+		t.Errorf("unexpected pk: %+v, old pk: %+v", pk, events[0]["old_pk"])
+	}
+
+	// 只记录在修改后数据中的列作为修改的列
+	h.ctx.Config().UpdateFormat = &g.UpdateFormatConfig{Default: updateFormatAfter}
+	if err := h.onRows(e, []byte{0x01}, []byte{0x02}); err != nil {
+		t.Fatal(err)
+	}
+	data = events[1]["event"].(map[string]interface{})["data"].(map[string]interface{})
+	if !reflect.DeepEqual(data["changed_columns"], []interface{}{"name"}) {
+		t.Errorf("expect changed columns [name], got %+v", data["changed_columns"])
+	}
+}
+
+// test full row image
+// 所有列都已记录时事件格式不变
+func TestBinlog_FullImage(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{}, &events)
+	e := newTestRowsEvent("a", 0)
+	e.Table = newTestImageTable()
+	e.Rows = [][]interface{}{{int32(1), nil, nil}}
+	if err := testOnRow(h, e); err != nil {
+		t.Fatal(err)
+	}
+	ed := events[0]["event"].(map[string]interface{})
+	data := ed["data"].(map[string]interface{})
+	if len(data) != 3 || ed["missing_columns"] != nil {
+		t.Errorf("unexpected event: %+v", ed)
+	}
+}
@@ -0,0 +1,95 @@
+package binlog
+
+import (
+	"regexp"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// 带上原始sql的表规则，编译后缓存，配置重新加载后重新编译
+type rowsQueryRules struct {
+	cfg    *g.RowsQueryConfig // 生成规则的配置
+	tables []*regexp.Regexp   //
+}
+
+// 编译rows_query配置中的表规则
+func newRowsQueryRules(cfg *g.RowsQueryConfig) (*rowsQueryRules, error) {
+	r := &rowsQueryRules{cfg: cfg}
+	if cfg == nil {
+		return r, nil
+	}
+	for _, t := range cfg.Tables {
+		re, err := regexp.Compile(t)
+		if err != nil {
+			return nil, err
+		}
+		r.tables = append(r.tables, re)
+	}
+	return r, nil
+}
+
+// 记录之后的行事件对应的原始sql
+// 来自mysql的rows_query事件或者mariadb的annotate_rows事件，下一个语句或者事务结束时失效
+func (h *Binlog) onRowsQuery(query string) {
+	h.lock.Lock()
+	h.rowsQuery = query
+	h.lock.Unlock()
+}
+
+// 当前生效的表规则
+func (h *Binlog) rowsQueryRules() *rowsQueryRules {
+	cfg := h.ctx.Config().RowsQuery
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.rowsQueryRule != nil && h.rowsQueryRule.cfg == cfg {
+		return h.rowsQueryRule
+	}
+	r, err := newRowsQueryRules(cfg)
+	if err != nil {
+		log.Errorf("[E] rows query rules with error: %+v", err)
+		if h.rowsQueryRule != nil {
+			// 保留之前的规则
+			return h.rowsQueryRule
+		}
+		r = &rowsQueryRules{cfg: cfg}
+	}
+	h.rowsQueryRule = r
+	return r
+}
+
+// 表的行事件是否带上原始sql
+func (r *rowsQueryRules) match(table string) bool {
+	for _, re := range r.tables {
+		if re.MatchString(table) {
+			return true
+		}
+	}
+	return false
+}
+
+// 行事件带上原始sql，超过配置的长度时截断
+// sql不经过脱敏规则处理
+func (h *Binlog) setRowsQuery(rowData map[string]interface{}, table, query string) {
+	if query == "" {
+		return
+	}
+	r := h.rowsQueryRules()
+	if !r.match(table) {
+		return
+	}
+	rowData["query"] = truncateQuery(query, r.cfg.MaxLength)
+}
+
+// 按字节数截断sql，不截断多字节字符
+func truncateQuery(query string, max int) string {
+	if max <= 0 || len(query) <= max {
+		return query
+	}
+	for max > 0 && !utf8.RuneStart(query[max]) {
+		max--
+	}
+	return query[:max]
+}
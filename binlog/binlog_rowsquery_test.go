@@ -0,0 +1,77 @@
+package binlog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// test rows query attached to the following rows events
+// 只有配置的表带上sql，事务结束后失效
+func TestBinlog_RowsQuery(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{RowsQuery: &g.RowsQueryConfig{Tables: []string{`^test\.a$`}, MaxLength: 20}}, &events)
+	h.schemas = newSchemaHistory(filepath.Join(os.TempDir(), "copycat-rows-query-schema-not-exist.json"))
+	for _, name := range []string{"a", "b"} {
+		h.schemas.add("test."+name, &schemaVersion{File: "mysql-bin.000001", Pos: 4, Table: &schema.Table{
+			Schema:  "test",
+			Name:    name,
+			Columns: []schema.TableColumn{{Name: "id", Type: schema.TYPE_NUMBER}},
+		}})
+	}
+	header := &replication.EventHeader{Timestamp: 1555555555, LogPos: 300, EventSize: 50, EventType: replication.WRITE_ROWS_EVENTv2}
+	rows := func(table string) *replication.BinlogEvent {
+		return &replication.BinlogEvent{Header: header, Event: &replication.RowsEvent{
+			Table: &replication.TableMapEvent{Schema: []byte("test"), Table: []byte(table)},
+			Rows:  [][]interface{}{{int32(1)}},
+		}}
+	}
+	replay := []*replication.BinlogEvent{
+		{Header: header, Event: &replication.RowsQueryEvent{Query: []byte("INSERT INTO a VALUES (1)")}},
+		rows("a"),
+		rows("b"),
+		{Header: header, Event: &replication.XIDEvent{}},
+		rows("a"),
+		{Header: header, Event: &replication.MariadbAnnotateRowsEvent{Query: []byte("INSERT INTO a SELECT 1")}},
+		rows("a"),
+	}
+	for _, e := range replay {
+		if err := h.replayEvent("mysql-bin.000001", e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := []interface{}{"INSERT INTO a VALUES", nil, nil, "INSERT INTO a SELECT"}
+	if len(events) != len(expect) {
+		t.Fatalf("expect %d events, got %d", len(expect), len(events))
+	}
+	for i, query := range expect {
+		if events[i]["query"] != query {
+			t.Errorf("event %d expect query %v, got %v", i, query, events[i]["query"])
+		}
+	}
+}
+
+// test truncate query on the rune boundary
+func TestBinlog_TruncateQuery(t *testing.T) {
+	cases := []struct {
+		query  string
+		max    int
+		expect string
+	}{
+		{"SELECT 1", 0, "SELECT 1"},
+		{"SELECT 1", 6, "SELECT"},
+		{"SET a='中文'", 9, "SET a='"},
+		{"SET a='中文'", 10, "SET a='中"},
+		{"SET a='中文'", 11, "SET a='中"},
+	}
+	for _, c := range cases {
+		if r := truncateQuery(c.query, c.max); r != c.expect {
+			t.Errorf("truncate %q to %d expect %q, got %q", c.query, c.max, c.expect, r)
+		}
+	}
+}
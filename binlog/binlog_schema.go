@@ -0,0 +1,443 @@
+package binlog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+// 表结构历史
+// canal只缓存了表的当前结构，回放ALTER之前的binlog时列名和类型会对不上
+// 这里保存每个表的结构版本，初始时从information_schema做一次快照，
+// 之后每个ddl事件在上一个版本的基础上推导出新版本，见binlog_ddl.go
+// 版本按记录的顺序编号，解析行事件时从最新的版本开始查找第一个已经生效的版本：
+// gtid模式下按事件之前已执行的gtid集合判断，切换master之后binlog文件名可能变小，不能按位置比较；
+// 非gtid模式下按binlog位置判断
+type schemaHistory struct {
+	file   string                      // 持久化文件
+	lock   *sync.RWMutex               //
+	Seq    uint64                      `json:"seq"`    // 最后一个版本的序号
+	Tables map[string][]*schemaVersion `json:"tables"` // key为db.table，按序号排序
+}
+
+// 表结构版本
+type schemaVersion struct {
+	Seq     uint64        `json:"seq"`      // 版本序号，单调递增
+	File    string        `json:"file"`     // 版本生效的binlog file
+	Pos     uint32        `json:"pos"`      // 版本生效的binlog pos
+	GTID    string        `json:"gtid"`     // 版本生效时已执行的gtid集合，包括ddl本身
+	Table   *schema.Table `json:"table"`    // 表结构，表被删除时为nil
+	Unique  []string      `json:"unique"`   // 主键以外的唯一索引名，为nil时没有记录
+	NotNull []string      `json:"not_null"` // 不能为null的列，为nil时没有记录
+	gset    mysql.GTIDSet // 解析后的GTID
+}
+
+// 系统库不做快照
+const systemSchemas = "'mysql', 'information_schema', 'performance_schema', 'sys'"
+
+// 创建表结构历史，如果持久化文件存在则加载
+func newSchemaHistory(file string) *schemaHistory {
+	s := &schemaHistory{
+		file:   file,
+		lock:   new(sync.RWMutex),
+		Tables: make(map[string][]*schemaVersion),
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("[E] read schema history with error: %+v", err)
+		}
+		return s
+	}
+	if err = json.Unmarshal(data, s); err != nil {
+		log.Errorf("[E] parse schema history with error: %+v", err)
+		s.Tables = make(map[string][]*schemaVersion)
+	}
+	return s
+}
+
+func (v *schemaVersion) position() mysql.Position {
+	return mysql.Position{Name: v.File, Pos: v.Pos}
+}
+
+// 版本的gtid集合，按gset的类型解析，版本没有gtid或者gset为nil时返回nil
+func (v *schemaVersion) gtidSet(gset mysql.GTIDSet) mysql.GTIDSet {
+	if v.GTID == "" || gset == nil {
+		return nil
+	}
+	if v.gset == nil {
+		flavor := mysql.MySQLFlavor
+		if _, ok := gset.(*mysql.MariadbGTIDSet); ok {
+			flavor = mysql.MariaDBFlavor
+		}
+		vset, err := mysql.ParseGTIDSet(flavor, v.GTID)
+		if err != nil {
+			return nil
+		}
+		v.gset = vset
+	}
+	return v.gset
+}
+
+// 版本在事件之前是否已经生效
+// 事件之前已执行的gtid集合包含版本的gtid集合时已经生效，没有gtid时版本位置不晚于事件位置时生效
+func (v *schemaVersion) effective(pos mysql.Position, gset mysql.GTIDSet) bool {
+	if vset := v.gtidSet(gset); vset != nil {
+		return gset.Contain(vset)
+	}
+	return v.position().Compare(pos) <= 0
+}
+
+// 是否还没有任何表结构
+func (s *schemaHistory) empty() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.Tables) == 0
+}
+
+// 添加一个表结构版本，序号为上一个版本加一
+// 非gtid模式下位置不晚于上一个版本时记录错误日志，一般是切换master之后binlog文件名变小，
+// 版本仍然添加，查找时最新的版本优先，之后的事件使用新的版本
+func (s *schemaHistory) add(key string, v *schemaVersion) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	versions := s.Tables[key]
+	if l := len(versions); l > 0 && v.GTID == "" && versions[l-1].position().Compare(v.position()) >= 0 {
+		log.Errorf("[E] schema version of %s at %s is not after the last version at %s, "+
+			"the versions of the table are ordered by sequence", key, v.position(), versions[l-1].position())
+	}
+	s.Seq++
+	v.Seq = s.Seq
+	s.Tables[key] = append(versions, v)
+}
+
+// 返回事件之前已经生效的表结构，pos为事件位置，gset为事件之前已执行的gtid集合，非gtid模式下为nil
+// 找不到时返回false，由调用方使用当前表结构
+func (s *schemaHistory) get(key string, pos mysql.Position, gset mysql.GTIDSet) (*schema.Table, bool) {
+	v := s.version(key, pos, gset)
+	if v == nil || v.Table == nil {
+		return nil, false
+	}
+	return v.Table, true
+}
+
+// 事件之前已经生效的最新版本，没有记录时返回nil
+func (s *schemaHistory) version(key string, pos mysql.Position, gset mysql.GTIDSet) *schemaVersion {
+	// 解析后的gtid集合缓存在版本中，使用写锁
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	versions := s.Tables[key]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].effective(pos, gset) {
+			return versions[i]
+		}
+	}
+	return nil
+}
+
+// 最新的版本是否已经包含了这个ddl，重新处理已经记录过的ddl时不再推导
+// gset为包括ddl本身在内已执行的gtid集合
+func (s *schemaHistory) recorded(key string, pos mysql.Position, gset mysql.GTIDSet) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	versions := s.Tables[key]
+	if len(versions) == 0 {
+		return false
+	}
+	v := versions[len(versions)-1]
+	if vset := v.gtidSet(gset); vset != nil {
+		return vset.Contain(gset)
+	}
+	return v.position().Compare(pos) >= 0
+}
+
+// 表是否有记录的版本
+func (s *schemaHistory) tracked(key string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.Tables[key]) > 0
+}
+
+// 表结构版本中记录的行唯一标识列，见versionKeys
+// t是历史中的一个版本时使用这个版本的索引，否则使用最新的版本，没有记录或者版本中没有唯一索引信息时返回false
+func (s *schemaHistory) keys(t *schema.Table) ([]string, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var found *schemaVersion
+	for _, v := range s.Tables[t.String()] {
+		if v.Table == t {
+			found = v
+			break
+		}
+		if v.Table != nil {
+			found = v
+		}
+	}
+	if found == nil || found.Unique == nil || found.NotNull == nil {
+		return nil, false
+	}
+	return versionKeys(t, found.Table.Indexes, found.Unique, found.NotNull), true
+}
+
+// 没有主键时行的唯一标识列，indexes中第一个列都不能为null并且都在t中存在的唯一索引
+// 唯一索引的列可以为null时，多行null不违反唯一约束，按索引分块时null的行也会被跳过，不能作为行的标识
+func versionKeys(t *schema.Table, indexes []*schema.Index, unique, notNull []string) []string {
+	for _, index := range indexes {
+		if !hasName(unique, index.Name) {
+			continue
+		}
+		columns := make([]string, 0, len(index.Columns))
+		for _, column := range index.Columns {
+			if column == "" || !hasName(notNull, column) || t.FindColumn(column) < 0 {
+				columns = append(columns, "")
+			} else {
+				columns = append(columns, column)
+			}
+		}
+		if keys := uniqueColumns(columns); len(keys) > 0 {
+			return keys
+		}
+	}
+	return make([]string, 0)
+}
+
+// 持久化，先写临时文件再改名，避免写入一半的文件
+func (s *schemaHistory) save() error {
+	s.lock.RLock()
+	data, err := json.Marshal(s)
+	s.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// 表结构快照
+// 第一次启动时从information_schema读取所有表的结构，作为起始位置的版本
+func (h *Binlog) schemaSnapshot(pos mysql.Position) {
+	rr, err := h.handler.Execute("SELECT TABLE_SCHEMA, TABLE_NAME FROM information_schema.TABLES " +
+		"WHERE TABLE_TYPE = 'BASE TABLE' AND TABLE_SCHEMA NOT IN (" + systemSchemas + ")")
+	if err != nil {
+		log.Errorf("[E] schema snapshot with error: %+v", err)
+		return
+	}
+	h.lock.Lock()
+	gtid := h.gtidString()
+	h.lock.Unlock()
+	for i := 0; i < rr.RowNumber(); i++ {
+		db, _ := rr.GetString(i, 0)
+		name, _ := rr.GetString(i, 1)
+		v, err := liveVersion(h.handler, db, name)
+		if err != nil {
+			if err != canal.ErrExcludedTable {
+				log.Warnf("[W] schema snapshot %s.%s with error: %+v", db, name, err)
+			}
+			continue
+		}
+		v.File, v.Pos, v.GTID = pos.Name, pos.Pos, gtid
+		h.schemas.add(v.Table.String(), v)
+	}
+	if err = h.schemas.save(); err != nil {
+		log.Errorf("[E] save schema history with error: %+v", err)
+	}
+	log.Infof("[I] schema snapshot at %s done", pos)
+}
+
+// 数据库中表的当前结构，包括唯一索引和不能为null的列
+func liveVersion(handler *canal.Canal, db, name string) (*schemaVersion, error) {
+	t, err := handler.GetTable(db, name)
+	if err != nil {
+		return nil, err
+	}
+	unique, notNull, err := tableKeys(handler, db, name)
+	if err != nil {
+		return nil, err
+	}
+	return &schemaVersion{Table: t, Unique: unique, NotNull: notNull}, nil
+}
+
+// 从information_schema读取表的唯一索引名（不包括主键）和不能为null的列
+func tableKeys(handler *canal.Canal, db, name string) ([]string, []string, error) {
+	unique := make([]string, 0)
+	notNull := make([]string, 0)
+	rr, err := handler.Execute("SELECT DISTINCT INDEX_NAME FROM information_schema.STATISTICS "+
+		"WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND NON_UNIQUE = 0 AND INDEX_NAME <> 'PRIMARY'", db, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := 0; i < rr.RowNumber(); i++ {
+		index, _ := rr.GetString(i, 0)
+		unique = append(unique, index)
+	}
+	rr, err = handler.Execute("SELECT COLUMN_NAME FROM information_schema.COLUMNS "+
+		"WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND IS_NULLABLE = 'NO'", db, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := 0; i < rr.RowNumber(); i++ {
+		column, _ := rr.GetString(i, 0)
+		notNull = append(notNull, column)
+	}
+	return unique, notNull, nil
+}
+
+// 记录ddl之后的表结构
+// 新版本由上一个版本应用ddl推导，不读取数据库中的表结构：回放或者追赶旧的binlog时数据库中的表结构可能已经经过了之后的ddl
+// 无法推导时重新读取数据库中的当前表结构作为新版本，实时同步时与ddl之后的表结构一致，追赶旧的binlog时可能偏新；
+// 离线回放时没有数据库连接，保留上一个版本
+// 离线回放时只在内存中更新，不修改表结构快照文件
+func (h *Binlog) schemaChanged(db, table, query string, p mysql.Position) {
+	if h.schemas == nil {
+		return
+	}
+	key := db + "." + table
+	h.lock.Lock()
+	gtid := h.gtidString()
+	recorded := h.schemas.recorded(key, p, h.gtidSet)
+	h.lock.Unlock()
+	if recorded {
+		// 已经记录过的ddl
+		h.tableCacheClear(key)
+		return
+	}
+	changes, err := evolveSchema(query, db, func(k string) *schemaVersion {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		return h.schemas.version(k, p, h.gtidSet)
+	})
+	if err != nil {
+		changes = h.schemaReload(key, p, err)
+	}
+	for _, c := range changes {
+		h.tableCacheClear(c.key)
+		c.version.File, c.version.Pos, c.version.GTID = p.Name, p.Pos, gtid
+		h.schemas.add(c.key, c.version)
+	}
+	if len(changes) == 0 || h.currentHandler() == nil {
+		return
+	}
+	if err = h.schemas.save(); err != nil {
+		log.Errorf("[E] save schema history with error: %+v", err)
+	}
+}
+
+// ddl无法推导时重新读取数据库中的当前表结构
+// 表已经不存在时，没有记录过的表保持不记录，记录过的表记为未知，之后使用canal缓存的当前表结构
+func (h *Binlog) schemaReload(key string, p mysql.Position, err error) []ddlChange {
+	handler := h.currentHandler()
+	if handler == nil {
+		log.Errorf("[E] schema of %s not changed, can not rebuild the schema after the ddl at %s: %v", key, p, err)
+		return nil
+	}
+	log.Warnf("[W] can not rebuild the schema of %s after the ddl at %s: %v, read the current schema instead", key, p, err)
+	h.tableCacheClear(key)
+	parts := strings.SplitN(key, ".", 2)
+	v, err := liveVersion(handler, parts[0], parts[1])
+	if err != nil {
+		if !h.schemas.tracked(key) {
+			log.Warnf("[W] schema of %s not tracked after the ddl at %s: %v", key, p, err)
+			return nil
+		}
+		log.Errorf("[E] schema of %s unknown after the ddl at %s: %v", key, p, err)
+		v = &schemaVersion{}
+	}
+	return []ddlChange{{key: key, version: v}}
+}
+
+// 清除表的唯一索引和canal缓存的表结构
+func (h *Binlog) tableCacheClear(key string) {
+	h.lock.Lock()
+	delete(h.uniqueKeys, key)
+	handler := h.handler
+	h.lock.Unlock()
+	if handler != nil {
+		parts := strings.SplitN(key, ".", 2)
+		handler.ClearTableCache([]byte(parts[0]), []byte(parts[1]))
+	}
+}
+
+// 行事件对应的表结构
+// 优先使用表结构历史中事件位置之前最近的版本，没有记录时使用canal缓存的当前表结构
+func (h *Binlog) tableAt(e *canal.RowsEvent) *schema.Table {
+	if h.schemas == nil || e.Header == nil {
+		return e.Table
+	}
+	h.lock.Lock()
+	pos := mysql.Position{Name: h.lastBinFile, Pos: e.Header.LogPos}
+	h.lock.Unlock()
+	if t, ok := h.schemaAt(e.Table.String(), pos); ok {
+		return t
+	}
+	return e.Table
+}
+
+// pos时刻的表结构，gtid模式下按当前已执行的gtid集合查找
+func (h *Binlog) schemaAt(key string, pos mysql.Position) (*schema.Table, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.schemas.get(key, pos, h.gtidSet)
+}
+
+// 行的唯一标识列
+// 优先使用主键，没有主键时使用第一个所有列都不能为null的唯一索引，都没有时为空
+// 唯一索引使用表结构历史中记录的版本，回放旧的binlog时数据库中的索引可能已经改变，离线回放时也没有数据库连接；
+// 没有记录的表才从information_schema读取
+func (h *Binlog) keyColumns(t *schema.Table) []string {
+	keys := make([]string, 0)
+	if len(t.PKColumns) > 0 {
+		for _, i := range t.PKColumns {
+			keys = append(keys, t.Columns[i].Name)
+		}
+		return keys
+	}
+	if h.schemas != nil {
+		if keys, ok := h.schemas.keys(t); ok {
+			return keys
+		}
+	}
+	key := t.String()
+	h.lock.Lock()
+	cached, ok := h.uniqueKeys[key]
+	handler := h.handler
+	h.lock.Unlock()
+	if ok {
+		return cached
+	}
+	if handler == nil {
+		return keys
+	}
+	unique, notNull, err := tableKeys(handler, t.Schema, t.Name)
+	if err != nil {
+		log.Errorf("[E] query unique key of %s with error: %+v", key, err)
+		return keys
+	}
+	keys = versionKeys(t, t.Indexes, unique, notNull)
+	h.lock.Lock()
+	if h.uniqueKeys == nil {
+		h.uniqueKeys = make(map[string][]string)
+	}
+	h.uniqueKeys[key] = keys
+	h.lock.Unlock()
+	return keys
+}
+
+// 唯一索引的列，有列不在当前表结构中时为空
+func uniqueColumns(columns []string) []string {
+	for _, column := range columns {
+		if column == "" {
+			return make([]string, 0)
+		}
+	}
+	return columns
+}
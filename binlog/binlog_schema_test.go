@@ -0,0 +1,121 @@
+package binlog
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+	"github.com/toolkits/file"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// test schema history api
+// 按binlog位置返回表结构版本，并且可以持久化
+func TestSchemaHistory(t *testing.T) {
+	path := CurrentPath + "/schema_test.json"
+	defer file.Remove(path)
+
+	s := newSchemaHistory(path)
+	if !s.empty() {
+		t.Fatalf("schema history should be empty")
+	}
+	v1 := &schema.Table{Schema: "test", Name: "a", Columns: []schema.TableColumn{{Name: "id"}}}
+	v2 := &schema.Table{Schema: "test", Name: "a", Columns: []schema.TableColumn{{Name: "id"}, {Name: "name"}}}
+	v3 := &schema.Table{Schema: "test", Name: "a", Columns: []schema.TableColumn{{Name: "id"}, {Name: "name"}, {Name: "age"}}}
+	s.add("test.a", &schemaVersion{File: "mysql-bin.000001", Pos: 4, Table: v1})
+	s.add("test.a", &schemaVersion{File: "mysql-bin.000002", Pos: 100, Table: v2})
+	if err := s.save(); err != nil {
+		t.Fatalf("save schema history error: %+v", err)
+	}
+
+	s = newSchemaHistory(path)
+	if _, ok := s.get("test.a", mysql.Position{Name: "mysql-bin.000001", Pos: 1}, nil); ok {
+		t.Errorf("no version before the first one")
+	}
+	if tb, ok := s.get("test.a", mysql.Position{Name: "mysql-bin.000002", Pos: 50}, nil); !ok || len(tb.Columns) != 1 {
+		t.Errorf("expect version 1 before alter")
+	}
+	if tb, ok := s.get("test.a", mysql.Position{Name: "mysql-bin.000002", Pos: 100}, nil); !ok || len(tb.Columns) != 2 {
+		t.Errorf("expect version 2 after alter")
+	}
+	if _, ok := s.get("test.b", mysql.Position{Name: "mysql-bin.000002", Pos: 100}, nil); ok {
+		t.Errorf("unknown table should not be found")
+	}
+
+	// 切换master后binlog文件名变小，版本仍然按顺序添加，之后的事件使用新的版本
+	s.add("test.a", &schemaVersion{File: "mysql-bin.000001", Pos: 200, Table: v3})
+	if versions := s.Tables["test.a"]; len(versions) != 3 || versions[2].Seq != 3 || s.Seq != 3 {
+		t.Fatalf("expect 3 versions by sequence, got %+v", versions)
+	}
+	if tb, ok := s.get("test.a", mysql.Position{Name: "mysql-bin.000001", Pos: 300}, nil); !ok || len(tb.Columns) != 3 {
+		t.Errorf("expect version 3 after failover")
+	}
+}
+
+// test schema history lookup by gtid
+// gtid模式下按事件之前已执行的gtid集合查找版本，与binlog位置无关
+func TestSchemaHistory_GTID(t *testing.T) {
+	s := newSchemaHistory(CurrentPath + "/schema_gtid_test_not_exist.json")
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	v1 := &schema.Table{Schema: "test", Name: "a", Columns: []schema.TableColumn{{Name: "id"}}}
+	v2 := &schema.Table{Schema: "test", Name: "a", Columns: []schema.TableColumn{{Name: "id"}, {Name: "name"}}}
+	s.add("test.a", &schemaVersion{File: "mysql-bin.000009", Pos: 4, GTID: uuid + ":1-5", Table: v1})
+	// 新master上的ddl，位置比快照小
+	s.add("test.a", &schemaVersion{File: "mysql-bin.000001", Pos: 100, GTID: uuid + ":1-8", Table: v2})
+
+	gset := func(s string) mysql.GTIDSet {
+		g, err := mysql.ParseMysqlGTIDSet(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return g
+	}
+	pos := mysql.Position{Name: "mysql-bin.000001", Pos: 50}
+	if tb, ok := s.get("test.a", pos, gset(uuid+":1-7")); !ok || len(tb.Columns) != 1 {
+		t.Errorf("expect version 1 before the ddl")
+	}
+	if tb, ok := s.get("test.a", pos, gset(uuid+":1-8")); !ok || len(tb.Columns) != 2 {
+		t.Errorf("expect version 2 after the ddl")
+	}
+	if _, ok := s.get("test.a", pos, gset(uuid+":1-3")); ok {
+		t.Errorf("no version before the snapshot")
+	}
+	if !s.recorded("test.a", pos, gset(uuid+":1-8")) || s.recorded("test.a", pos, gset(uuid+":1-9")) {
+		t.Errorf("only the ddl in the last version is recorded")
+	}
+}
+
+// test key columns from schema history
+// 没有主键时使用表结构历史中记录的非空唯一索引，不需要数据库连接
+func TestBinlog_HistoryKeyColumns(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{}, &events)
+	h.schemas = newSchemaHistory(CurrentPath + "/schema_keys_test_not_exist.json")
+	tables := make(map[string]*schemaVersion)
+	changes, err := evolveSchema("CREATE TABLE a (id int, code varchar(10) NOT NULL, name varchar(10), "+
+		"UNIQUE KEY uk_name (name), UNIQUE KEY uk_code (code))", "test", func(key string) *schemaVersion { return tables[key] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.schemas.add("test.a", changes[0].version)
+	old := changes[0].version.Table
+	if keys := h.keyColumns(old); !reflect.DeepEqual(keys, []string{"code"}) {
+		t.Errorf("expect non-null unique key code, got %v", keys)
+	}
+	tables["test.a"] = changes[0].version
+	changes, err = evolveSchema("ALTER TABLE a MODIFY code varchar(10) NULL, MODIFY name varchar(10) NOT NULL", "test",
+		func(key string) *schemaVersion { return tables[key] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.schemas.add("test.a", changes[0].version)
+	// 每个版本使用自己的索引
+	if keys := h.keyColumns(old); !reflect.DeepEqual(keys, []string{"code"}) {
+		t.Errorf("old version expect key code, got %v", keys)
+	}
+	if keys := h.keyColumns(changes[0].version.Table); !reflect.DeepEqual(keys, []string{"name"}) {
+		t.Errorf("new version expect key name, got %v", keys)
+	}
+}
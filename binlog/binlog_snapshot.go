@@ -0,0 +1,471 @@
+package binlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/client"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// 初始快照
+// 开启后第一次启动时先记录master当前的binlog位置，然后按主键顺序分块读取所有需要同步的表并推送，
+// 完成后从记录的位置开始增量同步，快照期间的修改会在增量同步时再次收到
+// 没有主键和不能为null的唯一索引的表无法确定分块的顺序，跳过并记录警告
+// 每个分块推送后保存进度，中断后从最后一个分块继续
+const eventTypeSnapshot = "snapshot"
+
+// 默认分块大小
+const snapshotDefaultChunkSize = 1000
+
+// 快照进度
+type snapshotState struct {
+	file    string      // 持久化文件
+	lock    *sync.Mutex // 进度在管理接口中读取
+	File    string      `json:"file"`     // 快照开始时的binlog file
+	Pos     uint32      `json:"pos"`      // 快照开始时的binlog pos
+	GTID    string      `json:"gtid"`     // 快照开始时的gtid集合，仅gtid模式
+	Tables  []string    `json:"tables"`   // 需要快照的表，格式为db.table
+	Index   int         `json:"index"`    // 正在快照的表的序号
+	LastKey []string    `json:"last_key"` // 当前表已推送的最后一行的主键
+	Offset  int64       `json:"offset"`   // 当前表已推送的行数
+	Rows    int64       `json:"rows"`     // 已推送的总行数
+	Done    bool        `json:"done"`     // 是否已经完成
+}
+
+// 加载快照进度，文件不存在时返回一个新的进度
+func loadSnapshotState(file string) (*snapshotState, error) {
+	s := &snapshotState{file: file, lock: new(sync.Mutex)}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// 持久化，先写临时文件再改名
+func (s *snapshotState) save() error {
+	s.lock.Lock()
+	data, err := json.Marshal(s)
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// 快照进度，用于管理接口
+func (s *snapshotState) status() map[string]interface{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status := make(map[string]interface{})
+	status["binlog_file"] = s.File
+	status["binlog_pos"] = s.Pos
+	status["tables"] = len(s.Tables)
+	status["done_tables"] = s.Index
+	status["rows"] = s.Rows
+	status["done"] = s.Done
+	if s.Index < len(s.Tables) {
+		status["table"] = s.Tables[s.Index]
+		status["table_rows"] = s.Offset
+	}
+	return status
+}
+
+// 是否开启了初始快照
+func (h *Binlog) isSnapshotMode() bool {
+	cfg := h.ctx.Config().Snapshot
+	return cfg != nil && cfg.Enabled
+}
+
+// 快照进度文件
+func (h *Binlog) snapshotFile() string {
+	file := ""
+	if cfg := h.ctx.Config().Snapshot; cfg != nil {
+		file = cfg.File
+	}
+	if file == "" {
+		file = g.SNAPSHOT_FILE
+	}
+	return h.sourceFile(file)
+}
+
+// 执行初始快照，已经完成时直接返回
+// 快照被停止时返回error，调用方不应再开始增量同步
+func (h *Binlog) snapshot() error {
+	h.lock.Lock()
+	forced := h.snapshotForced
+	h.lock.Unlock()
+	if !h.isSnapshotMode() && !forced {
+		return nil
+	}
+	chunkSize := 0
+	if cfg := h.ctx.Config().Snapshot; cfg != nil {
+		chunkSize = cfg.ChunkSize
+	}
+	state, err := loadSnapshotState(h.snapshotFile())
+	if err != nil {
+		return err
+	}
+	if state.Done {
+		return nil
+	}
+	if state.File == "" {
+		if err = h.snapshotStart(state); err != nil {
+			return err
+		}
+	}
+	// 增量同步从快照开始时的位置继续
+	if err = h.snapshotPosition(state); err != nil {
+		return err
+	}
+	h.lock.Lock()
+	h.snapshotting = state
+	h.lock.Unlock()
+	log.Infof("[I] snapshot start at %s:%d, tables: %d", state.File, state.Pos, len(state.Tables))
+	for state.Index < len(state.Tables) {
+		if err = h.snapshotTable(state, chunkSize); err != nil {
+			return err
+		}
+		state.lock.Lock()
+		state.Index++
+		state.LastKey = nil
+		state.Offset = 0
+		state.lock.Unlock()
+		if err = state.save(); err != nil {
+			return err
+		}
+	}
+	state.lock.Lock()
+	state.Done = true
+	state.lock.Unlock()
+	if err = state.save(); err != nil {
+		return err
+	}
+	h.lock.Lock()
+	h.snapshotForced = false
+	r := packPos(h.lastBinFile, int64(h.lastPos), atomic.LoadInt64(&h.EventIndex), h.gtidString())
+	h.lock.Unlock()
+	h.ackPosition(r)
+	log.Infof("[I] snapshot done, rows: %d", state.Rows)
+	return nil
+}
+
+// 记录快照开始时的位置和需要快照的表
+func (h *Binlog) snapshotStart(state *snapshotState) error {
+	handler := h.currentHandler()
+	pos, err := handler.GetMasterPos()
+	if err != nil {
+		return err
+	}
+	state.File, state.Pos = pos.Name, pos.Pos
+	if h.isGTIDMode() {
+		gset, err := handler.GetMasterGTIDSet()
+		if err != nil {
+			return err
+		}
+		state.GTID = gset.String()
+	}
+	rr, err := handler.Execute("SELECT TABLE_SCHEMA, TABLE_NAME FROM information_schema.TABLES " +
+		"WHERE TABLE_TYPE = 'BASE TABLE' AND TABLE_SCHEMA NOT IN (" + systemSchemas + ") " +
+		"ORDER BY TABLE_SCHEMA, TABLE_NAME")
+	if err != nil {
+		return err
+	}
+	state.Tables = make([]string, 0)
+	for i := 0; i < rr.RowNumber(); i++ {
+		db, _ := rr.GetString(i, 0)
+		name, _ := rr.GetString(i, 1)
+		if h.tableMatch(db+"."+name) && db+"."+name != h.watermarkTable() {
+			state.Tables = append(state.Tables, db+"."+name)
+		}
+	}
+	return state.save()
+}
+
+// 将同步位置设置为快照开始时的位置
+func (h *Binlog) snapshotPosition(state *snapshotState) error {
+	var (
+		gset mysql.GTIDSet
+		err  error
+	)
+	if state.GTID != "" {
+		if gset, err = mysql.ParseGTIDSet(h.flavor(), state.GTID); err != nil {
+			return err
+		}
+	}
+	h.lock.Lock()
+	h.lastBinFile = state.File
+	h.lastPos = state.Pos
+	if gset != nil {
+		h.gtidSet = gset
+	}
+	h.lock.Unlock()
+	return nil
+}
+
+// 当前的canal句柄，停止服务时会被重新创建
+func (h *Binlog) currentHandler() *canal.Canal {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.handler
+}
+
+// 快照读取使用的独立连接
+// 会话时区设置为UTC，timestamp按UTC读取，由snapshotValue转换，不影响canal的共享连接
+func (h *Binlog) snapshotConn() (*client.Conn, error) {
+	cfg := h.database()
+	conn, err := client.Connect(fmt.Sprintf("%s:%d", cfg.Host, cfg.Port), cfg.User, cfg.Password, "")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Charset != "" {
+		if err = conn.SetCharset(cfg.Charset); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if _, err = conn.Execute("SET time_zone = '+00:00'"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// 服务是否被停止或者退出，快照、重连和等待确认时需要中断
+func (h *Binlog) stopped() bool {
+	h.statusLock.Lock()
+	defer h.statusLock.Unlock()
+	return h.status&binlogIsRunning == 0 || h.status&binlogIsExit > 0
+}
+
+// 分块读取一个表
+func (h *Binlog) snapshotTable(state *snapshotState, chunkSize int) error {
+	if chunkSize <= 0 {
+		chunkSize = snapshotDefaultChunkSize
+	}
+	name := state.Tables[state.Index]
+	parts := strings.SplitN(name, ".", 2)
+	table, err := h.currentHandler().GetTable(parts[0], parts[1])
+	if err != nil {
+		// 快照开始后被删除或者被排除的表
+		log.Warnf("[W] snapshot %s skipped, get table with error: %+v", name, err)
+		return nil
+	}
+	keys := h.keyColumns(table)
+	if len(keys) == 0 {
+		// 没有顺序时按偏移分块会重复或者遗漏行，中断后也无法继续
+		log.Warnf("[W] snapshot %s skipped: no primary key or non-null unique key", name)
+		return nil
+	}
+	conn, err := h.snapshotConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for {
+		if h.stopped() {
+			return fmt.Errorf("snapshot of %s stopped", name)
+		}
+		query, args := snapshotQuery(table, keys, state, chunkSize)
+		rr, err := conn.Execute(query, args...)
+		if err != nil {
+			return err
+		}
+		n := len(rr.Values)
+		for i, row := range rr.Values {
+			if err = h.snapshotRow(table, keys, state, i, row); err != nil {
+				return err
+			}
+		}
+		state.lock.Lock()
+		if n > 0 {
+			state.LastKey = snapshotKey(table, keys, rr.Values[n-1])
+		}
+		state.Offset += int64(n)
+		state.Rows += int64(n)
+		state.lock.Unlock()
+		// 分块中的行都交付之后才保存进度
+		if err = h.waitSnapshotAcked(name); err != nil {
+			return err
+		}
+		if err = state.save(); err != nil {
+			return err
+		}
+		if n < chunkSize {
+			log.Infof("[I] snapshot %s done, rows: %d", name, state.Offset)
+			return nil
+		}
+	}
+}
+
+// 分块查询语句
+// 按主键顺序从上一个分块的最后一行之后读取，keys不能为空
+func snapshotQuery(table *schema.Table, keys []string, state *snapshotState, chunkSize int) (string, []interface{}) {
+	columns := make([]string, 0)
+	for _, col := range table.Columns {
+		columns = append(columns, quoteName(col.Name))
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s.%s", strings.Join(columns, ", "),
+		quoteName(table.Schema), quoteName(table.Name))
+	args := make([]interface{}, 0)
+	quoted := make([]string, 0)
+	marks := make([]string, 0)
+	for _, k := range keys {
+		quoted = append(quoted, quoteName(k))
+	}
+	if len(state.LastKey) == len(keys) {
+		for i, k := range keys {
+			arg, mark := snapshotKeyArg(&table.Columns[table.FindColumn(k)], state.LastKey[i])
+			args = append(args, arg)
+			marks = append(marks, mark)
+		}
+		query += fmt.Sprintf(" WHERE (%s) > (%s)", strings.Join(quoted, ", "), strings.Join(marks, ", "))
+	}
+	return fmt.Sprintf("%s ORDER BY %s LIMIT %d", query, strings.Join(quoted, ", "), chunkSize), args
+}
+
+// 按主键列的类型绑定上一个分块最后一行的主键值
+// 主键值保存为字符串，直接绑定字符串时整数列和decimal列会按double比较，超过2^53的值会重复或者遗漏行，
+// 整数按有无符号解析后绑定，decimal在sql中转换，其他类型与字符串比较的结果与列本身一致
+func snapshotKeyArg(column *schema.TableColumn, v string) (interface{}, string) {
+	switch column.Type {
+	case schema.TYPE_NUMBER:
+		if column.IsUnsigned {
+			if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+				return n, "?"
+			}
+		} else if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return n, "?"
+		}
+	case schema.TYPE_DECIMAL:
+		return v, "CAST(? AS DECIMAL(65,30))"
+	}
+	return v, "?"
+}
+
+// 行的主键值，保存为字符串，避免json中的大整数丢失精度
+func snapshotKey(table *schema.Table, keys []string, row []interface{}) []string {
+	res := make([]string, 0)
+	for _, k := range keys {
+		v := row[table.FindColumn(k)]
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		res = append(res, fmt.Sprint(v))
+	}
+	return res
+}
+
+func quoteName(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// 推送一行快照数据
+func (h *Binlog) snapshotRow(table *schema.Table, keys []string, state *snapshotState, rowIndex int, row []interface{}) error {
+	p := mysql.Position{Name: state.File, Pos: state.Pos}
+	rowData := h.snapshotEvent(table, keys, p, rowIndex, row)
+	rowData["event_id"] = h.snapshotEventID(fmt.Sprintf("%s:%d", state.File, state.Pos), table, keys, state.Offset+int64(rowIndex), row)
+	return h.pushSnapshot(rowData, nil)
+}
+
+// 构造快照事件，p为快照数据对应的binlog位置
+func (h *Binlog) snapshotEvent(table *schema.Table, keys []string, p mysql.Position, rowIndex int, row []interface{}) map[string]interface{} {
+	data := make(map[string]interface{})
+	for k, col := range table.Columns {
+		if k < len(row) {
+			column := &table.Columns[k]
+			data[col.Name] = fieldDecode(snapshotValue(row[k], column), column)
+		}
+	}
+	rowData := make(map[string]interface{})
+	rowData["database"] = table.Schema
+	rowData["event_type"] = eventTypeSnapshot
+	rowData["time"] = time.Now().Unix()
+	rowData["table"] = table.Name
+	rowData["event_index"] = atomic.AddInt64(&h.EventIndex, int64(1))
+	rowData["event"] = map[string]interface{}{"data": data}
+	rowData["row_index"] = rowIndex
+	rowData["column_types"] = columnTypes(table)
+	h.setSource(rowData, h.serverID, p)
+	setRowKey(rowData, keys, nil, data)
+	return rowData
+}
+
+// 脱敏和转换之后推送快照事件，targets为空时推送给所有的客户端
+func (h *Binlog) pushSnapshot(rowData map[string]interface{}, targets []string) error {
+	h.redact(rowData)
+	events, err := h.transform(rowData)
+	if err != nil {
+		return err
+	}
+	fanoutEventID(events)
+	for _, ev := range events {
+		if len(targets) == 0 {
+			h.notify(ev)
+		} else {
+			h.notifyTo(ev, targets)
+		}
+	}
+	return nil
+}
+
+// 查询结果与binlog中的值类型不同，这里转换为fieldDecode可以处理的类型
+// 时间类型在查询结果中为字符串，decimal、bit为[]byte
+func snapshotValue(v interface{}, column *schema.TableColumn) interface{} {
+	b, ok := v.([]byte)
+	if !ok {
+		return v
+	}
+	switch column.Type {
+	case schema.TYPE_DECIMAL:
+		d, err := decimal.NewFromString(string(b))
+		if err != nil {
+			return string(b)
+		}
+		return d
+	case schema.TYPE_BIT:
+		// 与binlog中的解析一致，按大端序转换为整数
+		var n int64
+		for _, c := range b {
+			n = n<<8 | int64(c)
+		}
+		return n
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP:
+		loc := g.Location
+		if column.Type == schema.TYPE_TIMESTAMP {
+			// 快照查询的会话时区为UTC
+			loc = time.UTC
+		}
+		t, err := time.ParseInLocation("2006-01-02 15:04:05.999999", string(b), loc)
+		if err != nil {
+			// 零值等无法解析的时间，保持原样
+			return string(b)
+		}
+		return t
+	}
+	return v
+}
@@ -0,0 +1,89 @@
+package binlog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/siddontang/go-mysql/schema"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+func newTestSnapshotTable() *schema.Table {
+	return &schema.Table{
+		Schema: "test",
+		Name:   "user",
+		Columns: []schema.TableColumn{
+			{Name: "id", Type: schema.TYPE_NUMBER, RawType: "int"},
+			{Name: "name", Type: schema.TYPE_STRING, RawType: "varchar(20)"},
+			{Name: "amount", Type: schema.TYPE_DECIMAL, RawType: "decimal(10,2)"},
+		},
+		PKColumns: []int{0},
+	}
+}
+
+// test snapshot chunk query
+func TestSnapshotQuery(t *testing.T) {
+	table := newTestSnapshotTable()
+	state := &snapshotState{}
+	query, args := snapshotQuery(table, []string{"id"}, state, 100)
+	if query != "SELECT `id`, `name`, `amount` FROM `test`.`user` ORDER BY `id` LIMIT 100" || len(args) != 0 {
+		t.Errorf("first chunk query error: %s, %v", query, args)
+	}
+	state.LastKey = []string{"10"}
+	query, args = snapshotQuery(table, []string{"id"}, state, 100)
+	if query != "SELECT `id`, `name`, `amount` FROM `test`.`user` WHERE (`id`) > (?) ORDER BY `id` LIMIT 100" ||
+		len(args) != 1 || args[0] != int64(10) {
+		t.Errorf("next chunk query error: %s, %v", query, args)
+	}
+	// 超过2^53的无符号整数和decimal按列的类型比较
+	table.Columns[0].IsUnsigned = true
+	state.LastKey = []string{"18446744073709551615", "12.30"}
+	query, args = snapshotQuery(table, []string{"id", "amount"}, state, 100)
+	if query != "SELECT `id`, `name`, `amount` FROM `test`.`user` WHERE (`id`, `amount`) > (?, CAST(? AS DECIMAL(65,30))) ORDER BY `id`, `amount` LIMIT 100" ||
+		len(args) != 2 || args[0] != uint64(18446744073709551615) || args[1] != "12.30" {
+		t.Errorf("typed key query error: %s, %v", query, args)
+	}
+	if key := snapshotKey(table, []string{"id"}, []interface{}{int64(12345678901234567), []byte("a"), nil}); key[0] != "12345678901234567" {
+		t.Errorf("snapshot key error: %v", key)
+	}
+}
+
+// test snapshot row and state
+func TestBinlog_SnapshotRow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copycat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{Database: &g.DatabaseConfig{}}, &events)
+	state, err := loadSnapshotState(filepath.Join(dir, "snapshot.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.File, state.Pos, state.Tables = "mysql-bin.000002", 4, []string{"test.user"}
+	table := newTestSnapshotTable()
+	if err = h.snapshotRow(table, []string{"id"}, state, 0, []interface{}{int64(1), []byte("tom"), []byte("1.50")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expect 1 event, got %d", len(events))
+	}
+	ev := events[0]
+	data := ev["event"].(map[string]interface{})["data"].(map[string]interface{})
+	if ev["event_type"] != eventTypeSnapshot || ev["binlog_file"] != "mysql-bin.000002" ||
+		data["name"] != "tom" || data["amount"] != "1.50" {
+		t.Errorf("snapshot event error: %+v", ev)
+	}
+	state.LastKey = []string{"1"}
+	if err = state.save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadSnapshotState(state.file)
+	if err != nil || loaded.File != state.File || len(loaded.LastKey) != 1 || loaded.Done {
+		t.Errorf("load snapshot state error: %+v, %v", loaded, err)
+	}
+}
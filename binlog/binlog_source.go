@@ -0,0 +1,103 @@
+package binlog
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// 多数据源
+// 每个数据源一个Binlog对象，各自同步、各自保存检查点，推送到共享的服务
+// 数据源有名称时，事件中带有source字段，主题为source.database.table
+
+// Source set the source name
+// 设置数据源名称，对应配置中sources的name
+func Source(name string) Option {
+	return func(h *Binlog) {
+		h.name = name
+	}
+}
+
+// Name 数据源名称
+func (h *Binlog) Name() string {
+	return h.name
+}
+
+// 数据源配置
+func (h *Binlog) database() *g.DatabaseConfig {
+	if cfg := h.ctx.Config().DatabaseSource(h.name); cfg != nil {
+		return cfg
+	}
+	return h.ctx.Config().Database
+}
+
+// 表过滤配置，数据源没有配置时使用全局配置
+func (h *Binlog) filterConfig() *g.FilterConfig {
+	if cfg := h.database(); cfg != nil && cfg.Filter != nil {
+		return cfg.Filter
+	}
+	return h.ctx.Config().Filter
+}
+
+// 检查点配置，数据源没有配置时使用全局配置，文件名加上数据源名称
+func (h *Binlog) checkpointConfig() *g.CheckpointConfig {
+	if cfg := h.database(); cfg != nil && cfg.Checkpoint != nil && cfg.Checkpoint.File != "" {
+		return cfg.Checkpoint
+	}
+	cfg := g.CheckpointConfig{}
+	if h.ctx.Config().Checkpoint != nil {
+		cfg = *h.ctx.Config().Checkpoint
+	}
+	if c := h.database(); c != nil && c.Checkpoint != nil && c.Checkpoint.Keep > 0 {
+		cfg.Keep = c.Checkpoint.Keep
+	}
+	if cfg.File == "" {
+		cfg.File = g.CHECKPOINT_FILE
+	}
+	cfg.File = h.sourceFile(cfg.File)
+	return &cfg
+}
+
+// 多个数据源共用的文件加上数据源名称，如checkpoint.json为checkpoint.name.json
+func (h *Binlog) sourceFile(path string) string {
+	if h.name == "" {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + h.name + ext
+}
+
+// 事件的主题，用于客户端按主题订阅
+func (h *Binlog) topic(data map[string]interface{}) string {
+	if data["table"] == "" {
+		// 没有表的事件，例如gap事件，推送给所有的订阅方
+		return ""
+	}
+	table := data["database"].(string) + "." + data["table"].(string)
+	if h.name == "" {
+		return table
+	}
+	return h.name + "." + table
+}
+
+// PackSourcePos 在pos信息前加上数据源名称，用于集群内同步多个数据源的pos
+// 格式为2字节名称长度加上名称
+func PackSourcePos(name string, r []byte) []byte {
+	res := make([]byte, 0)
+	res = append(res, byte(len(name)), byte(len(name)>>8))
+	res = append(res, name...)
+	return append(res, r...)
+}
+
+// UnpackSourcePos 解包PackSourcePos打包的pos信息
+func UnpackSourcePos(data []byte) (string, []byte) {
+	if len(data) < 2 {
+		return "", nil
+	}
+	l := int(data[0]) | int(data[1])<<8
+	if l > len(data)-2 {
+		return "", nil
+	}
+	return string(data[2 : l+2]), data[l+2:]
+}
@@ -0,0 +1,39 @@
+package binlog
+
+import (
+	"testing"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// test multiple sources
+// 有名称的数据源，事件带有source字段，主题带上数据源名称
+func TestBinlog_Source(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	topics := make([]string, 0)
+	h := newTestBinlog(&g.GlobalConfig{
+		Sources: []*g.DatabaseConfig{
+			{Name: "a", Filter: &g.FilterConfig{Exclude: []string{`^test\.b$`}}},
+			{Name: "b"},
+		},
+		Checkpoint: &g.CheckpointConfig{File: "/tmp/checkpoint.json", Keep: 3},
+	}, &events)
+	Source("a")(h)
+	OnEvent(func(table string, data []byte) {
+		topics = append(topics, table)
+	})(h)
+	testOnRow(h, newTestRowsEvent("a", 1))
+	if len(events) != 1 || events[0]["source"] != "a" || topics[0] != "a.test.a" {
+		t.Errorf("source event error: %+v, %v", events, topics)
+	}
+	if h.database().Name != "a" || h.filterConfig() == nil || len(h.filterConfig().Exclude) != 1 {
+		t.Errorf("source config error")
+	}
+	if cfg := h.checkpointConfig(); cfg.File != "/tmp/checkpoint.a.json" || cfg.Keep != 3 {
+		t.Errorf("source checkpoint error: %+v", cfg)
+	}
+	name, r := UnpackSourcePos(PackSourcePos("a", packPos("mysql-bin.000001", 4, 1, "")))
+	if file, pos, _, _ := unpackPos(r); name != "a" || file != "mysql-bin.000001" || pos != 4 {
+		t.Errorf("source pos error: %s, %s, %d", name, file, pos)
+	}
+}
@@ -0,0 +1,217 @@
+package binlog
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 大事务溢出到磁盘
+// 事务分组推送时行事件缓存在内存中，超过buffer_size后将已缓存的行写入临时文件，提交时按顺序读回并分块推送，
+// 事务被丢弃（回滚或者重新同步）时删除临时文件，进程重启时清理上次遗留的临时文件
+const (
+	spillDefaultBufferSize = 64 << 20 // 默认内存中缓存的最大字节数
+	spillDefaultChunkRows  = 1000     // 溢出的事务提交时每个分块的行数
+	spillFilePrefix        = "copycat-tx-"
+)
+
+// 溢出统计，用于管理接口
+type spillStats struct {
+	Transactions int64 `json:"transactions"` // 溢出到磁盘的事务数量
+	Segments     int64 `json:"segments"`     // 写入磁盘的次数
+	Rows         int64 `json:"rows"`         // 写入磁盘的行数
+	Bytes        int64 `json:"bytes"`        // 写入磁盘的字节数
+}
+
+// 缓存的一行，table为行所在的表在事务中的序号
+type bufferedRow struct {
+	table int
+	data  json.RawMessage
+}
+
+// 事务的行缓存，按binlog顺序保存json编码后的行
+// 文件中的行都早于内存中的行，文件中每行为4字节长度、4字节表序号和行内容
+type rowBuffer struct {
+	dir     string        // 临时文件目录
+	prefix  string        // 临时文件名前缀
+	limit   int64         // 内存中缓存的最大字节数
+	stats   *spillStats   // 溢出统计
+	rows    []bufferedRow // 内存中的行
+	size    int64         // 内存中的字节数
+	file    *os.File      // 溢出的临时文件
+	writer  *bufio.Writer //
+	spilled int           // 文件中的行数
+}
+
+func newRowBuffer(dir, prefix string, limit int64, stats *spillStats) *rowBuffer {
+	if limit <= 0 {
+		limit = spillDefaultBufferSize
+	}
+	return &rowBuffer{dir: dir, prefix: prefix, limit: limit, stats: stats}
+}
+
+// 缓存一行，内存超过限制时写入临时文件
+func (b *rowBuffer) add(row bufferedRow) error {
+	b.rows = append(b.rows, row)
+	b.size += int64(len(row.data))
+	if b.size <= b.limit {
+		return nil
+	}
+	return b.spill()
+}
+
+// 将内存中的行写入临时文件
+func (b *rowBuffer) spill() error {
+	if b.file == nil {
+		f, err := ioutil.TempFile(b.dir, b.prefix+"*.seg")
+		if err != nil {
+			return err
+		}
+		b.file = f
+		b.writer = bufio.NewWriter(f)
+		atomic.AddInt64(&b.stats.Transactions, 1)
+		log.Infof("[I] transaction spill to %s", f.Name())
+	}
+	header := make([]byte, 8)
+	for _, row := range b.rows {
+		binary.LittleEndian.PutUint32(header, uint32(len(row.data)))
+		binary.LittleEndian.PutUint32(header[4:], uint32(row.table))
+		if _, err := b.writer.Write(header); err != nil {
+			return err
+		}
+		if _, err := b.writer.Write(row.data); err != nil {
+			return err
+		}
+	}
+	if err := b.writer.Flush(); err != nil {
+		return err
+	}
+	atomic.AddInt64(&b.stats.Segments, 1)
+	atomic.AddInt64(&b.stats.Rows, int64(len(b.rows)))
+	atomic.AddInt64(&b.stats.Bytes, b.size+int64(8*len(b.rows)))
+	b.spilled += len(b.rows)
+	b.rows = nil
+	b.size = 0
+	return nil
+}
+
+// 总行数
+func (b *rowBuffer) len() int {
+	return b.spilled + len(b.rows)
+}
+
+// 是否已经溢出到文件
+func (b *rowBuffer) isSpilled() bool {
+	return b.file != nil
+}
+
+// 按顺序读取所有的行，每次最多n行，溢出的行直接从文件中流式读取
+func (b *rowBuffer) each(n int, f func(rows []bufferedRow) error) error {
+	batch := make([]bufferedRow, 0, n)
+	if b.file != nil {
+		if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		r := bufio.NewReader(b.file)
+		header := make([]byte, 8)
+		for i := 0; i < b.spilled; i++ {
+			if _, err := io.ReadFull(r, header); err != nil {
+				return err
+			}
+			row := make([]byte, binary.LittleEndian.Uint32(header))
+			if _, err := io.ReadFull(r, row); err != nil {
+				return err
+			}
+			batch = append(batch, bufferedRow{table: int(binary.LittleEndian.Uint32(header[4:])), data: row})
+			if len(batch) >= n {
+				if err := f(batch); err != nil {
+					return err
+				}
+				batch = make([]bufferedRow, 0, n)
+			}
+		}
+	}
+	for _, row := range b.rows {
+		batch = append(batch, row)
+		if len(batch) >= n {
+			if err := f(batch); err != nil {
+				return err
+			}
+			batch = make([]bufferedRow, 0, n)
+		}
+	}
+	if len(batch) > 0 {
+		return f(batch)
+	}
+	return nil
+}
+
+// 取出内存中的所有行，用于没有溢出时一次推送
+func (b *rowBuffer) take() []bufferedRow {
+	rows := b.rows
+	b.rows = nil
+	b.size = 0
+	return rows
+}
+
+// 丢弃所有的行，删除临时文件
+func (b *rowBuffer) close() {
+	b.rows = nil
+	b.size = 0
+	if b.file == nil {
+		return
+	}
+	name := b.file.Name()
+	b.file.Close()
+	if err := os.Remove(name); err != nil {
+		log.Warnf("[W] remove transaction spill file with error: %+v", err)
+	}
+	b.file = nil
+	b.writer = nil
+	b.spilled = 0
+}
+
+// 溢出的临时文件目录
+func (h *Binlog) spillDir() string {
+	if cfg := h.ctx.Config().Transaction; cfg != nil && cfg.SpillDir != "" {
+		return cfg.SpillDir
+	}
+	return os.TempDir()
+}
+
+// 溢出的临时文件名前缀，带上数据源名称，未命名的数据源为default
+func (h *Binlog) spillPrefix() string {
+	if h.name == "" {
+		return spillFilePrefix + "default-"
+	}
+	return spillFilePrefix + h.name + "-"
+}
+
+// 清理上次进程遗留的临时文件，这些事务会在重新同步时再次收到
+func (h *Binlog) cleanSpill() {
+	files, err := filepath.Glob(filepath.Join(h.spillDir(), h.spillPrefix()+"*.seg"))
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		log.Infof("[I] remove stale transaction spill file %s", file)
+		os.Remove(file)
+	}
+}
+
+// 溢出统计
+func (h *Binlog) spillStatus() *spillStats {
+	return &spillStats{
+		Transactions: atomic.LoadInt64(&h.spill.Transactions),
+		Segments:     atomic.LoadInt64(&h.spill.Segments),
+		Rows:         atomic.LoadInt64(&h.spill.Rows),
+		Bytes:        atomic.LoadInt64(&h.spill.Bytes),
+	}
+}
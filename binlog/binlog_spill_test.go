@@ -0,0 +1,127 @@
+package binlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// test row buffer
+// 超过内存限制时写入文件，读回时保持顺序
+func TestBinlog_RowBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copycat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stats := &spillStats{}
+	b := newRowBuffer(dir, spillFilePrefix, 10, stats)
+	for i := 0; i < 7; i++ {
+		if err = b.add(bufferedRow{table: i % 2, data: json.RawMessage(fmt.Sprintf(`{"id":%d}`, i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !b.isSpilled() || b.len() != 7 {
+		t.Fatalf("buffer should be spilled, rows: %d", b.len())
+	}
+	if stats.Transactions != 1 || stats.Rows == 0 || stats.Bytes == 0 {
+		t.Errorf("unexpected spill stats: %+v", stats)
+	}
+	rows := make([]string, 0)
+	tables := make([]int, 0)
+	batches := 0
+	err = b.each(3, func(batch []bufferedRow) error {
+		batches++
+		for _, row := range batch {
+			rows = append(rows, string(row.data))
+			tables = append(tables, row.table)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batches != 3 || len(rows) != 7 {
+		t.Fatalf("expect 3 batches and 7 rows, got %d, %d", batches, len(rows))
+	}
+	for i, row := range rows {
+		if row != fmt.Sprintf(`{"id":%d}`, i) || tables[i] != i%2 {
+			t.Errorf("row %d out of order: %s, table: %d", i, row, tables[i])
+		}
+	}
+	b.close()
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("spill file should be removed, got %v", files)
+	}
+}
+
+// test transaction spill
+// 溢出的事务提交时按顺序分块推送，丢弃时删除临时文件
+func TestBinlog_TransactionSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copycat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{
+		Database:    &g.DatabaseConfig{},
+		Transaction: &g.TransactionConfig{Enabled: true, BufferSize: 100, SpillDir: dir},
+	}, &events)
+	testOnRow(h, newTestRowsEvent("a", 5))
+	if len(events) != 0 {
+		t.Fatalf("rows should be buffered until xid, got %d events", len(events))
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, h.spillPrefix()+"*.seg")); len(files) != 1 {
+		t.Fatalf("expect 1 spill file, got %v", files)
+	}
+	h.onXID(txCommit{pos: mysql.Position{Name: "mysql-bin.000001", Pos: 300}})
+	if len(events) != 1 {
+		t.Fatalf("expect 1 chunk, got %d", len(events))
+	}
+	ed := events[0]["event"].(map[string]interface{})
+	if events[0]["event_type"] != eventTypeTransactionChunk || ed["last"] != true || ed["commit_pos"] != "mysql-bin.000001:300" {
+		t.Errorf("unexpected chunk: %+v", events[0])
+	}
+	rows := ed["rows"].([]interface{})
+	if len(rows) != 5 {
+		t.Fatalf("expect 5 rows, got %d", len(rows))
+	}
+	for i, row := range rows {
+		if row.(map[string]interface{})["row_index"] != float64(i) {
+			t.Errorf("row %d out of order: %+v", i, row)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("spill file should be removed after commit, got %v", files)
+	}
+	if s := h.spillStatus(); s.Transactions != 1 || s.Rows == 0 {
+		t.Errorf("unexpected spill stats: %+v", s)
+	}
+
+	// 丢弃的事务
+	testOnRow(h, newTestRowsEvent("a", 5))
+	h.discardTransaction()
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("spill file should be removed after discard, got %v", files)
+	}
+	h.onXID(txCommit{pos: mysql.Position{Name: "mysql-bin.000001", Pos: 400}})
+	if len(events) != 1 {
+		t.Errorf("discarded transaction should not be pushed, got %d events", len(events))
+	}
+
+	// 进程重启时清理遗留的临时文件
+	stale := filepath.Join(dir, h.spillPrefix()+"123.seg")
+	ioutil.WriteFile(stale, []byte("stale"), 0644)
+	h.cleanSpill()
+	if _, err = os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale spill file should be removed")
+	}
+}
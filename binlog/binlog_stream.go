@@ -0,0 +1,185 @@
+package binlog
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+	log "github.com/sirupsen/logrus"
+)
+
+// 实时同步的binlog流
+// canal会丢弃rows_query、annotate_rows事件，也不提供行事件的列位图和事件头，
+// 这里直接使用github.com/siddontang/go-mysql/replication读取binlog，和离线回放使用相同的事件处理，
+// canal只用于执行查询和缓存表结构
+
+// 从指定位置开始同步，gset不为空时从gtid集合开始，直到出错或者服务被停止
+func (h *Binlog) stream(pos mysql.Position, gset mysql.GTIDSet) error {
+	syncer := h.newSyncer()
+	h.lock.Lock()
+	h.syncer = syncer
+	h.lock.Unlock()
+	defer syncer.Close()
+	var (
+		s   *replication.BinlogStreamer
+		err error
+	)
+	if gset != nil {
+		s, err = syncer.StartSyncGTID(gset)
+	} else {
+		s, err = syncer.StartSync(pos)
+	}
+	if err != nil {
+		return err
+	}
+	file := pos.Name
+	for {
+		e, err := s.GetEvent(h.ctx.Ctx)
+		if err != nil {
+			return err
+		}
+		if e.Header.EventType != replication.HEARTBEAT_EVENT {
+			atomic.AddInt64(&h.streamEvents, 1)
+		}
+		if r, ok := e.Event.(*replication.RotateEvent); ok {
+			// gtid模式下第一个事件是伪造的rotate事件，给出开始的binlog文件
+			file = string(r.NextLogName)
+			log.Infof("[I] rotate binlog to %s:%d", file, r.Position)
+			if err = h.OnPosSynced(mysql.Position{Name: file, Pos: uint32(r.Position)}, true); err != nil {
+				return err
+			}
+			continue
+		}
+		save, err := h.handleEvent(file, e)
+		if err != nil {
+			return err
+		}
+		if save {
+			// 只在事务提交和ddl之后保存位置
+			if err = h.OnPosSynced(mysql.Position{Name: file, Pos: e.Header.LogPos}, true); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// 关闭实时同步的binlog流，正在读取的事件会返回错误
+func (h *Binlog) closeSyncer() {
+	h.lock.Lock()
+	syncer := h.syncer
+	h.syncer = nil
+	h.lock.Unlock()
+	if syncer != nil {
+		syncer.Close()
+	}
+}
+
+// 处理一个binlog事件，实时同步和离线回放共用
+// 返回true时事务已经结束，可以保存同步位置
+func (h *Binlog) handleEvent(file string, e *replication.BinlogEvent) (bool, error) {
+	pos := mysql.Position{Name: file, Pos: e.Header.LogPos}
+	switch ev := e.Event.(type) {
+	case *replication.FormatDescriptionEvent:
+		// 与master的server_id一致，用于ddl事件
+		h.serverID = e.Header.ServerID
+	case *replication.RowsEvent:
+		return false, h.handleRows(pos, e.Header, ev)
+	case *replication.RowsQueryEvent:
+		h.onRowsQuery(string(ev.Query))
+	case *replication.MariadbAnnotateRowsEvent:
+		h.onRowsQuery(string(ev.Query))
+	case *replication.XIDEvent:
+		if err := h.onXID(txCommit{pos: pos, xid: ev.XID, time: e.Header.Timestamp}); err != nil {
+			return false, err
+		}
+		return true, nil
+	case *replication.GTIDEvent:
+		gtid, err := mysql.ParseMysqlGTIDSet(fmt.Sprintf("%s:%d", sidString(ev.SID), ev.GNO))
+		if err != nil {
+			return false, err
+		}
+		return false, h.OnGTID(gtid)
+	case *replication.MariadbGTIDEvent:
+		gtid := ev.GTID
+		gtid.ServerID = e.Header.ServerID
+		gset, err := mysql.ParseMariadbGTIDSet(gtid.String())
+		if err != nil {
+			return false, err
+		}
+		return false, h.OnGTID(gset)
+	case *replication.QueryEvent:
+		// 非事务表的语句以query事件提交，之前的sql失效
+		h.onRowsQuery("")
+		switch strings.ToUpper(strings.TrimSpace(string(ev.Query))) {
+		case "ROLLBACK":
+			// 混合使用事务表和非事务表时，回滚的事务也会写入binlog
+			h.discardTransaction()
+			return false, nil
+		case "COMMIT":
+			// 非事务表的事务没有xid事件，以COMMIT语句提交，与xid事件一样推送事务并保存位置
+			if err := h.onXID(txCommit{pos: pos, time: e.Header.Timestamp}); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+		if action, _, _ := parseDDL(string(ev.Query)); action == "" {
+			return false, nil
+		}
+		if err := h.onDDL(pos, e.Header, ev); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// 处理行事件，被过滤的表和找不到表结构的表跳过
+func (h *Binlog) handleRows(pos mysql.Position, header *replication.EventHeader, ev *replication.RowsEvent) error {
+	h.countRowsEvent()
+	key := string(ev.Table.Schema) + "." + string(ev.Table.Table)
+	// 水位表用于单表增量快照，不受过滤规则影响
+	if key != h.watermarkTable() && !h.tableMatch(key) {
+		return nil
+	}
+	table, err := h.eventTable(key, pos)
+	if err != nil {
+		log.Warnf("[W] rows event of %s at %s skipped: %v", key, pos, err)
+		return nil
+	}
+	var action string
+	switch header.EventType {
+	case replication.WRITE_ROWS_EVENTv0, replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+		action = canal.InsertAction
+	case replication.DELETE_ROWS_EVENTv0, replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
+		action = canal.DeleteAction
+	case replication.UPDATE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+		action = canal.UpdateAction
+	default:
+		return nil
+	}
+	e := &canal.RowsEvent{Table: table, Action: action, Rows: ev.Rows, Header: header}
+	unsignedRows(table, e.Rows)
+	// binlog中有列位图，可以准确区分没有记录的列
+	return h.onRows(e, ev.ColumnBitmap1, ev.ColumnBitmap2)
+}
+
+// 行事件对应的表结构
+// 优先使用表结构历史中事件位置之前最近的版本，没有记录时使用canal缓存的当前表结构，
+// 离线回放时没有数据库连接，只能使用表结构快照
+func (h *Binlog) eventTable(key string, pos mysql.Position) (*schema.Table, error) {
+	if h.schemas != nil {
+		if t, ok := h.schemaAt(key, pos); ok {
+			return t, nil
+		}
+	}
+	handler := h.currentHandler()
+	if handler == nil {
+		return nil, fmt.Errorf("table not found in schema snapshot")
+	}
+	parts := strings.SplitN(key, ".", 2)
+	return handler.GetTable(parts[0], parts[1])
+}
@@ -0,0 +1,71 @@
+package binlog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// test live stream events
+// 实时同步直接处理binlog事件，行事件带上gtid，只在事务提交和ddl之后保存位置
+func TestBinlog_HandleEvent(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{Database: &g.DatabaseConfig{}}, &events)
+	h.schemas = newSchemaHistory(filepath.Join(os.TempDir(), "copycat-stream-schema-not-exist.json"))
+	h.schemas.add("test.a", &schemaVersion{File: "mysql-bin.000001", Pos: 4, Table: &schema.Table{
+		Schema:  "test",
+		Name:    "a",
+		Columns: []schema.TableColumn{{Name: "id", Type: schema.TYPE_NUMBER}, {Name: "name", Type: schema.TYPE_STRING}},
+	}})
+	h.gtidSet, _ = mysql.ParseMysqlGTIDSet("")
+	sid := []byte{0x3e, 0x11, 0xfa, 0x47, 0x71, 0xca, 0x11, 0xe1, 0x9e, 0x33, 0xc8, 0x0a, 0xa9, 0x42, 0x95, 0x62}
+	rows := newTestBinlogEvent(1555555555, 400, 50, &replication.RowsEvent{
+		Table:         &replication.TableMapEvent{Schema: []byte("test"), Table: []byte("a")},
+		ColumnBitmap1: []byte{0x01},
+		Rows:          [][]interface{}{{int32(1), nil}},
+	})
+	rows.Header.EventType = replication.WRITE_ROWS_EVENTv2
+	stream := []struct {
+		event *replication.BinlogEvent
+		save  bool
+	}{
+		{newTestBinlogEvent(1555555555, 200, 50, &replication.GTIDEvent{SID: sid, GNO: 5}), false},
+		{newTestBinlogEvent(1555555555, 300, 50, &replication.QueryEvent{Schema: []byte("test"), Query: []byte("BEGIN")}), false},
+		{rows, false},
+		{newTestBinlogEvent(1555555555, 450, 50, &replication.XIDEvent{XID: 7}), true},
+		{newTestBinlogEvent(1555555556, 550, 50, &replication.QueryEvent{Schema: []byte("test"), Query: []byte("ALTER TABLE a ADD COLUMN age INT")}), true},
+	}
+	for i, s := range stream {
+		save, err := h.handleEvent("mysql-bin.000001", s.event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if save != s.save {
+			t.Errorf("event %d expect save %v, got %v", i, s.save, save)
+		}
+	}
+	if len(events) != 2 {
+		t.Fatalf("expect a row event and a ddl event, got %d", len(events))
+	}
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	row := events[0]
+	if row["gtid"] != uuid+":5" || row["event_id"] != uuid+":5:0:0" || row["binlog_pos"] != float64(400) {
+		t.Errorf("row event source error: %+v", row)
+	}
+	// 行事件的列位图中没有记录name列
+	if missing, ok := row["event"].(map[string]interface{})["missing_columns"].([]interface{}); !ok || len(missing) != 1 || missing[0] != "name" {
+		t.Errorf("row event missing columns error: %+v", row)
+	}
+	if events[1]["event_type"] != eventTypeDDL {
+		t.Errorf("ddl event error: %+v", events[1])
+	}
+	if h.gtidSet.String() != uuid+":5" {
+		t.Errorf("gtid should be committed on xid, got %s", h.gtidSet.String())
+	}
+}
@@ -0,0 +1,332 @@
+package binlog
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// 从指定时间开始同步
+// 先读取master上每个binlog文件头部的时间，找到时间不晚于指定时间的最后一个文件，
+// 然后从头扫描该文件，找到第一个时间不早于指定时间的事务，从事务开始的位置同步
+// gtid模式下同时计算该位置之前已经执行的gtid集合
+// 定位时使用与同步相同的server_id，调用方需确保同步已经停止
+
+// 定位超时时间，只用于读取文件头部
+const locateHeaderTimeout = time.Second * 30
+
+// 定位之前等待同步停止的超时时间
+const locateStopTimeout = time.Second * 10
+
+// 时间格式，没有时区的时间使用配置的时区
+var startTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+}
+
+// ParseStartTime 解析起始时间，支持RFC3339和不带时区的时间，也支持unix时间戳
+func ParseStartTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	var ts int64
+	if _, err := fmt.Sscanf(s, "%d", &ts); err == nil && fmt.Sprintf("%d", ts) == s {
+		return time.Unix(ts, 0), nil
+	}
+	for _, layout := range startTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, g.Location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid start time %s", s)
+}
+
+// 从binlog事件中查找指定时间的位置
+type timeLocator struct {
+	start    uint32        // 指定的时间
+	gset     mysql.GTIDSet // 已经执行的gtid集合，非gtid模式为空
+	pending  string        // 当前事务的gtid
+	boundary bool          // 当前是否在事务之间
+	pos      uint32        // 找到的事务开始的位置
+}
+
+// 处理一个事件，找到指定时间的事务时返回true
+func (l *timeLocator) feed(e *replication.BinlogEvent) (bool, error) {
+	switch ev := e.Event.(type) {
+	case *replication.FormatDescriptionEvent:
+		l.boundary = true
+		return false, nil
+	case *replication.GenericEvent:
+		// 文件开始之前已经执行的gtid集合
+		if e.Header.EventType == replication.PREVIOUS_GTIDS_EVENT && l.gset != nil {
+			gset, err := mysql.DecodeMysqlGTIDSet(ev.Data)
+			if err != nil {
+				return false, err
+			}
+			l.gset = gset
+			return false, nil
+		}
+	case *replication.MariadbGTIDListEvent:
+		if l.gset != nil {
+			list := make([]string, 0, len(ev.GTIDs))
+			for i := range ev.GTIDs {
+				list = append(list, ev.GTIDs[i].String())
+			}
+			gset, err := mysql.ParseGTIDSet(mysql.MariaDBFlavor, strings.Join(list, ","))
+			if err != nil {
+				return false, err
+			}
+			l.gset = gset
+		}
+		return false, nil
+	case *replication.RotateEvent:
+		return false, nil
+	}
+	if e.Header.Timestamp == 0 {
+		// 心跳等没有时间的事件
+		return false, nil
+	}
+	if l.boundary && e.Header.Timestamp >= l.start {
+		l.pos = e.Header.LogPos - e.Header.EventSize
+		return true, nil
+	}
+	commit := false
+	switch ev := e.Event.(type) {
+	case *replication.GTIDEvent:
+		l.pending = fmt.Sprintf("%s:%d", sidString(ev.SID), ev.GNO)
+	case *replication.MariadbGTIDEvent:
+		gtid := ev.GTID
+		gtid.ServerID = e.Header.ServerID
+		l.pending = gtid.String()
+	case *replication.XIDEvent:
+		commit = true
+	case *replication.QueryEvent:
+		// 非事务表的BEGIN之后以COMMIT结束，ddl自身就是一个事务
+		commit = strings.ToUpper(strings.TrimSpace(string(ev.Query))) != "BEGIN"
+	}
+	l.boundary = commit
+	if commit && l.pending != "" {
+		if l.gset != nil {
+			if err := l.gset.Update(l.pending); err != nil {
+				return false, err
+			}
+		}
+		l.pending = ""
+	}
+	return false, nil
+}
+
+// 将16字节的server uuid格式化为字符串
+func sidString(sid []byte) string {
+	if len(sid) != 16 {
+		return fmt.Sprintf("%x", sid)
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sid[0:4], sid[4:6], sid[6:8], sid[8:10], sid[10:16])
+}
+
+// 查找指定时间开始的同步位置，gtid模式下同时返回该位置之前已经执行的gtid集合
+func (h *Binlog) locateTime(t time.Time) (mysql.Position, mysql.GTIDSet, error) {
+	handler := h.currentHandler()
+	masterPos, err := handler.GetMasterPos()
+	if err != nil {
+		return mysql.Position{}, nil, err
+	}
+	logs, err := h.binaryLogs()
+	if err != nil {
+		return mysql.Position{}, nil, err
+	}
+	start := uint32(t.Unix())
+	// 二分查找头部时间不晚于指定时间的最后一个文件
+	index := 0
+	lo, hi := 0, len(logs)-1
+	for lo <= hi {
+		mid := (lo + hi) / 2
+		ts, err := h.fileTime(logs[mid].name)
+		if err != nil {
+			return mysql.Position{}, nil, err
+		}
+		if ts <= start {
+			index = mid
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+	if index == 0 {
+		if ts, err := h.fileTime(logs[0].name); err == nil && ts > start {
+			log.Warnf("[W] the oldest binlog %s is later than %s, events before it have been purged", logs[0].name, t)
+		}
+	}
+	var gset mysql.GTIDSet
+	if h.isGTIDMode() {
+		// 文件头部的gtid集合会覆盖这里的空集合
+		if gset, err = mysql.ParseGTIDSet(h.flavor(), ""); err != nil {
+			return mysql.Position{}, nil, err
+		}
+	}
+	for i := index; i < len(logs); i++ {
+		l := &timeLocator{start: start, gset: gset}
+		found, err := h.scanFile(logs[i].name, masterPos, l)
+		if err != nil {
+			return mysql.Position{}, nil, err
+		}
+		if found {
+			return mysql.Position{Name: logs[i].name, Pos: l.pos}, l.gset, nil
+		}
+		gset = l.gset
+		if logs[i].name == masterPos.Name {
+			break
+		}
+	}
+	// 指定的时间之后没有事件，从master当前的位置开始
+	if h.isGTIDMode() {
+		if gset, err = handler.GetMasterGTIDSet(); err != nil {
+			return mysql.Position{}, nil, err
+		}
+	}
+	return masterPos, gset, nil
+}
+
+// 新的binlog读取句柄，使用与canal相同的连接配置
+// decimal解析为精确值，时间类型解析为time.Time，由fieldDecode统一格式化
+// mariadb需要在dump命令中请求annotate_rows事件
+func (h *Binlog) newSyncer() *replication.BinlogSyncer {
+	cfg := replication.BinlogSyncerConfig{
+		ServerID:        h.database().ServerID,
+		Flavor:          h.flavor(),
+		Host:            h.database().Host,
+		Port:            h.database().Port,
+		User:            h.database().User,
+		Password:        h.database().Password,
+		Charset:         h.database().Charset,
+		HeartbeatPeriod: time.Duration(h.database().HeartbeatPeriod),
+		ReadTimeout:     time.Duration(h.database().ReadTimeout),
+		UseDecimal:      true,
+		ParseTime:       true,
+	}
+	if cfg.Flavor == mysql.MariaDBFlavor {
+		cfg.DumpCommandFlag = replication.BINLOG_SEND_ANNOTATE_ROWS_EVENT
+	}
+	return replication.NewBinlogSyncer(cfg)
+}
+
+// 读取binlog文件头部的时间
+func (h *Binlog) fileTime(name string) (uint32, error) {
+	syncer := h.newSyncer()
+	defer syncer.Close()
+	streamer, err := syncer.StartSync(mysql.Position{Name: name, Pos: 4})
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(h.ctx.Ctx, locateHeaderTimeout)
+	defer cancel()
+	for {
+		e, err := streamer.GetEvent(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := e.Event.(*replication.FormatDescriptionEvent); ok {
+			return e.Header.Timestamp, nil
+		}
+	}
+}
+
+// 从头扫描一个binlog文件，直到找到指定时间的事务、文件结束或者到达master当前的位置
+func (h *Binlog) scanFile(name string, masterPos mysql.Position, l *timeLocator) (bool, error) {
+	syncer := h.newSyncer()
+	defer syncer.Close()
+	streamer, err := syncer.StartSync(mysql.Position{Name: name, Pos: 4})
+	if err != nil {
+		return false, err
+	}
+	events := 0
+	defer func() {
+		log.Debugf("[D] scan binlog %s, events: %d", name, events)
+	}()
+	for {
+		e, err := streamer.GetEvent(h.ctx.Ctx)
+		if err != nil {
+			return false, err
+		}
+		events++
+		if r, ok := e.Event.(*replication.RotateEvent); ok && string(r.NextLogName) != name {
+			// 文件结束
+			return false, nil
+		}
+		found, err := l.feed(e)
+		if found || err != nil {
+			return found, err
+		}
+		if name == masterPos.Name && e.Header.LogPos >= masterPos.Pos {
+			return false, nil
+		}
+	}
+}
+
+// StartFromTime 从指定时间开始同步
+// 停止同步后定位并保存新的位置，之前在运行时重新开始同步，返回定位到的位置
+// 定位使用的dump连接与同步使用相同的server_id，master会断开server_id相同的旧连接，
+// 同步没有停止时不能定位，否则同步会被断开后在旧的位置重连，并覆盖新保存的位置
+func (h *Binlog) StartFromTime(t time.Time) (map[string]interface{}, error) {
+	h.statusLock.Lock()
+	running := h.status&binlogIsRunning > 0
+	h.statusLock.Unlock()
+	if running {
+		h.lock.Lock()
+		done := h.runDone
+		h.lock.Unlock()
+		h.StopService(false)
+		defer h.StartService()
+		if done != nil {
+			select {
+			case <-done:
+			case <-time.After(locateStopTimeout):
+				log.Errorf("[E] wait binlog service stop timeout, start from time aborted")
+				return nil, fmt.Errorf("binlog service is not stopped in %v, try again later", locateStopTimeout)
+			}
+		}
+	}
+	pos, gset, err := h.locateTime(t)
+	if err != nil {
+		return nil, err
+	}
+	h.setStartPosition(pos, gset)
+	h.lock.Lock()
+	h.acks = nil
+	r := packPos(h.lastBinFile, int64(h.lastPos), atomic.LoadInt64(&h.EventIndex), h.gtidString())
+	h.lock.Unlock()
+	h.saveCheckpoint(r)
+	h.flushCheckpoint()
+	res := map[string]interface{}{
+		"binlog_file": pos.Name,
+		"binlog_pos":  pos.Pos,
+	}
+	if gset != nil {
+		res["gtid_set"] = gset.String()
+	}
+	return res, nil
+}
+
+// 设置同步开始的位置
+func (h *Binlog) setStartPosition(pos mysql.Position, gset mysql.GTIDSet) {
+	h.lock.Lock()
+	h.lastBinFile = pos.Name
+	h.lastPos = pos.Pos
+	if gset != nil {
+		h.gtidSet = gset
+	}
+	h.lock.Unlock()
+	if gset != nil {
+		log.Infof("[I] binlog start from %s:%d, gtid set: %s", pos.Name, pos.Pos, gset.String())
+	} else {
+		log.Infof("[I] binlog start from %s:%d", pos.Name, pos.Pos)
+	}
+}
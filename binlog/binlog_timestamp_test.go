@@ -0,0 +1,98 @@
+package binlog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// test start time parsing
+func TestBinlog_ParseStartTime(t *testing.T) {
+	expect := time.Date(2019, 4, 1, 14, 5, 0, 0, g.Location)
+	for _, s := range []string{"2019-04-01 14:05:00", "2019-04-01T14:05:00", "2019-04-01 14:05", expect.Format(time.RFC3339)} {
+		ts, err := ParseStartTime(s)
+		if err != nil {
+			t.Fatalf("parse %s with error: %+v", s, err)
+		}
+		if !ts.Equal(expect) {
+			t.Errorf("parse %s expect %s, got %s", s, expect, ts)
+		}
+	}
+	if ts, err := ParseStartTime("1554098700"); err != nil || ts.Unix() != 1554098700 {
+		t.Errorf("parse unix timestamp got %s, %+v", ts, err)
+	}
+	if _, err := ParseStartTime("yesterday"); err == nil {
+		t.Errorf("parse invalid time should fail")
+	}
+}
+
+func newTestBinlogEvent(ts, logPos, size uint32, ev replication.Event) *replication.BinlogEvent {
+	return &replication.BinlogEvent{
+		Header: &replication.EventHeader{Timestamp: ts, LogPos: logPos, EventSize: size},
+		Event:  ev,
+	}
+}
+
+// test locating a point in time
+// 定位到事务开始的位置，并计算之前已经执行的gtid集合
+func TestBinlog_TimeLocator(t *testing.T) {
+	sid := []byte{0x3e, 0x11, 0xfa, 0x47, 0x71, 0xca, 0x11, 0xe1, 0x9e, 0x33, 0xc8, 0x0a, 0xa9, 0x42, 0x95, 0x62}
+	uuid := "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	if s := sidString(sid); s != uuid {
+		t.Fatalf("expect sid %s, got %s", uuid, s)
+	}
+	previous, _ := mysql.ParseGTIDSet(mysql.MySQLFlavor, uuid+":1-10")
+	events := []*replication.BinlogEvent{
+		newTestBinlogEvent(0, 0, 0, &replication.RotateEvent{NextLogName: []byte("mysql-bin.000002")}),
+		newTestBinlogEvent(100, 120, 120, &replication.FormatDescriptionEvent{}),
+		{
+			Header: &replication.EventHeader{Timestamp: 100, LogPos: 191, EventSize: 71, EventType: replication.PREVIOUS_GTIDS_EVENT},
+			Event:  &replication.GenericEvent{Data: previous.Encode()},
+		},
+		// 第一个事务，早于指定时间
+		newTestBinlogEvent(200, 250, 59, &replication.GTIDEvent{SID: sid, GNO: 11}),
+		newTestBinlogEvent(200, 300, 50, &replication.QueryEvent{Query: []byte("BEGIN")}),
+		newTestBinlogEvent(200, 400, 100, &replication.RowsEvent{}),
+		newTestBinlogEvent(200, 431, 31, &replication.XIDEvent{}),
+		// 第二个事务，事务中的行事件晚于指定时间，但事务开始早于指定时间
+		newTestBinlogEvent(290, 490, 59, &replication.GTIDEvent{SID: sid, GNO: 12}),
+		newTestBinlogEvent(290, 540, 50, &replication.QueryEvent{Query: []byte("BEGIN")}),
+		newTestBinlogEvent(310, 640, 100, &replication.RowsEvent{}),
+		newTestBinlogEvent(310, 671, 31, &replication.XIDEvent{}),
+		// 第三个事务，从这里开始
+		newTestBinlogEvent(320, 730, 59, &replication.GTIDEvent{SID: sid, GNO: 13}),
+	}
+	empty, _ := mysql.ParseGTIDSet(mysql.MySQLFlavor, "")
+	l := &timeLocator{start: 300, gset: empty}
+	found := false
+	for _, e := range events {
+		ok, err := l.feed(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Fatalf("position should be found")
+	}
+	if l.pos != 671 {
+		t.Errorf("expect pos 671, got %d", l.pos)
+	}
+	if s := l.gset.String(); s != uuid+":1-12" {
+		t.Errorf("expect gtid set %s:1-12, got %s", uuid, s)
+	}
+	// 位置模式不计算gtid
+	l = &timeLocator{start: 1000}
+	for _, e := range events {
+		if ok, err := l.feed(e); ok || err != nil {
+			t.Fatalf("position should not be found, %+v", err)
+		}
+	}
+}
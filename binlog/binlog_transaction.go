@@ -0,0 +1,273 @@
+package binlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// 事务分组推送
+// 开启后行事件先缓存，直到xid事件（或者非事务表的COMMIT语句）时整体推送，事务涉及的每个表推送一个事件，
+// 这些事件带上相同的事务id和提交信息，主题仍然是各自的库名和表名，消费者可以按事务id整体应用一个事务
+// 事务的行数超过max_rows时退化为分块推送，每个分块带上事务id和表内的序号，每个表最后一个分块带上提交位置
+const (
+	eventTypeTransaction      = "transaction"
+	eventTypeTransactionChunk = "transaction_chunk"
+)
+
+// 正在进行中的事务
+type transaction struct {
+	id       string         // 事务id，为第一个行事件的binlog位置，如mysql-bin.000001:1234
+	key      string         // 事件id前缀，有gtid时为gtid，否则为server_id和事务id
+	serverID uint32         // 第一个行事件的server_id
+	gtid     string         // 事务的gtid，非gtid模式下为空
+	pos      mysql.Position // 第一个行事件的位置
+	rows     *rowBuffer     // 缓存的行事件，按binlog顺序，超过内存限制时溢出到磁盘
+	tables   []*txTable     // 事务涉及的表，按第一次出现的顺序
+	chunked  bool           // 是否已经分块推送过
+	time     uint32         // 最后一个行事件的时间戳
+}
+
+// 事务涉及的一个表，每个表单独推送，主题过滤按真实的库名和表名
+type txTable struct {
+	database string
+	table    string
+	seq      int // 这个表已经推送的分块数量
+}
+
+// 事务的提交信息，来自xid事件
+// 非事务表的提交没有xid，以COMMIT语句提交时只有提交位置和时间，新事务开始时推送上一个事务则为零值
+type txCommit struct {
+	pos  mysql.Position // 提交位置
+	xid  uint64         // xid事件中的事务号
+	time uint32         // 提交事件的时间戳，即事务提交的时间
+}
+
+// 是否开启了事务分组推送
+func (h *Binlog) isTransactionMode() bool {
+	cfg := h.ctx.Config().Transaction
+	return cfg != nil && cfg.Enabled
+}
+
+// 推送行事件
+// 事务分组推送模式下先缓存，超过max_rows时推送已缓存的行
+func (h *Binlog) emit(e *canal.RowsEvent, row map[string]interface{}) {
+	if !h.isTransactionMode() {
+		h.notify(row)
+		return
+	}
+	cfg := h.ctx.Config().Transaction
+	h.lock.Lock()
+	if h.tx == nil {
+		h.tx = h.newTransaction(e, row)
+	}
+	tx := h.tx
+	if err := tx.add(row, e.Header.Timestamp); err != nil {
+		// 写入磁盘失败时继续缓存在内存中
+		log.Errorf("[E] transaction %s spill with error: %+v", tx.id, err)
+	}
+	var rows *rowBuffer
+	if max := cfg.MaxRows; max > 0 && tx.rows.len() >= max {
+		// 已缓存的行交给分块推送，后续的行写入新的缓存
+		rows = tx.rows
+		tx.rows = newRowBuffer(h.spillDir(), h.spillPrefix(), cfg.BufferSize, &h.spill)
+		tx.chunked = true
+	}
+	h.lock.Unlock()
+	if rows == nil {
+		return
+	}
+	defer rows.close()
+	if err := h.sendChunks(tx, rows, cfg.MaxRows, nil); err != nil {
+		log.Errorf("[E] transaction %s read spilled rows with error: %+v", tx.id, err)
+	}
+}
+
+// 开始一个事务，row为第一个行事件，已经带上了server_id和gtid
+func (h *Binlog) newTransaction(e *canal.RowsEvent, row map[string]interface{}) *transaction {
+	tx := &transaction{
+		serverID: e.Header.ServerID,
+		pos:      mysql.Position{Name: h.lastBinFile, Pos: e.Header.LogPos - e.Header.EventSize},
+		rows:     newRowBuffer(h.spillDir(), h.spillPrefix(), h.ctx.Config().Transaction.BufferSize, &h.spill),
+	}
+	tx.id = fmt.Sprintf("%s:%d", tx.pos.Name, tx.pos.Pos)
+	tx.gtid, _ = row["gtid"].(string)
+	if tx.gtid != "" {
+		tx.key = h.eventID(tx.gtid)
+	} else {
+		tx.key = h.eventID(tx.serverID, tx.id)
+	}
+	return tx
+}
+
+// 提交事务，每个表推送一个事件，带上相同的事务id和提交信息
+// c为提交信息，非事务表的提交没有xid，此时c中只有提交位置或者为零值
+// 已经分块推送过或者溢出到磁盘的事务，按顺序分块推送剩下的行，每个表最后一个分块带上提交信息
+func (h *Binlog) commitTransaction(c txCommit) {
+	h.lock.Lock()
+	tx := h.tx
+	h.tx = nil
+	h.lock.Unlock()
+	if tx == nil {
+		return
+	}
+	defer tx.rows.close()
+	if !tx.chunked && !tx.rows.isSpilled() {
+		groups := tx.group(tx.rows.take())
+		for i, t := range tx.tables {
+			h.notify(tx.envelope(eventTypeTransaction, t, tx.event(c, groups[i], true), c, t.database+"."+t.table))
+		}
+		return
+	}
+	size := h.ctx.Config().Transaction.MaxRows
+	if size <= 0 {
+		size = spillDefaultChunkRows
+	}
+	if err := h.sendChunks(tx, tx.rows, size, &c); err != nil {
+		log.Errorf("[E] transaction %s read spilled rows with error: %+v", tx.id, err)
+	}
+}
+
+// 按顺序分块推送rows中的行，每次最多读取size行，按表拆分成多个分块
+// c不为nil时为提交，每个表保留最后一个分块，读完后带上提交信息推送，已经全部推送过的表推送一个空的最后分块
+func (h *Binlog) sendChunks(tx *transaction, rows *rowBuffer, size int, c *txCommit) error {
+	held := make([][]json.RawMessage, len(tx.tables))
+	err := rows.each(size, func(batch []bufferedRow) error {
+		for i, group := range tx.group(batch) {
+			if group == nil {
+				continue
+			}
+			if c == nil {
+				h.notify(tx.chunk(i, group, false, txCommit{}))
+				continue
+			}
+			if held[i] != nil {
+				h.notify(tx.chunk(i, held[i], false, txCommit{}))
+			}
+			held[i] = group
+		}
+		return nil
+	})
+	if err != nil || c == nil {
+		return err
+	}
+	for i, group := range held {
+		if group == nil {
+			group = make([]json.RawMessage, 0)
+		}
+		h.notify(tx.chunk(i, group, true, *c))
+	}
+	return nil
+}
+
+// 丢弃正在进行中的事务，事务回滚或者重新同步时调用
+func (h *Binlog) discardTransaction() {
+	h.lock.Lock()
+	tx := h.tx
+	h.tx = nil
+	h.lock.Unlock()
+	if tx != nil {
+		log.Debugf("[D] transaction %s discarded, rows: %d", tx.id, tx.rows.len())
+		tx.rows.close()
+	}
+}
+
+// 缓存一个行事件，记录行所在的表
+func (tx *transaction) add(row map[string]interface{}, timestamp uint32) error {
+	database, _ := row["database"].(string)
+	table, _ := row["table"].(string)
+	index := -1
+	for i, t := range tx.tables {
+		if t.database == database && t.table == table {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		index = len(tx.tables)
+		tx.tables = append(tx.tables, &txTable{database: database, table: table})
+	}
+	tx.time = timestamp
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	return tx.rows.add(bufferedRow{table: index, data: data})
+}
+
+// 按表分组，返回值按表的序号排列，没有行的表为nil
+func (tx *transaction) group(rows []bufferedRow) [][]json.RawMessage {
+	groups := make([][]json.RawMessage, len(tx.tables))
+	for _, row := range rows {
+		groups[row.table] = append(groups[row.table], row.data)
+	}
+	return groups
+}
+
+// 构造一个表的分块，只有最后一个分块带上提交信息
+func (tx *transaction) chunk(index int, rows []json.RawMessage, last bool, c txCommit) map[string]interface{} {
+	t := tx.tables[index]
+	ed := tx.event(c, rows, last)
+	ed["seq"] = t.seq
+	ed["last"] = last
+	res := tx.envelope(eventTypeTransactionChunk, t, ed, c, t.database+"."+t.table, t.seq)
+	t.seq++
+	return res
+}
+
+// 事务事件内容
+// 有提交位置时带上commit_pos和提交时间commit_time，有xid时带上事务号xid
+// 提交时带上事务涉及的所有表tables，消费者据此等待同一个事务的其他表
+func (tx *transaction) event(c txCommit, rows []json.RawMessage, commit bool) map[string]interface{} {
+	ed := make(map[string]interface{})
+	ed["transaction_id"] = tx.id
+	ed["rows"] = rows
+	if c.pos.Name != "" {
+		ed["commit_pos"] = fmt.Sprintf("%s:%d", c.pos.Name, c.pos.Pos)
+		ed["commit_time"] = c.time
+	}
+	if c.xid != 0 {
+		ed["xid"] = c.xid
+	}
+	if commit {
+		tables := make([]string, 0, len(tx.tables))
+		for _, t := range tx.tables {
+			tables = append(tables, t.database+"."+t.table)
+		}
+		ed["tables"] = tables
+	}
+	return ed
+}
+
+// 事务事件外层结构，与行事件保持一致，database和table用于主题过滤
+// binlog_file和binlog_pos为提交位置，还没有提交时为事务开始的位置
+// event_id为事务的gtid（或者server_id和事务id）加上表名，分块时再加上分块序号
+func (tx *transaction) envelope(eventType string, t *txTable, ed map[string]interface{}, c txCommit, parts ...interface{}) map[string]interface{} {
+	log.Debugf("[D] transaction %s, %s.%s, seq: %d", tx.id, t.database, t.table, t.seq)
+	data := make(map[string]interface{})
+	data["database"] = t.database
+	data["event_type"] = eventType
+	data["time"] = tx.time
+	data["table"] = t.table
+	data["event"] = ed
+	ids := []string{tx.key}
+	for _, p := range parts {
+		ids = append(ids, fmt.Sprint(p))
+	}
+	data["event_id"] = strings.Join(ids, ":")
+	data["server_id"] = tx.serverID
+	pos := tx.pos
+	if c.pos.Name != "" {
+		pos = c.pos
+	}
+	data["binlog_file"] = pos.Name
+	data["binlog_pos"] = pos.Pos
+	if tx.gtid != "" {
+		data["gtid"] = tx.gtid
+	}
+	return data
+}
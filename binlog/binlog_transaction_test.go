@@ -0,0 +1,215 @@
+package binlog
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+
+	"github.com/mia0x75/copycat/g"
+	"github.com/mia0x75/copycat/services"
+)
+
+// 创建一个用于测试的binlog对象，推送的事件写入events
+func newTestBinlog(cfg *g.GlobalConfig, events *[]map[string]interface{}) *Binlog {
+	ctx := &g.Context{}
+	ctx.SetConfig(cfg)
+	return &Binlog{
+		lock:        new(sync.Mutex),
+		statusLock:  new(sync.Mutex),
+		ctx:         ctx,
+		lastBinFile: "mysql-bin.000001",
+		onEvent: []OnEventFunc{func(table string, data []byte) {
+			var raw map[string]interface{}
+			json.Unmarshal(data, &raw)
+			*events = append(*events, raw)
+		}},
+	}
+}
+
+func newTestRowsEvent(table string, rows int) *canal.RowsEvent {
+	e := &canal.RowsEvent{
+		Table: &schema.Table{
+			Schema:  "test",
+			Name:    table,
+			Columns: []schema.TableColumn{{Name: "id", Type: schema.TYPE_NUMBER}},
+		},
+		Action: canal.InsertAction,
+		Header: &replication.EventHeader{Timestamp: 1555555555, LogPos: 200, EventSize: 50},
+	}
+	for i := 0; i < rows; i++ {
+		e.Rows = append(e.Rows, []interface{}{int32(i)})
+	}
+	return e
+}
+
+// 推送一个行事件，与实时同步和离线回放中的行事件一样先计数
+func testOnRow(h *Binlog, e *canal.RowsEvent) error {
+	h.countRowsEvent()
+	return h.onRows(e, nil, nil)
+}
+
+// test transaction mode
+// 事务分组推送，提交时每个表推送一个事件，带上相同的事务信息
+func TestBinlog_TransactionMode(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{
+		Database:    &g.DatabaseConfig{},
+		Transaction: &g.TransactionConfig{Enabled: true},
+	}, &events)
+	testOnRow(h, newTestRowsEvent("a", 2))
+	testOnRow(h, newTestRowsEvent("b", 1))
+	if len(events) != 0 {
+		t.Fatalf("rows should be buffered until xid, got %d events", len(events))
+	}
+	xid := &replication.BinlogEvent{
+		Header: &replication.EventHeader{Timestamp: 1555555556, LogPos: 300},
+		Event:  &replication.XIDEvent{XID: 42},
+	}
+	if _, err := h.handleEvent("mysql-bin.000001", xid); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expect 2 transaction events, got %d", len(events))
+	}
+	for i, table := range []string{"a", "b"} {
+		ev := events[i]
+		if ev["event_type"] != eventTypeTransaction || ev["database"] != "test" || ev["table"] != table {
+			t.Errorf("transaction envelope error: %+v", ev)
+		}
+		if ev["event_id"] != "0:mysql-bin.000001:150:test."+table || ev["binlog_file"] != "mysql-bin.000001" || ev["binlog_pos"] != float64(300) {
+			t.Errorf("transaction source error: %+v", ev)
+		}
+		ed := ev["event"].(map[string]interface{})
+		if ed["transaction_id"] != "mysql-bin.000001:150" || ed["commit_pos"] != "mysql-bin.000001:300" {
+			t.Errorf("transaction id error: %+v", ed)
+		}
+		if ed["xid"] != float64(42) || ed["commit_time"] != float64(1555555556) {
+			t.Errorf("transaction commit error: %+v", ed)
+		}
+		if tables := ed["tables"].([]interface{}); len(tables) != 2 || tables[0] != "test.a" || tables[1] != "test.b" {
+			t.Errorf("transaction tables error: %+v", ed["tables"])
+		}
+		rows := ed["rows"].([]interface{})
+		if len(rows) != 2-i {
+			t.Errorf("transaction rows error: %+v", rows)
+		}
+		for _, row := range rows {
+			if row.(map[string]interface{})["table"] != table {
+				t.Errorf("row of another table: %+v", row)
+			}
+		}
+	}
+}
+
+// test transaction route
+// 订阅了一个表的客户端只收到这个表的行，事务提交信息相同
+func TestBinlog_TransactionRoute(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{
+		Database:    &g.DatabaseConfig{},
+		Transaction: &g.TransactionConfig{Enabled: true, MaxRows: 3},
+	}, &events)
+	filters := []string{`^test\.a$`}
+	received := make([]map[string]interface{}, 0)
+	h.onEvent = append(h.onEvent, func(table string, data []byte) {
+		if !services.MatchFilters(filters, table) {
+			return
+		}
+		var raw map[string]interface{}
+		json.Unmarshal(data, &raw)
+		received = append(received, raw)
+	})
+	testOnRow(h, newTestRowsEvent("a", 1))
+	testOnRow(h, newTestRowsEvent("b", 2))
+	testOnRow(h, newTestRowsEvent("a", 1))
+	h.onXID(txCommit{pos: mysql.Position{Name: "mysql-bin.000001", Pos: 300}})
+	if len(received) != 2 {
+		t.Fatalf("expect 2 chunks of test.a, got %d", len(received))
+	}
+	rows := 0
+	for i, ev := range received {
+		ed := ev["event"].(map[string]interface{})
+		if ev["table"] != "a" || int(ed["seq"].(float64)) != i || ed["last"] != (i == 1) {
+			t.Errorf("chunk of test.a error: %+v", ev)
+		}
+		for _, row := range ed["rows"].([]interface{}) {
+			if row.(map[string]interface{})["table"] != "a" {
+				t.Errorf("row of another table: %+v", row)
+			}
+			rows++
+		}
+	}
+	if rows != 2 {
+		t.Errorf("expect 2 rows of test.a, got %d", rows)
+	}
+	last := received[1]["event"].(map[string]interface{})
+	if last["commit_pos"] != "mysql-bin.000001:300" || len(last["tables"].([]interface{})) != 2 {
+		t.Errorf("last chunk should carry the commit info: %+v", last)
+	}
+	// 另一个表的行已经全部推送过，最后一个分块为空，带上相同的提交信息
+	ed := events[len(events)-1]["event"].(map[string]interface{})
+	if events[len(events)-1]["table"] != "b" || ed["last"] != true || ed["transaction_id"] != last["transaction_id"] || ed["commit_pos"] != last["commit_pos"] {
+		t.Errorf("last chunk of test.b error: %+v", events[len(events)-1])
+	}
+}
+
+// test commit query
+// 非事务表以COMMIT语句提交，推送事务并保存位置
+func TestBinlog_TransactionCommitQuery(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{
+		Database:    &g.DatabaseConfig{},
+		Transaction: &g.TransactionConfig{Enabled: true},
+	}, &events)
+	testOnRow(h, newTestRowsEvent("a", 2))
+	commit := &replication.BinlogEvent{
+		Header: &replication.EventHeader{Timestamp: 1555555556, LogPos: 300},
+		Event:  &replication.QueryEvent{Schema: []byte("test"), Query: []byte("COMMIT")},
+	}
+	save, err := h.handleEvent("mysql-bin.000001", commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !save {
+		t.Errorf("position should be saved after commit")
+	}
+	if len(events) != 1 {
+		t.Fatalf("expect 1 transaction event, got %d", len(events))
+	}
+	ed := events[0]["event"].(map[string]interface{})
+	if ed["commit_pos"] != "mysql-bin.000001:300" || ed["commit_time"] != float64(1555555556) {
+		t.Errorf("transaction commit error: %+v", ed)
+	}
+	if _, ok := ed["xid"]; ok {
+		t.Errorf("commit query has no xid: %+v", ed)
+	}
+}
+
+// test transaction mode with max rows
+// 超过max_rows时分块推送
+func TestBinlog_TransactionChunk(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{
+		Database:    &g.DatabaseConfig{},
+		Transaction: &g.TransactionConfig{Enabled: true, MaxRows: 2},
+	}, &events)
+	testOnRow(h, newTestRowsEvent("a", 5))
+	h.onXID(txCommit{pos: mysql.Position{Name: "mysql-bin.000001", Pos: 300}})
+	if len(events) != 3 {
+		t.Fatalf("expect 3 chunks, got %d", len(events))
+	}
+	for i, ev := range events {
+		ed := ev["event"].(map[string]interface{})
+		if ev["event_type"] != eventTypeTransactionChunk || ev["table"] != "a" {
+			t.Errorf("chunk envelope error: %+v", ev)
+		}
+		if int(ed["seq"].(float64)) != i || ed["last"] != (i == 2) {
+			t.Errorf("chunk seq error: %+v", ed)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package binlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// Transformer 事件转换
+// 行事件在序列化之前按注册顺序经过所有的Transformer
+// 返回的事件交给下一个Transformer，返回多个事件即拆分，返回空即丢弃
+// 返回的事件必须包含字符串类型的database和table，用于主题过滤
+type Transformer interface {
+	Transform(event map[string]interface{}) ([]map[string]interface{}, error)
+}
+
+// TransformerFunc 函数形式的Transformer
+type TransformerFunc func(event map[string]interface{}) ([]map[string]interface{}, error)
+
+// Transform 实现Transformer接口
+func (f TransformerFunc) Transform(event map[string]interface{}) ([]map[string]interface{}, error) {
+	return f(event)
+}
+
+// Transform set event transformer
+// 注册事件转换，按注册顺序执行
+func Transform(t Transformer) Option {
+	return func(h *Binlog) {
+		h.transformers = append(h.transformers, t)
+	}
+}
+
+// 转换出错时的处理策略
+const (
+	transformErrorSkip       = "skip"        // 丢弃出错的事件，默认
+	transformErrorHalt       = "halt"        // 停止同步，从最后保存的位置重新开始时会再次收到该事件
+	transformErrorDeadLetter = "dead_letter" // 写入死信文件后丢弃
+)
+
+// 执行事件转换
+// 返回error时停止同步
+func (h *Binlog) transform(event map[string]interface{}) ([]map[string]interface{}, error) {
+	events := []map[string]interface{}{event}
+	for i, t := range h.transformers {
+		next := make([]map[string]interface{}, 0)
+		for _, ev := range events {
+			res, err := t.Transform(ev)
+			if err == nil {
+				err = checkTransformed(res)
+			}
+			if err != nil {
+				if err = h.transformError(i, ev, err); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			next = append(next, res...)
+		}
+		events = next
+	}
+	return events, nil
+}
+
+// 转换后的事件需要能被推送
+func checkTransformed(events []map[string]interface{}) error {
+	for _, ev := range events {
+		if ev == nil {
+			return fmt.Errorf("transformed event is nil")
+		}
+		if _, ok := ev["database"].(string); !ok {
+			return fmt.Errorf("transformed event without database")
+		}
+		if _, ok := ev["table"].(string); !ok {
+			return fmt.Errorf("transformed event without table")
+		}
+	}
+	return nil
+}
+
+// 转换错误策略为halt时的错误，重连后会再次收到同一个事件，不再重试
+type transformHaltError struct {
+	index int
+	err   error
+}
+
+func (e *transformHaltError) Error() string {
+	return fmt.Sprintf("transformer %d: %v, fix the transformer or the error policy before resume", e.index, e.err)
+}
+
+// 按配置的策略处理转换错误，返回error时停止同步
+func (h *Binlog) transformError(index int, event map[string]interface{}, err error) error {
+	policy := transformErrorSkip
+	file := g.DEAD_LETTER_FILE
+	if cfg := h.ctx.Config().Transform; cfg != nil {
+		if cfg.ErrorPolicy != "" {
+			policy = cfg.ErrorPolicy
+		}
+		if cfg.DeadLetterFile != "" {
+			file = cfg.DeadLetterFile
+		}
+	}
+	switch policy {
+	case transformErrorHalt:
+		log.Errorf("[E] transformer %d with error, halt: %+v", index, err)
+		return &transformHaltError{index: index, err: err}
+	case transformErrorDeadLetter:
+		if werr := writeDeadLetter(file, index, event, err); werr != nil {
+			// 死信写入失败时停止同步，避免丢失事件
+			log.Errorf("[E] write dead letter with error: %+v", werr)
+			return werr
+		}
+		log.Warnf("[W] transformer %d with error, write to dead letter: %+v", index, err)
+	default:
+		log.Warnf("[W] transformer %d with error, skip event: %+v", index, err)
+	}
+	return nil
+}
+
+// 死信文件每行一个json，包含错误信息和出错时的事件
+func writeDeadLetter(file string, index int, event map[string]interface{}, err error) error {
+	data, jerr := json.Marshal(map[string]interface{}{
+		"time":        time.Now().Unix(),
+		"transformer": index,
+		"error":       err.Error(),
+		"event":       event,
+	})
+	if jerr != nil {
+		return jerr
+	}
+	f, ferr := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if ferr != nil {
+		return ferr
+	}
+	defer f.Close()
+	_, ferr = f.Write(append(data, '\n'))
+	return ferr
+}
@@ -0,0 +1,76 @@
+package binlog
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// test transformer chain
+func TestBinlog_Transform(t *testing.T) {
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{Database: &g.DatabaseConfig{}}, &events)
+	// 拆分为两个事件
+	Transform(TransformerFunc(func(ev map[string]interface{}) ([]map[string]interface{}, error) {
+		cp := make(map[string]interface{})
+		for k, v := range ev {
+			cp[k] = v
+		}
+		cp["table"] = "copy"
+		return []map[string]interface{}{ev, cp}, nil
+	}))(h)
+	// 丢弃第一行，其他的加上计算列
+	Transform(TransformerFunc(func(ev map[string]interface{}) ([]map[string]interface{}, error) {
+		if ev["row_index"] == 0 {
+			return nil, nil
+		}
+		ev["source_table"] = "test." + ev["table"].(string)
+		return []map[string]interface{}{ev}, nil
+	}))(h)
+	if err := testOnRow(h, newTestRowsEvent("a", 2)); err != nil {
+		t.Fatalf("on row error: %+v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expect 2 events, got %d", len(events))
+	}
+	if events[0]["source_table"] != "test.a" || events[1]["source_table"] != "test.copy" {
+		t.Errorf("transformed events error: %+v", events)
+	}
+}
+
+// test transformer error policy
+func TestBinlog_TransformError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copycat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "dead_letter.log")
+	failed := TransformerFunc(func(ev map[string]interface{}) ([]map[string]interface{}, error) {
+		return nil, errors.New("bad event")
+	})
+	for _, policy := range []string{transformErrorSkip, transformErrorHalt, transformErrorDeadLetter} {
+		events := make([]map[string]interface{}, 0)
+		h := newTestBinlog(&g.GlobalConfig{
+			Database:  &g.DatabaseConfig{},
+			Transform: &g.TransformConfig{ErrorPolicy: policy, DeadLetterFile: file},
+		}, &events)
+		Transform(failed)(h)
+		err := testOnRow(h, newTestRowsEvent("a", 1))
+		if _, halt := err.(*transformHaltError); halt != (policy == transformErrorHalt) || (err != nil) != halt {
+			t.Errorf("%s: unexpected error %v", policy, err)
+		}
+		if len(events) != 0 {
+			t.Errorf("%s: failed event should not be sent", policy)
+		}
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil || strings.Count(string(data), "\n") != 1 || !strings.Contains(string(data), "bad event") {
+		t.Errorf("dead letter error: %s, %v", data, err)
+	}
+}
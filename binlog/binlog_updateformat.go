@@ -0,0 +1,89 @@
+package binlog
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// update事件格式规则，编译后缓存，配置重新加载后重新编译
+type updateFormats struct {
+	cfg     *g.UpdateFormatConfig // 生成规则的配置
+	def     string                // 默认格式
+	tables  []*regexp.Regexp      // 按表配置的规则，按顺序匹配
+	formats []string              // 与tables对应的格式
+}
+
+// 编译update_format配置，表达式或者格式错误时返回error
+func newUpdateFormats(cfg *g.UpdateFormatConfig) (*updateFormats, error) {
+	f := &updateFormats{cfg: cfg, def: updateFormatFull}
+	if cfg == nil {
+		return f, nil
+	}
+	if cfg.Default != "" {
+		format, err := checkUpdateFormat(cfg.Default)
+		if err != nil {
+			return nil, err
+		}
+		f.def = format
+	}
+	for _, t := range cfg.Tables {
+		if t == nil {
+			continue
+		}
+		re, err := regexp.Compile(t.Table)
+		if err != nil {
+			return nil, err
+		}
+		format, err := checkUpdateFormat(t.Format)
+		if err != nil {
+			return nil, err
+		}
+		f.tables = append(f.tables, re)
+		f.formats = append(f.formats, format)
+	}
+	return f, nil
+}
+
+func checkUpdateFormat(format string) (string, error) {
+	switch format = strings.ToLower(format); format {
+	case updateFormatFull, updateFormatDiff, updateFormatAfter:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown update format %s", format)
+}
+
+// 表的update事件格式
+func (f *updateFormats) format(table string) string {
+	for i, re := range f.tables {
+		if re.MatchString(table) {
+			return f.formats[i]
+		}
+	}
+	return f.def
+}
+
+// 当前生效的update事件格式规则
+// 启动时已经检查过配置，重新加载的配置错误时保留之前的规则
+func (h *Binlog) updateFormatRules() *updateFormats {
+	cfg := h.ctx.Config().UpdateFormat
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.updateFormat != nil && h.updateFormat.cfg == cfg {
+		return h.updateFormat
+	}
+	f, err := newUpdateFormats(cfg)
+	if err != nil {
+		log.Errorf("[E] update format with error: %+v", err)
+		if h.updateFormat != nil {
+			return h.updateFormat
+		}
+		f = &updateFormats{cfg: cfg, def: updateFormatFull}
+	}
+	h.updateFormat = f
+	return f
+}
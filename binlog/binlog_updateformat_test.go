@@ -0,0 +1,54 @@
+package binlog
+
+import (
+	"testing"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// test update format rules
+// 按顺序匹配表规则，错误的表达式和格式在编译时拒绝
+func TestUpdateFormats(t *testing.T) {
+	f, err := newUpdateFormats(&g.UpdateFormatConfig{
+		Default: "Diff",
+		Tables: []*g.TableFormatConfig{
+			{Table: `^test\.user$`, Format: "after"},
+			{Table: `^test\.`, Format: "full"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for table, expect := range map[string]string{
+		"test.user":  updateFormatAfter,
+		"test.order": updateFormatFull,
+		"other.user": updateFormatDiff,
+	} {
+		if format := f.format(table); format != expect {
+			t.Errorf("%s expect %s, got %s", table, expect, format)
+		}
+	}
+	if f, _ = newUpdateFormats(nil); f.format("test.user") != updateFormatFull {
+		t.Errorf("default format should be full")
+	}
+	for _, cfg := range []*g.UpdateFormatConfig{
+		{Tables: []*g.TableFormatConfig{{Table: "(", Format: "diff"}}},
+		{Tables: []*g.TableFormatConfig{{Table: "a", Format: "xml"}}},
+		{Default: "none"},
+	} {
+		if _, err = newUpdateFormats(cfg); err == nil {
+			t.Errorf("%+v should fail", cfg)
+		}
+	}
+
+	// 重新加载的配置错误时保留之前的规则
+	events := make([]map[string]interface{}, 0)
+	h := newTestBinlog(&g.GlobalConfig{UpdateFormat: &g.UpdateFormatConfig{Default: "after"}}, &events)
+	if format := h.updateFormatRules().format("test.a"); format != updateFormatAfter {
+		t.Errorf("expect after, got %s", format)
+	}
+	h.ctx.Config().UpdateFormat = &g.UpdateFormatConfig{Default: "none"}
+	if format := h.updateFormatRules().format("test.a"); format != updateFormatAfter {
+		t.Errorf("invalid reload should keep after, got %s", format)
+	}
+}
@@ -1,15 +1,100 @@
 package binlog
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/shopspring/decimal"
 	"github.com/siddontang/go-mysql/schema"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/mia0x75/copycat/g"
 )
 
+// 按格式构造update事件的数据
+// full：old_data和new_data为完整的修改前后数据
+// diff：old_data和new_data只包含修改的列和主键
+// after：new_data为完整的修改后数据，changed_columns为修改的列名
+// 没有记录在修改后数据中的列没有修改，只记录在修改后数据中的列被修改
+func updateData(format string, table *schema.Table, keys []string, oldData, newData map[string]interface{}) map[string]interface{} {
+	data := make(map[string]interface{})
+	if format != updateFormatDiff && format != updateFormatAfter {
+		data["old_data"] = oldData
+		data["new_data"] = newData
+		return data
+	}
+	changed := make([]string, 0)
+	for _, col := range table.Columns {
+		nv, ok := newData[col.Name]
+		if !ok {
+			continue
+		}
+		if ov, ok := oldData[col.Name]; ok && reflect.DeepEqual(ov, nv) {
+			continue
+		}
+		changed = append(changed, col.Name)
+	}
+	if format == updateFormatAfter {
+		data["new_data"] = newData
+		data["changed_columns"] = changed
+		return data
+	}
+	oldDiff := make(map[string]interface{})
+	newDiff := make(map[string]interface{})
+	for _, cols := range [][]string{keys, changed} {
+		for _, k := range cols {
+			if v, ok := oldData[k]; ok {
+				oldDiff[k] = v
+			}
+			if v, ok := newData[k]; ok {
+				newDiff[k] = v
+			}
+		}
+	}
+	data["old_data"] = oldDiff
+	data["new_data"] = newDiff
+	return data
+}
+
+// ddl语句解析，在github.com/siddontang/go-mysql/canal中判断表结构改变的规则之外，
+// 还包括CREATE INDEX、DROP INDEX和mariadb的ALTER ONLINE TABLE
+var ddlExps = []struct {
+	action string
+	exp    *regexp.Regexp
+}{
+	{"create", regexp.MustCompile("(?i)^CREATE\\sTABLE(\\sIF\\sNOT\\sEXISTS)?\\s`{0,1}(.*?)`{0,1}\\.{0,1}`{0,1}([^`\\.]+?)`{0,1}\\s.*")},
+	{"alter", regexp.MustCompile("(?i)^ALTER(?:\\sONLINE)?(?:\\sIGNORE)?\\sTABLE\\s.*?`{0,1}(.*?)`{0,1}\\.{0,1}`{0,1}([^`\\.]+?)`{0,1}\\s.*")},
+	{"rename", regexp.MustCompile("(?i)^RENAME\\sTABLE\\s.*?`{0,1}(.*?)`{0,1}\\.{0,1}`{0,1}([^`\\.]+?)`{0,1}\\s{1,}TO\\s.*?")},
+	{"drop", regexp.MustCompile("(?i)^DROP\\sTABLE(\\sIF\\sEXISTS){0,1}\\s`{0,1}(.*?)`{0,1}\\.{0,1}`{0,1}([^`\\.]+?)`{0,1}(?:$|\\s)")},
+	{"create_index", regexp.MustCompile("(?i)^CREATE\\s(?:(?:UNIQUE|FULLTEXT|SPATIAL)\\s)?INDEX\\s.*?\\sON\\s+`{0,1}(.*?)`{0,1}\\.{0,1}`{0,1}([^`\\.\\s(]+)`{0,1}\\s*\\(")},
+	{"drop_index", regexp.MustCompile("(?i)^DROP\\sINDEX\\s.*?\\sON\\s+`{0,1}(.*?)`{0,1}\\.{0,1}`{0,1}([^`\\.\\s]+)`{0,1}(?:$|\\s)")},
+	{"truncate", regexp.MustCompile("(?i)^TRUNCATE\\s+(?:TABLE\\s+)?(?:`?([^`\\s]+)`?\\.`?)?([^`\\s]+)`?")},
+}
+
+// 解析ddl语句
+// 返回值分别为操作类型，库名（语句中未指定时为空），表名
+func parseDDL(query string) (string, string, string) {
+	query = strings.TrimSpace(query)
+	for _, d := range ddlExps {
+		mb := d.exp.FindStringSubmatch(query)
+		if len(mb) == 0 {
+			continue
+		}
+		return d.action, mb[len(mb)-2], mb[len(mb)-1]
+	}
+	return "", "", ""
+}
+
 // 打包pos信息
 // 最终这个打包的信息会被写入到cache
-func packPos(binFile string, pos int64, eventIndex int64) []byte {
+// gtid集合追加在binlog file之后，格式为2字节长度加上集合字符串，
+// 旧版本只读取前面dl长度的数据，因此仍然兼容
+func packPos(binFile string, pos int64, eventIndex int64, gtid string) []byte {
 	res := []byte(binFile)
 	l := 16 + len(res)
 	r := make([]byte, l+2)
@@ -36,11 +121,20 @@ func packPos(binFile string, pos int64, eventIndex int64) []byte {
 	r[17] = byte(eventIndex >> 56)
 	// the last is binlog file
 	r = append(r[:18], res...)
+	// gtid set, 2 bytes length and the gtid set string
+	gl := len(gtid)
+	r = append(r, byte(gl), byte(gl>>8))
+	r = append(r, gtid...)
 	return r
 }
 
 // 解包pos信息，这里的信息来源于读取的cache
-func unpackPos(data []byte) (string, int64, int64) {
+// 返回值分别为binlog file，binlog pos，event index 事件索引，gtid集合
+func unpackPos(data []byte) (string, int64, int64, string) {
+	if len(data) < 18 {
+		log.Errorf("[E] unpack pos error: %v", data)
+		return "", 0, 0, ""
+	}
 	dl := int64(data[0]) | int64(data[1])<<8
 	pos := int64(data[2]) | int64(data[3])<<8 | int64(data[4])<<16 |
 		int64(data[5])<<24 | int64(data[6])<<32 | int64(data[7])<<40 |
@@ -52,19 +146,67 @@ func unpackPos(data []byte) (string, int64, int64) {
 	if dl+2 < 18 || dl > int64(len(data)-2) {
 		log.Debugf("[D] dl=%d, pos=%d, eventIndex=%d", dl, pos, eventIndex)
 		log.Errorf("[E] unpack pos error: %v", data)
-		return "", 0, 0
+		return "", 0, 0, ""
 	}
-	return string(data[18 : dl+2]), pos, eventIndex
+	gtid := ""
+	// 旧格式的cache没有gtid集合
+	if tail := data[dl+2:]; len(tail) >= 2 {
+		gl := int(tail[0]) | int(tail[1])<<8
+		if gl <= len(tail)-2 {
+			gtid = string(tail[2 : gl+2])
+		}
+	}
+	return string(data[18 : dl+2]), pos, eventIndex, gtid
 }
 
 // 字段解析
 // binlog数据改变事件相关字段使用这个api解析
+// 类型映射：
+// DECIMAL                   精确的字符串，如"10.50"
+// DATETIME、TIMESTAMP        配置时区的RFC3339字符串，如"2019-04-01T12:00:00+08:00"，零值保持"0000-00-00 00:00:00"
+// JSON                      直接嵌入的json
+// BLOB、BINARY、VARBINARY     {"encoding": "base64", "value": "..."}
+// BIT                       整数
+// YEAR                      整数
+// GEOMETRY等空间类型          WKT字符串，如"POINT(1 2)"，SRID被忽略
+// TEXT等字符串类型             字符串
+// 列的原始类型通过事件的column_types字段给出
 func fieldDecode(edata interface{}, column *schema.TableColumn) interface{} {
+	if edata == nil {
+		return nil
+	}
+	switch column.Type {
+	case schema.TYPE_DECIMAL:
+		return decimalDecode(edata, column)
+	case schema.TYPE_DATETIME, schema.TYPE_TIMESTAMP:
+		return timeDecode(edata, column)
+	case schema.TYPE_JSON:
+		return jsonDecode(edata)
+	}
+	if isGeometry(column) {
+		if v, ok := edata.([]uint8); ok {
+			wkt, err := geometryToWKT(v)
+			if err != nil {
+				log.Warnf("[W] binlog decode geometry %s with error: %+v", column.Name, err)
+				return binaryDecode(v)
+			}
+			return wkt
+		}
+	}
+	if isBinary(column) {
+		switch v := edata.(type) {
+		case []uint8:
+			return binaryDecode(v)
+		case string:
+			return binaryDecode([]byte(v))
+		}
+	}
 	switch edata.(type) {
 	case string:
 		return edata
 	case []uint8:
-		return edata
+		// text类型
+		return string(edata.([]uint8))
 	case int:
 		return edata
 	case int8:
@@ -144,3 +286,95 @@ func fieldDecode(edata interface{}, column *schema.TableColumn) interface{} {
 		return edata
 	}
 }
+
+// 空间类型
+var geometryTypes = []string{"geometry", "point", "linestring", "polygon", "multipoint",
+	"multilinestring", "multipolygon", "geometrycollection", "geomcollection"}
+
+func isGeometry(column *schema.TableColumn) bool {
+	for _, t := range geometryTypes {
+		if column.RawType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// 二进制类型
+func isBinary(column *schema.TableColumn) bool {
+	return strings.HasPrefix(column.RawType, "binary") ||
+		strings.HasPrefix(column.RawType, "varbinary") ||
+		strings.Contains(column.RawType, "blob")
+}
+
+// 二进制数据使用base64编码，并加上标记，避免和字符串混淆
+func binaryDecode(data []byte) map[string]interface{} {
+	return map[string]interface{}{
+		"encoding": "base64",
+		"value":    base64.StdEncoding.EncodeToString(data),
+	}
+}
+
+// decimal转换为精确的字符串，按列定义的小数位数保留末尾的0，如decimal(10,2)的10.5为"10.50"
+func decimalDecode(edata interface{}, column *schema.TableColumn) interface{} {
+	scale := decimalScale(column)
+	switch v := edata.(type) {
+	case decimal.Decimal:
+		return v.StringFixed(scale)
+	case float64:
+		return strconv.FormatFloat(v, 'f', int(scale), 64)
+	default:
+		return edata
+	}
+}
+
+var decimalTypeRegex = regexp.MustCompile(`^decimal\(\d+,(\d+)\)`)
+
+// decimal列定义的小数位数，decimal和decimal(M)为0
+func decimalScale(column *schema.TableColumn) int32 {
+	m := decimalTypeRegex.FindStringSubmatch(column.RawType)
+	if m == nil {
+		return 0
+	}
+	scale, _ := strconv.Atoi(m[1])
+	return int32(scale)
+}
+
+// datetime和timestamp转换为配置时区的RFC3339字符串
+// datetime没有时区，按配置的时区解释；timestamp是绝对时间，转换到配置的时区
+func timeDecode(edata interface{}, column *schema.TableColumn) interface{} {
+	t, ok := edata.(time.Time)
+	if !ok {
+		// 零值等无法解析的时间，保持原样
+		return edata
+	}
+	if column.Type == schema.TYPE_DATETIME {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), g.Location)
+	} else {
+		t = t.In(g.Location)
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// json类型直接嵌入
+func jsonDecode(edata interface{}) interface{} {
+	var data []byte
+	switch v := edata.(type) {
+	case []uint8:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return edata
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if !json.Valid(data) {
+		return string(data)
+	}
+	// binlog的缓冲区会被复用，这里复制一份
+	raw := make(json.RawMessage, len(data))
+	copy(raw, data)
+	return raw
+}
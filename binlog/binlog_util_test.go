@@ -0,0 +1,156 @@
+package binlog
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/siddontang/go-mysql/schema"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// test parseDDL api
+// ddl语句解析
+func TestParseDDL(t *testing.T) {
+	cases := []struct {
+		query  string
+		action string
+		db     string
+		table  string
+	}{
+		{"CREATE TABLE `test`.`a` (id int)", "create", "test", "a"},
+		{"create table if not exists a (id int)", "create", "", "a"},
+		{"ALTER TABLE test.a ADD COLUMN name varchar(10)", "alter", "test", "a"},
+		{"RENAME TABLE `a` TO `b`", "rename", "", "a"},
+		{"DROP TABLE IF EXISTS `test`.`a`", "drop", "test", "a"},
+		{"TRUNCATE TABLE test.a", "truncate", "test", "a"},
+		{"ALTER ONLINE TABLE a ADD COLUMN name varchar(10)", "alter", "", "a"},
+		{"ALTER IGNORE TABLE `test`.`a` ADD UNIQUE KEY (name)", "alter", "test", "a"},
+		{"CREATE UNIQUE INDEX uk_name ON `test`.`a` (name)", "create_index", "test", "a"},
+		{"CREATE INDEX idx_name ON a(name)", "create_index", "", "a"},
+		{"DROP INDEX uk_name ON test.a", "drop_index", "test", "a"},
+		{"CREATE DATABASE test", "", "", ""},
+	}
+	for _, c := range cases {
+		action, db, table := parseDDL(c.query)
+		if action != c.action || db != c.db || table != c.table {
+			t.Errorf("parseDDL %s error: %s, %s, %s", c.query, action, db, table)
+		}
+	}
+}
+
+// test updateData api
+// update事件的三种格式
+func TestUpdateData(t *testing.T) {
+	table := &schema.Table{Columns: []schema.TableColumn{{Name: "id"}, {Name: "name"}, {Name: "age"}}}
+	keys := []string{"id"}
+	oldData := map[string]interface{}{"id": 1, "name": "a", "age": 10}
+	newData := map[string]interface{}{"id": 1, "name": "b", "age": 10}
+
+	data := updateData(updateFormatFull, table, keys, oldData, newData)
+	if len(data["old_data"].(map[string]interface{})) != 3 || len(data["new_data"].(map[string]interface{})) != 3 {
+		t.Errorf("full format error: %+v", data)
+	}
+
+	data = updateData(updateFormatDiff, table, keys, oldData, newData)
+	diff := data["new_data"].(map[string]interface{})
+	if len(diff) != 2 || diff["id"] != 1 || diff["name"] != "b" {
+		t.Errorf("diff format error: %+v", data)
+	}
+	if data["old_data"].(map[string]interface{})["name"] != "a" {
+		t.Errorf("diff format error: %+v", data)
+	}
+
+	data = updateData(updateFormatAfter, table, keys, oldData, newData)
+	if _, ok := data["old_data"]; ok {
+		t.Errorf("after format should not contain old_data")
+	}
+	changed := data["changed_columns"].([]string)
+	if len(changed) != 1 || changed[0] != "name" || len(data["new_data"].(map[string]interface{})) != 3 {
+		t.Errorf("after format error: %+v", data)
+	}
+}
+
+// test fieldDecode api
+// 各种类型字段的解析
+func TestFieldDecode(t *testing.T) {
+	loc := g.Location
+	g.Location = time.FixedZone("CST", 8*3600)
+	defer func() { g.Location = loc }()
+
+	cases := []struct {
+		column *schema.TableColumn
+		data   interface{}
+		expect interface{}
+	}{
+		{&schema.TableColumn{Type: schema.TYPE_DECIMAL, RawType: "decimal(10,2)"}, decimal.RequireFromString("10.5"), "10.50"},
+		{&schema.TableColumn{Type: schema.TYPE_DECIMAL, RawType: "decimal(20,4) unsigned"},
+			decimal.RequireFromString("12345678901234.5"), "12345678901234.5000"},
+		{&schema.TableColumn{Type: schema.TYPE_DECIMAL, RawType: "decimal(10,0)"}, decimal.RequireFromString("-3"), "-3"},
+		{&schema.TableColumn{Type: schema.TYPE_DECIMAL, RawType: "decimal(10,2)"}, 10.5, "10.50"},
+		{&schema.TableColumn{Type: schema.TYPE_DATETIME, RawType: "datetime"},
+			time.Date(2019, 4, 1, 12, 0, 0, 0, time.UTC), "2019-04-01T12:00:00+08:00"},
+		{&schema.TableColumn{Type: schema.TYPE_TIMESTAMP, RawType: "timestamp"},
+			time.Date(2019, 4, 1, 12, 0, 0, 0, time.UTC), "2019-04-01T20:00:00+08:00"},
+		{&schema.TableColumn{Type: schema.TYPE_DATETIME, RawType: "datetime"}, "0000-00-00 00:00:00", "0000-00-00 00:00:00"},
+		{&schema.TableColumn{Type: schema.TYPE_STRING, RawType: "text"}, []byte("hello"), "hello"},
+		{&schema.TableColumn{Type: schema.TYPE_NUMBER, RawType: "year(4)"}, 2019, 2019},
+		{&schema.TableColumn{Type: schema.TYPE_JSON, RawType: "json"}, []byte{}, nil},
+	}
+	for _, c := range cases {
+		if v := fieldDecode(c.data, c.column); !reflect.DeepEqual(v, c.expect) {
+			t.Errorf("fieldDecode %s error: %+v", c.column.RawType, v)
+		}
+	}
+
+	v := fieldDecode([]byte(`{"a":1}`), &schema.TableColumn{Type: schema.TYPE_JSON, RawType: "json"})
+	if data, _ := json.Marshal(v); string(data) != `{"a":1}` {
+		t.Errorf("fieldDecode json error: %s", data)
+	}
+	// 快照查询结果与binlog中的解析一致
+	column := &schema.TableColumn{Type: schema.TYPE_BIT, RawType: "bit(12)"}
+	if v = fieldDecode(snapshotValue([]byte{0x01, 0x02}, column), column); v != int64(258) {
+		t.Errorf("fieldDecode snapshot bit error: %+v", v)
+	}
+	column = &schema.TableColumn{Type: schema.TYPE_DECIMAL, RawType: "decimal(10,2)"}
+	if v = fieldDecode(snapshotValue([]byte("1.50"), column), column); v != "1.50" {
+		t.Errorf("fieldDecode snapshot decimal error: %+v", v)
+	}
+	v = fieldDecode("\x00\x01", &schema.TableColumn{Type: schema.TYPE_STRING, RawType: "varbinary(2)"})
+	if b := v.(map[string]interface{}); b["encoding"] != "base64" || b["value"] != "AAE=" {
+		t.Errorf("fieldDecode binary error: %+v", v)
+	}
+}
+
+// test geometryToWKT api
+// 空间数据转换为WKT
+func TestGeometryToWKT(t *testing.T) {
+	point := func(x, y float64) []byte {
+		b := []byte{1, 1, 0, 0, 0}
+		b = append(b, make([]byte, 16)...)
+		binary.LittleEndian.PutUint64(b[5:], math.Float64bits(x))
+		binary.LittleEndian.PutUint64(b[13:], math.Float64bits(y))
+		return b
+	}
+	srid := []byte{0, 0, 0, 0}
+	wkt, err := geometryToWKT(append(srid, point(1, 2.5)...))
+	if err != nil || wkt != "POINT(1 2.5)" {
+		t.Errorf("point to wkt error: %s, %+v", wkt, err)
+	}
+	multi := append([]byte{}, srid...)
+	multi = append(multi, 1, 4, 0, 0, 0, 2, 0, 0, 0)
+	multi = append(multi, point(1, 2)...)
+	multi = append(multi, point(3, 4)...)
+	wkt, err = geometryToWKT(multi)
+	if err != nil || wkt != "MULTIPOINT((1 2),(3 4))" {
+		t.Errorf("multipoint to wkt error: %s, %+v", wkt, err)
+	}
+	if _, err = geometryToWKT(append(srid, 1, 1, 0)); err == nil {
+		t.Errorf("invalid wkb should return error")
+	}
+}
@@ -12,6 +12,9 @@ import (
 	"github.com/toolkits/file"
 )
 
+// Location 配置的时区，用于格式化时间类型的字段
+var Location = time.Local
+
 // Init app init
 // config path parse
 // cache path parse
@@ -54,7 +57,11 @@ func Init() {
 		// }
 	}()
 	// set timezone
-	time.LoadLocation(Config().TimeZone)
+	if loc, err := time.LoadLocation(Config().TimeZone); err == nil {
+		Location = loc
+	} else {
+		log.Warnf("[W] load time zone %s with error: %s", Config().TimeZone, err.Error())
+	}
 }
 
 // Usage show usage
@@ -62,6 +69,9 @@ func Usage() {
 	fmt.Println("copycat                                   : start service")
 	fmt.Println("copycat -h|-help                          : show this message")
 	fmt.Println("copycat -v|-version                       : show version info")
+	fmt.Println("copycat -replay <file|dir|glob>           : replay local binlog files")
+	fmt.Println("copycat -replay \"\"                        : replay the files in replay.files")
+	fmt.Println("copycat check                             : check the database sources and exit")
 }
 
 // GetKey get unique key, param if file path
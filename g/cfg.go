@@ -2,6 +2,7 @@ package g
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -24,17 +25,116 @@ type AdminConfig struct {
 
 // DatabaseConfig 数据库链接及日志信息配置
 type DatabaseConfig struct {
-	Host            string `json:"host"`             //
-	Port            uint16 `json:"port"`             //
-	User            string `json:"user"`             //
-	Password        string `json:"password"`         //
-	Charset         string `json:"charset"`          //
-	ServerID        uint32 `json:"server_id"`        //
-	Flavor          string `json:"flavor"`           //
-	HeartbeatPeriod uint64 `json:"heartbeat_period"` //
-	ReadTimeout     uint32 `json:"read_timeout"`     //
-	BinlogFile      string `json:"binlog_file"`      //
-	BinlogPos       uint32 `json:"binlog_pos"`       //
+	Name            string            `json:"name"`             // 数据源名称，多个数据源时必须设置，事件中带有该名称
+	Host            string            `json:"host"`             //
+	Port            uint16            `json:"port"`             //
+	User            string            `json:"user"`             //
+	Password        string            `json:"password"`         //
+	Charset         string            `json:"charset"`          //
+	ServerID        uint32            `json:"server_id"`        //
+	Flavor          string            `json:"flavor"`           //
+	HeartbeatPeriod uint64            `json:"heartbeat_period"` //
+	ReadTimeout     uint32            `json:"read_timeout"`     //
+	BinlogFile      string            `json:"binlog_file"`      //
+	BinlogPos       uint32            `json:"binlog_pos"`       //
+	SyncMode        string            `json:"sync_mode"`        // 同步模式，position或者gtid，默认position
+	GTIDSet         string            `json:"gtid_set"`         // gtid模式下的起始gtid集合，为空时从master当前gtid开始
+	SchemaFile      string            `json:"schema_file"`      // 表结构历史文件，默认/var/run/copycat/schema.json
+	StartTime       string            `json:"start_time"`       // 没有保存的位置时从该时间开始同步，如2019-04-01 14:05:00，使用配置的时区
+	MissingPosition string            `json:"missing_position"` // 同步位置已经被purge时的处理策略，fail、oldest、current或者snapshot，默认fail
+	Checkpoint      *CheckpointConfig `json:"checkpoint"`       // 数据源的检查点配置，为空时使用全局配置
+	Filter          *FilterConfig     `json:"filter"`           // 数据源的表过滤配置，为空时使用全局配置
+}
+
+// FilterConfig 采集端的表过滤配置
+// 规则为db.table的正则表达式，只有匹配include并且不匹配exclude的表才会被解析和推送
+type FilterConfig struct {
+	Include []string `json:"include"` // 为空时包含所有的表
+	Exclude []string `json:"exclude"` //
+}
+
+// TransactionConfig 事务分组推送配置
+type TransactionConfig struct {
+	Enabled    bool   `json:"enabled"`     // 是否按事务分组推送，关闭时每一行数据单独推送
+	MaxRows    int    `json:"max_rows"`    // 单个事务缓存的最大行数，超过后按分块推送，0为不限制
+	BufferSize int64  `json:"buffer_size"` // 单个事务在内存中缓存的最大字节数，超过后溢出到磁盘，提交时分块推送，默认64MB
+	SpillDir   string `json:"spill_dir"`   // 溢出的临时文件目录，默认为系统临时目录
+}
+
+// UpdateFormatConfig update事件格式配置
+// full为完整的修改前后数据，diff为修改的列加上主键，after为完整的修改后数据加上修改的列名
+type UpdateFormatConfig struct {
+	Default string               `json:"default"` // 默认格式，为空时为full
+	Tables  []*TableFormatConfig `json:"tables"`  // 按表配置，按顺序匹配，第一个匹配的生效
+}
+
+// TableFormatConfig 单个表的update事件格式
+type TableFormatConfig struct {
+	Table  string `json:"table"`  // db.table的正则表达式，如test\\.user
+	Format string `json:"format"` // full、diff或者after
+}
+
+// RowsQueryConfig 行事件带上产生该行的原始sql
+// 需要mysql开启binlog_rows_query_log_events或者mariadb开启binlog_annotate_row_events，sql中可能有敏感数据，默认不带
+type RowsQueryConfig struct {
+	Tables    []string `json:"tables"`     // db.table的正则表达式，匹配的表的行事件带上query字段，为空时都不带
+	MaxLength int      `json:"max_length"` // sql的最大字节数，超过时截断，0为不限制
+}
+
+// RedactConfig 敏感数据脱敏配置
+type RedactConfig struct {
+	Salt  string              `json:"salt"`  // hash使用的盐
+	Rules []*RedactRuleConfig `json:"rules"` // 按顺序匹配，第一个匹配的生效
+}
+
+// RedactRuleConfig 单个列的脱敏规则
+type RedactRuleConfig struct {
+	Column string `json:"column"` // db.table.column的正则表达式，如^test\.user\.email$
+	Action string `json:"action"` // drop、null、mask、hash或者last
+	Mask   string `json:"mask"`   // mask使用的字符串，为空时为******
+	Keep   int    `json:"keep"`   // last保留的字符数
+}
+
+// ReplayConfig 离线回放本地binlog文件的配置，使用-replay参数启动回放模式
+type ReplayConfig struct {
+	Source     string `json:"source"`      // 使用的数据源名称，用于过滤等配置以及事件中的source字段
+	Files      string `json:"files"`       // binlog文件，可以是单个文件、目录或者通配符，-replay参数为空时使用
+	SchemaFile string `json:"schema_file"` // 表结构快照，格式与表结构历史文件相同，默认使用数据源的schema_file
+	StartFile  string `json:"start_file"`  // 开始的binlog文件，为空时从第一个文件开始
+	StartPos   uint32 `json:"start_pos"`   // 开始的位置，必须是事件开始的位置
+	StopFile   string `json:"stop_file"`   // 结束的binlog文件，为空时回放到最后一个文件
+	StopPos    uint32 `json:"stop_pos"`    // 结束的位置，结束位置超过该值的事件不再回放，为0时回放到stop_file结束
+	Delay      int    `json:"delay"`       // 开始回放之前等待客户端连接的时间，秒
+}
+
+// ReconnectConfig 同步出错时的自动重连配置
+type ReconnectConfig struct {
+	MaxRetries      int   `json:"max_retries"`      // 连续失败的最大重试次数，0为不限制
+	InitialInterval int64 `json:"initial_interval"` // 初始重试间隔，毫秒，默认1000
+	MaxInterval     int64 `json:"max_interval"`     // 最大重试间隔，毫秒，默认60000
+}
+
+// CheckpointConfig 同步位置检查点配置
+type CheckpointConfig struct {
+	File            string `json:"file"`             // 检查点文件，默认/var/run/copycat/checkpoint.json
+	Keep            int    `json:"keep"`             // 保留的历史检查点数量，默认10
+	Interval        int    `json:"interval"`         // 两次写入检查点的最小间隔，单位秒，默认1
+	HistoryInterval int    `json:"history_interval"` // 历史检查点的最小间隔，单位秒，默认60
+}
+
+// SnapshotConfig 初始快照配置
+type SnapshotConfig struct {
+	Enabled          bool   `json:"enabled"`           // 开始增量同步之前是否先推送所有表的现有数据
+	ChunkSize        int    `json:"chunk_size"`        // 每次读取的行数，默认1000
+	File             string `json:"file"`              // 快照进度文件，默认/var/run/copycat/snapshot.json
+	WatermarkTable   string `json:"watermark_table"`   // 单表增量快照使用的水位表，默认copycat.watermark
+	WatermarkTimeout int    `json:"watermark_timeout"` // 等待高水位时binlog没有进展的超时时间，单位秒，默认60
+}
+
+// TransformConfig 事件转换配置
+type TransformConfig struct {
+	ErrorPolicy    string `json:"error_policy"`     // 转换出错时的处理策略，skip、halt或者dead_letter，默认skip
+	DeadLetterFile string `json:"dead_letter_file"` // 死信文件，默认/var/log/copycat/dead_letter.log
 }
 
 // AgentConfig 代理配置
@@ -53,13 +153,66 @@ type ConsulConfig struct {
 
 // GlobalConfig 系统配置
 type GlobalConfig struct {
-	Log      *LogConfig      `json:"log"`       //
-	Admin    *AdminConfig    `json:"admin"`     //
-	TimeZone string          `json:"time_zone"` //
-	Database *DatabaseConfig `json:"database"`  //
-	Listen   string          `json:"listen"`    //
-	Consul   *ConsulConfig   `json:"consul"`    //
-	Agent    *AgentConfig    `json:"agent"`     //
+	Log          *LogConfig          `json:"log"`           //
+	Admin        *AdminConfig        `json:"admin"`         //
+	TimeZone     string              `json:"time_zone"`     //
+	Database     *DatabaseConfig     `json:"database"`      // 单个数据源，配置了sources时忽略
+	Sources      []*DatabaseConfig   `json:"sources"`       // 多个数据源，每个数据源独立同步
+	Checkpoint   *CheckpointConfig   `json:"checkpoint"`    //
+	Reconnect    *ReconnectConfig    `json:"reconnect"`     //
+	Replay       *ReplayConfig       `json:"replay"`        //
+	Filter       *FilterConfig       `json:"filter"`        //
+	Transaction  *TransactionConfig  `json:"transaction"`   //
+	UpdateFormat *UpdateFormatConfig `json:"update_format"` //
+	RowsQuery    *RowsQueryConfig    `json:"rows_query"`    //
+	Redact       *RedactConfig       `json:"redact"`        //
+	Transform    *TransformConfig    `json:"transform"`     //
+	Snapshot     *SnapshotConfig     `json:"snapshot"`      //
+	Listen       string              `json:"listen"`        //
+	Consul       *ConsulConfig       `json:"consul"`        //
+	Agent        *AgentConfig        `json:"agent"`         //
+}
+
+// DatabaseSources 返回所有的数据源，没有配置sources时为database
+func (c *GlobalConfig) DatabaseSources() []*DatabaseConfig {
+	if len(c.Sources) > 0 {
+		return c.Sources
+	}
+	return []*DatabaseConfig{c.Database}
+}
+
+// DatabaseSource 返回指定名称的数据源，找不到时返回nil
+func (c *GlobalConfig) DatabaseSource(name string) *DatabaseConfig {
+	for _, source := range c.DatabaseSources() {
+		if source != nil && source.Name == name {
+			return source
+		}
+	}
+	return nil
+}
+
+// Validate 检查数据源配置
+// 多个数据源时名称不能为空并且不能重复，文件名和订阅主题按名称区分；server_id不能重复，否则master会断开其中一个连接
+func (c *GlobalConfig) Validate() error {
+	names := make(map[string]bool)
+	ids := make(map[uint32]string)
+	for i, source := range c.Sources {
+		if source == nil {
+			return fmt.Errorf("sources[%d] is empty", i)
+		}
+		if source.Name == "" && len(c.Sources) > 1 {
+			return fmt.Errorf("sources[%d] has no name", i)
+		}
+		if names[source.Name] {
+			return fmt.Errorf("duplicate source name %s", source.Name)
+		}
+		names[source.Name] = true
+		if name, ok := ids[source.ServerID]; ok {
+			return fmt.Errorf("source %s has the same server_id %d as source %s", source.Name, source.ServerID, name)
+		}
+		ids[source.ServerID] = source.Name
+	}
+	return nil
 }
 
 var (
@@ -119,6 +272,9 @@ func ParseConfig(cfg string) *GlobalConfig {
 	if err != nil {
 		log.Fatalf("[F] 解析配置文件 \"%s\" 错误: %s", ConfigFile, err.Error())
 	}
+	if err = c.Validate(); err != nil {
+		log.Fatalf("[F] 配置文件 \"%s\" 错误: %s", ConfigFile, err.Error())
+	}
 
 	configLock.Lock()
 	defer configLock.Unlock()
@@ -5,5 +5,9 @@ const (
 	LOG_FILE         = "/var/log/copycat/copycat.log"
 	SESSION_FILE     = "/var/run/copycat/session"
 	TOKEN_FILE       = "/var/run/copycat/token"
-	MASTER_INFO_FILE = "/var/run/copycat/copycat.cache"
+	MASTER_INFO_FILE = "/var/run/copycat/copycat.cache" // 旧版本的位置文件，仅用于迁移
+	CHECKPOINT_FILE  = "/var/run/copycat/checkpoint.json"
+	SCHEMA_FILE      = "/var/run/copycat/schema.json"
+	SNAPSHOT_FILE    = "/var/run/copycat/snapshot.json"
+	DEAD_LETTER_FILE = "/var/log/copycat/dead_letter.log"
 )
@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 
 	log "github.com/sirupsen/logrus"
@@ -19,15 +20,15 @@ type Context struct {
 	PidFile    string
 	cancelChan chan struct{}
 	PosChan    chan string
-	Config     *GlobalConfig
+	config     atomic.Value // *GlobalConfig，重新加载时替换，同步中的服务同时在读取
 }
 
 // NewContext new app context
 func NewContext() *Context {
 	ctx := &Context{
 		cancelChan: make(chan struct{}),
-		Config:     Config(),
 	}
+	ctx.SetConfig(Config())
 	ctx.Ctx, ctx.Cancel = context.WithCancel(context.Background())
 	go ctx.signalHandler()
 	return ctx
@@ -45,7 +46,18 @@ func (ctx *Context) Done() <-chan struct{} {
 
 // Reload TODO
 func (ctx *Context) Reload() {
-	ctx.Config = Reload()
+	ctx.SetConfig(Reload())
+}
+
+// Config 当前的配置，重新加载后返回新的配置
+func (ctx *Context) Config() *GlobalConfig {
+	c, _ := ctx.config.Load().(*GlobalConfig)
+	return c
+}
+
+// SetConfig 替换配置
+func (ctx *Context) SetConfig(c *GlobalConfig) {
+	ctx.config.Store(c)
 }
 
 // wait for control + c signal
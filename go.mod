@@ -1,5 +1,7 @@
 module github.com/mia0x75/copycat
 
+go 1.23
+
 replace (
 	cloud.google.com/go => github.com/googleapis/google-cloud-go v0.36.0
 	github.com/siddontang/go-mysql => github.com/mia0x75/go-mysql v0.0.0-20190411053611-e23f6fe57410
@@ -7,15 +9,12 @@ replace (
 	golang.org/x/build => github.com/golang/build v0.0.0-20190228010158-44b79b8774a7
 	golang.org/x/crypto => github.com/golang/crypto v0.0.0-20190227175134-215aa809caaf
 	golang.org/x/exp => github.com/golang/exp v0.0.0-20190221220918-438050ddec5e
-	golang.org/x/lint => github.com/golang/lint v0.0.0-20190227174305-5b3e6a55c961
 	golang.org/x/net => github.com/golang/net v0.0.0-20190227160552-c95aed5357e7
 	golang.org/x/oauth2 => github.com/golang/oauth2 v0.0.0-20190226205417-e64efc72b421
 	golang.org/x/perf => github.com/golang/perf v0.0.0-20190124201629-844a5f5b46f4
 	golang.org/x/sync => github.com/golang/sync v0.0.0-20190227155943-e225da77a7e6
 	golang.org/x/sys => github.com/golang/sys v0.0.0-20190226215855-775f8194d0f9
-	golang.org/x/text => github.com/golang/text v0.3.0
 	golang.org/x/time => github.com/golang/time v0.0.0-20181108054448-85acf8d2951c
-	golang.org/x/tools => github.com/golang/tools v0.0.0-20190227232517-f0a709d59f0f
 	google.golang.org/api => github.com/googleapis/google-api-go-client v0.1.0
 	google.golang.org/appengine => github.com/golang/appengine v1.4.0
 	google.golang.org/genproto => github.com/google/go-genproto v0.0.0-20190227213309-4f5b463f9597
@@ -23,14 +22,38 @@ replace (
 )
 
 require (
-	github.com/go-sql-driver/mysql v1.4.1 // indirect
 	github.com/hashicorp/consul/api v1.0.1
-	github.com/jmoiron/sqlx v1.2.0 // indirect
-	github.com/kr/pretty v0.1.0 // indirect
-	github.com/pingcap/check v0.0.0-20190102082844-67f458068fc8 // indirect
+	github.com/pingcap/tidb/pkg/parser v0.0.0-20250324122243-d51e00e5bbf0
+	github.com/shopspring/decimal v0.0.0-20180709203117-cd690d0c9e24
 	github.com/siddontang/go-mysql v0.0.0-20190312052122-c6ab05a85eb8
 	github.com/sirupsen/logrus v1.4.1
 	github.com/toolkits/file v0.0.0-20160325033739-a5b3c5147e07
+)
+
+require (
+	github.com/BurntSushi/toml v0.3.1 // indirect
+	github.com/armon/go-metrics v0.0.0-20180917152333-f0300d1749da // indirect
+	github.com/go-sql-driver/mysql v1.7.1 // indirect
+	github.com/hashicorp/go-cleanhttp v0.5.1 // indirect
+	github.com/hashicorp/go-immutable-radix v1.0.0 // indirect
+	github.com/hashicorp/go-rootcerts v1.0.0 // indirect
+	github.com/hashicorp/golang-lru v0.5.0 // indirect
+	github.com/hashicorp/serf v0.8.2 // indirect
+	github.com/jmoiron/sqlx v1.2.0 // indirect
+	github.com/kr/pretty v0.1.0 // indirect
+	github.com/mitchellh/mapstructure v1.1.2 // indirect
+	github.com/pingcap/check v0.0.0-20190102082844-67f458068fc8 // indirect
+	github.com/pingcap/errors v0.11.5-0.20240311024730-e056997136bb // indirect
+	github.com/pingcap/failpoint v0.0.0-20240528011301-b51a646c7c86 // indirect
+	github.com/pingcap/log v1.1.0 // indirect
+	github.com/satori/go.uuid v1.2.0 // indirect
+	github.com/siddontang/go v0.0.0-20180604090527-bdc77568d726 // indirect
+	go.uber.org/atomic v1.11.0 // indirect
+	go.uber.org/multierr v1.11.0 // indirect
+	go.uber.org/zap v1.27.0 // indirect
+	golang.org/x/sys v0.0.0-20190215142949-d0b11bdaac8a // indirect
+	golang.org/x/text v0.19.0 // indirect
 	google.golang.org/appengine v0.0.0-00010101000000-000000000000 // indirect
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
 )
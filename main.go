@@ -1,11 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/mia0x75/copycat/agent"
 	"github.com/mia0x75/copycat/binlog"
@@ -21,6 +23,7 @@ var (
 	hCmd       = flag.Bool("h", false, "help")                                      //
 	daemonCmd  = flag.Bool("daemon", false, "-daemon or -d, run as daemon process") //
 	dCmd       = flag.Bool("d", false, "-daemon or -d, run as daemon process")      //
+	replayCmd  = flag.String("replay", "", "replay local binlog files")             //
 )
 
 func main() {
@@ -49,12 +52,26 @@ func main() {
 	}
 
 	g.ParseConfig("")
+	// 只检查数据源，不启动服务，也不写pid文件
+	if flag.Arg(0) == "check" {
+		if !preflight(g.NewContext(), true) {
+			os.Exit(1)
+		}
+		return
+	}
 	// app init
 	g.Init()
 	ctx := g.NewContext()
 
 	tcpService := services.NewTCPService(ctx)
 
+	// 离线回放模式，不连接数据库，也不加入集群
+	// 只在指定了-replay参数时回放，参数为空时使用配置的replay.files
+	if flagSet("replay") {
+		replay(ctx, tcpService, *replayCmd)
+		return
+	}
+
 	// agent代理，用于实现集群
 	agentServer := agent.NewAgentServer(
 		ctx,
@@ -62,33 +79,74 @@ func main() {
 		agent.OnRaw(tcpService.SendRaw),
 	)
 
-	// 核心binlog服务
-	blog := binlog.NewBinlog(
-		ctx,
-		// pos改变的时候，通过agent server同步给所有的客户端
-		binlog.PosChange(func(data []byte) {
-			packData := services.Pack(agent.CMD_POS, data)
-			agentServer.Sync(packData)
-		}),
-		// 将所有的事件同步给所有的客户端
-		binlog.OnEvent(func(table string, data []byte) {
-			packData := services.Pack(agent.CMD_EVENT, data)
-			agentServer.Sync(packData)
-		}),
-	)
-
-	// 注册服务
-	blog.RegisterService(tcpService)
-	// 开始binlog进程
-	blog.Start()
+	// 核心binlog服务，每个数据源一个
+	// 只有一个未命名的数据源时，pos信息保持旧的格式
+	if g.Config().Database == nil && len(g.Config().Sources) == 0 {
+		fmt.Println("neither database nor sources is configured")
+		os.Exit(1)
+	}
+	sources := g.Config().DatabaseSources()
+	multiSource := len(sources) > 1 || sources[0].Name != ""
+	// 启动前检查所有的数据源，有不能启动的问题时退出
+	if !preflight(ctx, false) {
+		fmt.Println("preflight check failed, run \"copycat check\" for details")
+		os.Exit(1)
+	}
+	blogs := make([]*binlog.Binlog, 0)
+	for _, source := range sources {
+		name := source.Name
+		blog := binlog.NewBinlog(
+			ctx,
+			binlog.Source(name),
+			// pos改变的时候，通过agent server同步给所有的客户端
+			binlog.PosChange(func(data []byte) {
+				if multiSource {
+					data = binlog.PackSourcePos(name, data)
+				}
+				packData := services.Pack(agent.CMD_POS, data)
+				agentServer.Sync(packData)
+			}),
+			// 将所有的事件同步给所有的客户端
+			binlog.OnEvent(func(table string, data []byte) {
+				packData := services.Pack(agent.CMD_EVENT, data)
+				agentServer.Sync(packData)
+			}),
+		)
+		// 注册服务
+		blog.RegisterService(tcpService)
+		blogs = append(blogs, blog)
+	}
+	// 按名称查找数据源
+	findBinlog := func(name string) *binlog.Binlog {
+		for _, blog := range blogs {
+			if blog.Name() == name {
+				return blog
+			}
+		}
+		return nil
+	}
+	// 开始服务进程，服务被所有的数据源共享，只启动一次
+	tcpService.Start()
 
 	// set agent receive pos callback
 	// 延迟依赖绑定
 	// agent与binlog相互依赖
 	// agent收到leader的pos改变同步信息时，回调到SaveBinlogPosition
 	// agent选leader成功回调到OnLeader上，是为了停止和开启服务，只有leader在工作
-	agent.OnPos(blog.SaveBinlogPosition)(agentServer)
-	agent.OnLeader(blog.OnLeader)(agentServer)
+	agent.OnPos(func(r []byte) {
+		name := ""
+		if multiSource {
+			name, r = binlog.UnpackSourcePos(r)
+		}
+		if blog := findBinlog(name); blog != nil {
+			blog.SaveBinlogPosition(r)
+		}
+	})(agentServer)
+	agent.OnLeader(func(isLeader bool) {
+		for _, blog := range blogs {
+			blog.OnLeader(isLeader)
+		}
+	})(agentServer)
 
 	// 启动agent进程
 	agentServer.Start()
@@ -99,7 +157,67 @@ func main() {
 		mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 			io.WriteString(w, agentServer.ShowMembers())
 		})
+		mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			var status interface{}
+			if multiSource {
+				res := make(map[string]interface{})
+				for _, blog := range blogs {
+					res[blog.Name()] = blog.Status()
+				}
+				status = res
+			} else {
+				status = blogs[0].Status()
+			}
+			data, _ := json.Marshal(status)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(data)
+		})
+		mux.HandleFunc("/snapshot", func(w http.ResponseWriter, r *http.Request) {
+			targets := make([]string, 0)
+			if v := r.FormValue("targets"); v != "" {
+				targets = strings.Split(v, ",")
+			}
+			blog := findBinlog(r.FormValue("source"))
+			if blog == nil {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, "source not found")
+				return
+			}
+			if err := blog.SnapshotTable(r.FormValue("table"), targets); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, err.Error())
+				return
+			}
+			io.WriteString(w, "snapshot")
+		})
+		mux.HandleFunc("/start_from", func(w http.ResponseWriter, r *http.Request) {
+			blog := findBinlog(r.FormValue("source"))
+			if blog == nil {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, "source not found")
+				return
+			}
+			t, err := binlog.ParseStartTime(r.FormValue("time"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, err.Error())
+				return
+			}
+			pos, err := blog.StartFromTime(t)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, err.Error())
+				return
+			}
+			data, _ := json.Marshal(pos)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(data)
+		})
 		mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+			ctx.Reload()
+			for _, blog := range blogs {
+				blog.Reload()
+			}
 			io.WriteString(w, "reload")
 		})
 		mux.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
@@ -117,6 +235,63 @@ func main() {
 	}
 
 	ctx.Cancel()
-	blog.Close()
+	for _, blog := range blogs {
+		blog.Close()
+	}
 	fmt.Println("service exit...")
 }
+
+// 命令行中是否指定了参数
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// 检查所有的数据源，报告所有的问题
+// verbose为true时输出完整的报告，否则只记录日志
+// 返回false时有不能启动的问题
+func preflight(ctx *g.Context, verbose bool) bool {
+	ok := true
+	for _, source := range g.Config().DatabaseSources() {
+		name := ""
+		if source != nil {
+			name = source.Name
+		}
+		report := binlog.Preflight(ctx, binlog.Source(name))
+		if verbose {
+			fmt.Println(report.String())
+		} else {
+			report.Log()
+		}
+		if report.Fatal() {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// 回放本地binlog文件，完成后退出
+func replay(ctx *g.Context, tcpService *services.TCPService, files string) {
+	name := ""
+	if g.Config().Replay != nil {
+		name = g.Config().Replay.Source
+	}
+	blog, err := binlog.NewReplay(ctx, binlog.Source(name))
+	if err != nil {
+		fmt.Printf("replay with error: %v\n", err)
+		os.Exit(1)
+	}
+	blog.RegisterService(tcpService)
+	tcpService.Start()
+	if err = blog.Replay(files); err != nil {
+		fmt.Printf("replay with error: %v\n", err)
+	}
+	ctx.Cancel()
+	tcpService.Close()
+	fmt.Println("replay exit...")
+}
@@ -14,6 +14,13 @@ type IService interface {
 	Close()                                 // 关闭服务
 	Reload()                                // 重新加载服务配置
 	Name() string                           // 返回服务名称
+	Sent() int64                            // 已经接收的SendAll事件数量
+	Acked() int64                           // 已经安全交付的SendAll事件数量，事件按接收顺序交付
+}
+
+// ITargetService 支持推送给指定客户端的服务
+type ITargetService interface {
+	SendTo(targets []string, table string, data []byte) bool // 推送给指定地址的客户端，地址格式为ip:port
 }
 
 const (
@@ -56,7 +63,10 @@ const ServiceName = "binlog-go-subscribe"
 
 type tcpClientNode struct {
 	conn             *net.Conn       // 客户端连接进来的资源句柄
-	sendQueue        chan []byte     // 发送channel
+	sendQueue        chan tcpMessage // 发送channel
+	closed           chan struct{}   // 连接关闭时关闭，发送队列不关闭，避免阻塞中的发送panic
+	queuedSeq        int64           // 最后一个进入发送队列的事件序号
+	sentSeq          int64           // 最后一个发送成功的事件序号
 	sendFailureTimes int64           // 发送失败次数
 	topics           []string        // 订阅的主题
 	recvBuf          []byte          // 读缓冲区
@@ -68,6 +78,12 @@ type tcpClientNode struct {
 	onclose          []NodeFunc      //
 }
 
+// 发送队列中的消息，seq为事件序号，心跳等非事件消息为0
+type tcpMessage struct {
+	seq  int64
+	data []byte
+}
+
 // NodeFunc TODO
 type NodeFunc func(n *tcpClientNode)
 
@@ -97,6 +113,8 @@ type TCPService struct {
 	conn        *net.TCPConn
 	buffer      []byte
 	sendAll     []SendAllFunc
+	sendTo      []SendToFunc
+	ack         AckFunc
 	sendRaw     []SendRawFunc
 	onConnect   []OnConnectFunc
 	onClose     []CloseFunc
@@ -105,7 +123,8 @@ type TCPService struct {
 }
 
 var (
-	_ IService = &TCPService{}
+	_ IService       = &TCPService{}
+	_ ITargetService = &TCPService{}
 
 	packDataTickOk = Pack(CMD_TICK, []byte("ok"))
 	packDataSetPro = Pack(CMD_SET_PRO, []byte("ok"))
@@ -117,6 +136,12 @@ type TCPServiceOption func(service *TCPService)
 // SendAllFunc TODO
 type SendAllFunc func(table string, data []byte) bool
 
+// AckFunc 返回已经接收和已经安全交付的事件数量
+type AckFunc func() (int64, int64)
+
+// SendToFunc TODO
+type SendToFunc func(targets []string, table string, data []byte) bool
+
 // SendRawFunc TODO
 type SendRawFunc func(msg []byte)
 
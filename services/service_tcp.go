@@ -17,8 +17,10 @@ func NewTCPService(ctx *g.Context) *TCPService {
 	grp := newGroups(ctx)
 	t := newTCPService(
 		ctx,
-		ctx.Config.Listen,
+		ctx.Config().Listen,
 		SetSendAll(grp.sendAll),
+		SetSendTo(grp.sendTo),
+		SetAck(grp.ack),
 		SetSendRaw(grp.asyncSend),
 		SetOnConnect(grp.onConnect),
 		SetOnClose(grp.close),
@@ -27,11 +29,11 @@ func NewTCPService(ctx *g.Context) *TCPService {
 	)
 
 	// 服务注册相关
-	if ctx.Config.Consul.Enabled && ctx.Config.Consul.Addr != "" {
-		temp := strings.Split(ctx.Config.Listen, ":")
+	if ctx.Config().Consul.Enabled && ctx.Config().Consul.Addr != "" {
+		temp := strings.Split(ctx.Config().Listen, ":")
 		host := temp[0]
 		port, _ := strconv.ParseInt(temp[1], 10, 32)
-		svc := NewService(host, int(port), ctx.Config.Consul.Addr)
+		svc := NewService(host, int(port), ctx.Config().Consul.Addr)
 		svc.Register()
 		SetOnClose(svc.Close)(t)
 		SetOnConnect(svc.newConnect)(t)
@@ -55,6 +57,7 @@ func newTCPService(
 		ctx:         ctx,
 		status:      0,
 		sendAll:     make([]SendAllFunc, 0),
+		sendTo:      make([]SendToFunc, 0),
 		sendRaw:     make([]SendRawFunc, 0),
 		onConnect:   make([]OnConnectFunc, 0),
 		onClose:     make([]CloseFunc, 0),
@@ -77,6 +80,20 @@ func SetSendAll(f SendAllFunc) TCPServiceOption {
 	}
 }
 
+// SetSendTo TODO
+func SetSendTo(f SendToFunc) TCPServiceOption {
+	return func(svc *TCPService) {
+		svc.sendTo = append(svc.sendTo, f)
+	}
+}
+
+// SetAck TODO
+func SetAck(f AckFunc) TCPServiceOption {
+	return func(svc *TCPService) {
+		svc.ack = f
+	}
+}
+
 // SetSendRaw TODO
 func SetSendRaw(f SendRawFunc) TCPServiceOption {
 	return func(svc *TCPService) {
@@ -129,6 +146,22 @@ func (tcp *TCPService) SendAll(table string, data []byte) bool {
 	return true
 }
 
+// SendTo send event data to the client with the remote address in targets
+func (tcp *TCPService) SendTo(targets []string, table string, data []byte) bool {
+	tcp.statusLock.Lock()
+	if tcp.status&serviceEnable <= 0 {
+		tcp.statusLock.Unlock()
+		return false
+	}
+	tcp.statusLock.Unlock()
+	log.Debugf("[D] subscribe SendTo: %v, %s, %+v", targets, table, string(data))
+	packData := Pack(CMD_EVENT, data)
+	for _, f := range tcp.sendTo {
+		f(targets, table, packData)
+	}
+	return true
+}
+
 // SendRaw send raw bytes data to all connects client
 // msg is the pack frame form func: pack
 func (tcp *TCPService) SendRaw(msg []byte) bool {
@@ -229,6 +262,25 @@ func (tcp *TCPService) keepalive() {
 	}
 }
 
+// Sent 已经接收的SendAll事件数量
+func (tcp *TCPService) Sent() int64 {
+	if tcp.ack == nil {
+		return 0
+	}
+	sent, _ := tcp.ack()
+	return sent
+}
+
+// Acked 已经写入所有订阅客户端连接的SendAll事件数量
+// 没有客户端或者客户端断开时有事件没有交付，没有客户端时不再增加，有客户端确认之后丢弃没有交付的事件并继续增加
+func (tcp *TCPService) Acked() int64 {
+	if tcp.ack == nil {
+		return 0
+	}
+	_, acked := tcp.ack()
+	return acked
+}
+
 // Name TODO
 func (tcp *TCPService) Name() string {
 	return "subscribe"
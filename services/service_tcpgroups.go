@@ -3,6 +3,7 @@ package services
 import (
 	"net"
 	"sync"
+	"sync/atomic"
 
 	log "github.com/sirupsen/logrus"
 
@@ -12,8 +13,13 @@ import (
 type tcpGroups struct {
 	g        []*tcpClientNode
 	lock     *sync.Mutex
+	sendLock *sync.Mutex // 保证SendAll事件的发送顺序，发送队列满时阻塞，不能持有lock
 	ctx      *g.Context
 	unique   int64
+	sent     int64 // 已经接收的事件数量，也是最后一个事件的序号
+	lost     int64 // 第一个没有交付的事件之前的序号，没有客户端时确认的数量不会超过这个值
+	lostTo   int64 // 最后一个没有交付的事件序号
+	lossy    bool  // 是否有没有交付的事件
 	onRemove []OnRemoveFunc
 }
 
@@ -27,6 +33,7 @@ func newGroups(ctx *g.Context, opts ...TCPGroupsOptions) *tcpGroups {
 	g := &tcpGroups{
 		unique:   0,
 		lock:     new(sync.Mutex),
+		sendLock: new(sync.Mutex),
 		g:        make([]*tcpClientNode, 0),
 		ctx:      ctx,
 		onRemove: make([]OnRemoveFunc, 0),
@@ -45,23 +52,96 @@ func SetOnRemove(f OnRemoveFunc) TCPGroupsOptions {
 }
 
 func (groups *tcpGroups) sendAll(table string, data []byte) bool {
+	groups.sendLock.Lock()
+	defer groups.sendLock.Unlock()
+	groups.lock.Lock()
+	groups.sent++
+	seq := groups.sent
+	if len(groups.g) == 0 {
+		// 没有客户端，事件没有交付
+		groups.lose(seq-1, seq)
+	}
+	nodes := make([]*tcpClientNode, 0, len(groups.g))
 	for _, node := range groups.g {
 		log.Debugf("[D] topics:%+v, %v", node.topics, table)
 		// 如果有订阅主题
 		if MatchFilters(node.topics, table) {
-			node.asyncSend(data)
+			// 先记录进入队列的序号，释放锁之后ack也能看到这个事件还没有发送
+			node.queued(seq)
+			nodes = append(nodes, node)
+		}
+	}
+	groups.lock.Unlock()
+	for _, node := range nodes {
+		node.asyncSendSeq(seq, data)
+	}
+	return true
+}
+
+// 已经接收和已经安全交付的事件数量
+// 每个客户端发送队列中最早的事件之前的事件都已经交付。
+// 没有客户端时推送的事件和断开的客户端队列中的事件没有交付：没有客户端时确认停在第一个没有交付的事件之前，
+// 重启后从确认过的位置重新推送；有客户端连接并且确认超过这个位置后，明确丢弃这些事件，确认继续增加
+func (groups *tcpGroups) ack() (int64, int64) {
+	groups.lock.Lock()
+	defer groups.lock.Unlock()
+	acked := groups.sent
+	for _, node := range groups.g {
+		if seq, ok := node.pendingSeq(); ok && seq < acked {
+			acked = seq
+		}
+	}
+	if groups.lossy {
+		if len(groups.g) == 0 || acked <= groups.lost {
+			return groups.sent, groups.lost
+		}
+		log.Errorf("[E] tcp events %d-%d were not delivered to all subscribers and are dropped",
+			groups.lost+1, groups.lostTo)
+		groups.lossy = false
+	}
+	return groups.sent, acked
+}
+
+// 记录没有交付的事件，from为之前已经交付的序号，to为最后一个没有交付的序号
+// 调用方需持有groups.lock
+func (groups *tcpGroups) lose(from, to int64) {
+	if !groups.lossy {
+		log.Warnf("[W] tcp events after %d are not delivered, the checkpoint is held until a subscriber acks", from)
+		groups.lost, groups.lostTo, groups.lossy = from, to, true
+		return
+	}
+	if from < groups.lost {
+		groups.lost = from
+	}
+	if to > groups.lostTo {
+		groups.lostTo = to
+	}
+}
+
+// 推送给指定地址的客户端，仍然按客户端订阅的主题过滤
+func (groups *tcpGroups) sendTo(targets []string, table string, data []byte) bool {
+	for _, node := range groups.nodes() {
+		if !node.isTarget(targets) || !MatchFilters(node.topics, table) {
+			continue
 		}
+		node.asyncSend(data)
 	}
 	return true
 }
 
 func (groups *tcpGroups) remove(node *tcpClientNode) {
+	groups.lock.Lock()
 	for index, n := range groups.g {
 		if n == node {
 			groups.g = append(groups.g[:index], groups.g[index+1:]...)
 			break
 		}
 	}
+	if seq, ok := node.pendingSeq(); ok {
+		// 断开的客户端队列中的事件没有交付
+		groups.lose(seq, atomic.LoadInt64(&node.queuedSeq))
+	}
+	groups.lock.Unlock()
 	for _, f := range groups.onRemove {
 		f(node.conn)
 	}
@@ -72,18 +152,29 @@ func (groups *tcpGroups) reload() {
 }
 
 func (groups *tcpGroups) asyncSend(data []byte) {
+	for _, node := range groups.nodes() {
+		node.asyncSend(data)
+	}
+}
+
+// 当前的客户端，发送队列满时会阻塞，发送时不能持有lock
+func (groups *tcpGroups) nodes() []*tcpClientNode {
 	groups.lock.Lock()
 	defer groups.lock.Unlock()
-	for _, group := range groups.g {
-		group.asyncSend(data)
-	}
+	nodes := make([]*tcpClientNode, len(groups.g))
+	copy(nodes, groups.g)
+	return nodes
 }
 
 func (groups *tcpGroups) close() {
-	for _, group := range groups.g {
-		group.close()
-	}
+	groups.lock.Lock()
+	nodes := groups.g
 	groups.g = make([]*tcpClientNode, 0)
+	groups.lock.Unlock()
+	// 关闭时会回调remove，不能持有lock
+	for _, node := range nodes {
+		node.close()
+	}
 }
 
 func (groups *tcpGroups) onConnect(conn *net.Conn) {
@@ -0,0 +1,59 @@
+package services
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mia0x75/copycat/g"
+)
+
+// 连接一个订阅所有主题的客户端，对端读取并丢弃收到的数据
+func newTestClient(groups *tcpGroups) (*tcpClientNode, net.Conn) {
+	server, client := net.Pipe()
+	go io.Copy(ioutil.Discard, client)
+	conn := net.Conn(server)
+	groups.onConnect(&conn)
+	nodes := groups.nodes()
+	node := nodes[len(nodes)-1]
+	node.addTopic(".*")
+	return node, client
+}
+
+// 等待确认的数量
+func waitAcked(t *testing.T, groups *tcpGroups, expect int64) {
+	for i := 0; i < 100; i++ {
+		if _, acked := groups.ack(); acked == expect {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	_, acked := groups.ack()
+	t.Fatalf("expect acked %d, got %d", expect, acked)
+}
+
+// test acks after the subscriber disconnects and reconnects
+// 没有客户端时确认停在没有交付的事件之前，重新连接并确认之后继续增加
+func TestTCPGroups_AckAfterReconnect(t *testing.T) {
+	groups := newGroups(g.NewContext())
+	defer groups.close()
+	node, client := newTestClient(groups)
+	groups.sendAll("test.a", []byte("1"))
+	waitAcked(t, groups, 1)
+
+	node.close()
+	client.Close()
+	groups.sendAll("test.a", []byte("2"))
+	groups.sendAll("test.a", []byte("3"))
+	if sent, acked := groups.ack(); sent != 3 || acked != 1 {
+		t.Errorf("without subscribers expect sent 3 acked 1, got %d %d", sent, acked)
+	}
+
+	newTestClient(groups)
+	groups.sendAll("test.a", []byte("4"))
+	waitAcked(t, groups, 4)
+	groups.sendAll("test.a", []byte("5"))
+	waitAcked(t, groups, 5)
+}
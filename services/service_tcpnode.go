@@ -17,7 +17,8 @@ import (
 func newNode(ctx *g.Context, conn *net.Conn, opts ...NodeOption) *tcpClientNode {
 	node := &tcpClientNode{
 		conn:             conn,
-		sendQueue:        make(chan []byte, tcpMaxSendQueue),
+		sendQueue:        make(chan tcpMessage, tcpMaxSendQueue),
+		closed:           make(chan struct{}),
 		sendFailureTimes: 0,
 		connectTime:      time.Now().Unix(),
 		recvBuf:          make([]byte, 0),
@@ -53,6 +54,17 @@ func (node *tcpClientNode) addTopic(topic string) {
 	node.topics = append(node.topics, topic)
 }
 
+// 客户端地址是否在targets中
+func (node *tcpClientNode) isTarget(targets []string) bool {
+	addr := (*node.conn).RemoteAddr().String()
+	for _, t := range targets {
+		if t == addr {
+			return true
+		}
+	}
+	return false
+}
+
 func (node *tcpClientNode) close() {
 	node.lock.Lock()
 	defer node.lock.Unlock()
@@ -62,7 +74,7 @@ func (node *tcpClientNode) close() {
 	if node.status&tcpNodeOnline > 0 {
 		node.status ^= tcpNodeOnline
 		(*node.conn).Close()
-		close(node.sendQueue)
+		close(node.closed)
 	}
 
 	for _, f := range node.onclose {
@@ -76,19 +88,40 @@ func (node *tcpClientNode) send(data []byte) (int, error) {
 }
 
 func (node *tcpClientNode) asyncSend(data []byte) {
+	node.asyncSendSeq(0, data)
+}
+
+// 发送事件，seq为事件序号
+func (node *tcpClientNode) asyncSendSeq(seq int64, data []byte) {
 	node.lock.Lock()
 	if node.status&tcpNodeOnline <= 0 {
 		node.lock.Unlock()
 		return
 	}
 	node.lock.Unlock()
-	for {
-		if len(node.sendQueue) < cap(node.sendQueue) {
-			break
-		}
+	if len(node.sendQueue) >= cap(node.sendQueue) {
 		log.Warnf("[W] cache full, try wait, %v, %v", len(node.sendQueue), cap(node.sendQueue))
 	}
-	node.sendQueue <- data
+	node.queued(seq)
+	select {
+	case node.sendQueue <- tcpMessage{seq: seq, data: data}:
+	case <-node.closed:
+		// 发送时连接被关闭，事件没有交付，由remove记录
+	}
+}
+
+// 记录进入发送队列的事件序号
+func (node *tcpClientNode) queued(seq int64) {
+	if seq > 0 {
+		atomic.StoreInt64(&node.queuedSeq, seq)
+	}
+}
+
+// 队列中还有未发送的事件时，返回最后一个发送成功的事件序号
+func (node *tcpClientNode) pendingSeq() (int64, bool) {
+	queued := atomic.LoadInt64(&node.queuedSeq)
+	sent := atomic.LoadInt64(&node.sentSeq)
+	return sent, sent < queued
 }
 
 func (node *tcpClientNode) setReadDeadline(t time.Time) {
@@ -171,18 +204,13 @@ func (node *tcpClientNode) asyncSendService() {
 	node.wg.Add(1)
 	defer node.wg.Done()
 	for {
-		if node.status&tcpNodeOnline <= 0 {
+		select {
+		case <-node.closed:
 			log.Info("[I] tcp node is closed, clientSendService exit.")
 			return
-		}
-		select {
-		case msg, ok := <-node.sendQueue:
-			if !ok {
-				log.Info("[I] tcp node sendQueue is closed, sendQueue channel closed.")
-				return
-			}
+		case msg := <-node.sendQueue:
 			(*node.conn).SetWriteDeadline(time.Now().Add(time.Second * 30))
-			size, err := (*node.conn).Write(msg)
+			size, err := (*node.conn).Write(msg.data)
 			if err != nil {
 				atomic.AddInt64(&node.sendFailureTimes, int64(1))
 				log.Errorf("[E] tcp send to %s error: %v", (*node.conn).RemoteAddr().String(), err)
@@ -190,8 +218,11 @@ func (node *tcpClientNode) asyncSendService() {
 				node.close()
 				return
 			}
-			if size != len(msg) {
-				log.Errorf("[E] %s send not complete: %v", (*node.conn).RemoteAddr().String(), msg)
+			if size != len(msg.data) {
+				log.Errorf("[E] %s send not complete: %v", (*node.conn).RemoteAddr().String(), msg.data)
+			}
+			if msg.seq > 0 {
+				atomic.StoreInt64(&node.sentSeq, msg.seq)
 			}
 		case <-node.ctx.Ctx.Done():
 			log.Debugf("[D] context is closed, wait for exit, left: %d", len(node.sendQueue))
@@ -47,8 +47,9 @@ func hasCmd(cmd int) bool {
 }
 
 // MatchFilters TODO
+// 没有主题的事件匹配所有的订阅
 func MatchFilters(filters []string, table string) bool {
-	if filters == nil || len(filters) <= 0 {
+	if filters == nil || len(filters) <= 0 || table == "" {
 		return true
 	}
 	for _, f := range filters {